@@ -4,15 +4,52 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"time"
+)
+
+const (
+	// CommandMigrate migrates the database to the latest iteration and seeds it.
+	CommandMigrate = "migrate"
+	// CommandStatus shows which migrations have been applied.
+	CommandStatus = "status"
+	// CommandPlan shows the statements which would run to migrate the database.
+	CommandPlan = "plan"
+	// CommandDown rolls the database back to an earlier iteration.
+	CommandDown = "down"
+	// CommandPurge permanently removes strains which were deleted a while ago.
+	CommandPurge = "purge"
 )
 
 var (
-	Help             bool
-	LogLevel         string
-	DatabaseUsername string
-	DatabasePassword string
-	DatabaseName     string
-	SeedFile         string
+	Help                    bool
+	LogLevel                string
+	DatabaseDriver          string
+	DatabasePath            string
+	DatabaseUsername        string
+	DatabasePassword        string
+	DatabaseName            string
+	DatabaseHost            string
+	DatabasePort            int
+	DatabaseSocket          string
+	DatabaseTLSMode         string
+	DatabaseTLSCA           string
+	DatabaseTLSCert         string
+	DatabaseTLSKey          string
+	DatabaseTimezone        string
+	DatabaseMaxOpenConns    int
+	DatabaseMaxIdleConns    int
+	DatabaseConnMaxLifetime time.Duration
+	DatabaseConnectTimeout  time.Duration
+	SeedFile                string
+	LockTimeout             time.Duration
+	// Command is the command selected on the command line, one of the Command constants.
+	Command string
+	// DownTo is the iteration the database will be rolled back to by the down command.
+	DownTo uint
+	// DryRun shows the statements of the down command without running them.
+	DryRun bool
+	// OlderThan is how long ago strains must have been deleted to be removed by the purge command.
+	OlderThan time.Duration
 )
 
 // Init performs setup for the application CLI commands and flags, setting application version as provided.
@@ -23,15 +60,65 @@ func Init(appName string) {
 		Short: appName,
 		Long:  fmt.Sprintf("%s is a database migration script which will ensure the strain server database is on the correct schema version", appName),
 		Run: func(cmd *cobra.Command, args []string) {
+			Command = CommandMigrate
 		},
 	}
 
 	cmd.PersistentFlags().BoolVarP(&Help, "help", "h", false, "Display this help and exit.")
 	cmd.PersistentFlags().StringVarP(&LogLevel, "log-level", "l", "info", "Log level should be one of trace, debug, info, warn, error, fatal.")
+	cmd.PersistentFlags().StringVar(&DatabaseDriver, "db-driver", "mysql", "Database driver should be one of mysql, sqlite.")
+	cmd.PersistentFlags().StringVar(&DatabasePath, "db-path", "./tms.db", "Path to the database file when using the sqlite driver.")
 	cmd.PersistentFlags().StringVarP(&DatabaseUsername, "db-username", "u", "root", "The username of the database.")
 	cmd.PersistentFlags().StringVarP(&DatabasePassword, "db-password", "p", "password", "The password of the database.")
 	cmd.PersistentFlags().StringVar(&DatabaseName, "db-name", "so_many_strains", "Name of the logical database.")
-	cmd.PersistentFlags().StringVarP(&SeedFile, "database-seed-file", "f", "./strains.json", "Path to JSON strains file which will seed the database.")
+	cmd.PersistentFlags().StringVar(&DatabaseHost, "db-host", "127.0.0.1", "Hostname or IP address of the MySQL server.")
+	cmd.PersistentFlags().IntVar(&DatabasePort, "db-port", 3306, "Port of the MySQL server.")
+	cmd.PersistentFlags().StringVar(&DatabaseSocket, "db-socket", "", "Path to a unix socket for the MySQL server, used instead of host and port.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSMode, "db-tls", "disabled", "MySQL connection encryption should be one of disabled, verify, skip-verify.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSCA, "db-tls-ca", "", "Path to the PEM certificate authority which signed the MySQL server certificate.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSCert, "db-tls-cert", "", "Path to the PEM client certificate for MySQL.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSKey, "db-tls-key", "", "Path to the PEM client key for MySQL.")
+	cmd.PersistentFlags().StringVar(&DatabaseTimezone, "db-timezone", "Local", "Timezone of time values read from MySQL.")
+	cmd.PersistentFlags().IntVar(&DatabaseMaxOpenConns, "db-max-open-conns", 0, "Maximum open database connections, 0 for no limit.")
+	cmd.PersistentFlags().IntVar(&DatabaseMaxIdleConns, "db-max-idle-conns", 2, "Maximum idle database connections kept in the pool.")
+	cmd.PersistentFlags().DurationVar(&DatabaseConnMaxLifetime, "db-conn-max-lifetime", 0, "How long a database connection may be reused, 0 to reuse forever.")
+	cmd.PersistentFlags().DurationVar(&DatabaseConnectTimeout, "db-connect-timeout", 30*time.Second, "How long to keep retrying until the database is reachable.")
+	cmd.PersistentFlags().DurationVar(&LockTimeout, "lock-timeout", time.Minute, "How long to wait for other instances to finish migrating the database.")
+	cmd.Flags().StringVarP(&SeedFile, "database-seed-file", "f", "./strains.json", "Path to JSON strains file which will seed the database.")
+
+	statusCmd := &cobra.Command{
+		Use:   CommandStatus,
+		Short: "Show the current database iteration along with applied and pending migrations.",
+		Run: func(cmd *cobra.Command, args []string) {
+			Command = CommandStatus
+		},
+	}
+	planCmd := &cobra.Command{
+		Use:   CommandPlan,
+		Short: "Show the statements which would run to migrate the database, without running them.",
+		Run: func(cmd *cobra.Command, args []string) {
+			Command = CommandPlan
+		},
+	}
+	downCmd := &cobra.Command{
+		Use:   CommandDown,
+		Short: "Roll the database back to an earlier iteration.",
+		Run: func(cmd *cobra.Command, args []string) {
+			Command = CommandDown
+		},
+	}
+	downCmd.Flags().UintVar(&DownTo, "to", 0, "Iteration to roll the database back to.")
+	downCmd.Flags().BoolVar(&DryRun, "dry-run", false, "Show the statements which would run, without running them.")
+	_ = downCmd.MarkFlagRequired("to")
+	purgeCmd := &cobra.Command{
+		Use:   CommandPurge,
+		Short: "Permanently remove strains which were deleted longer ago than --older-than.",
+		Run: func(cmd *cobra.Command, args []string) {
+			Command = CommandPurge
+		},
+	}
+	purgeCmd.Flags().DurationVar(&OlderThan, "older-than", 30*24*time.Hour, "How long ago strains must have been deleted to be removed.")
+	cmd.AddCommand(statusCmd, planCmd, downCmd, purgeCmd)
 
 	if err := cmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -2,15 +2,13 @@
 package main
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/swtch1/too_many_strains/cmd/database-migration/cli"
 	tms "github.com/swtch1/too_many_strains/pkg"
 	"os"
-)
-
-var (
-	// dbVersion is the desired version of the database
-	dbVersion uint = 1
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
@@ -18,7 +16,71 @@ func main() {
 	tms.InitLogger(os.Stderr, cli.LogLevel, "text", false)
 
 	dbSrv := tms.NewDBServer(cli.DatabaseName, cli.DatabaseUsername, cli.DatabasePassword)
-	dbSrv.DBIteration = dbVersion
+	dbSrv.Driver = cli.DatabaseDriver
+	dbSrv.Path = cli.DatabasePath
+	dbSrv.Host = cli.DatabaseHost
+	dbSrv.Port = cli.DatabasePort
+	dbSrv.Socket = cli.DatabaseSocket
+	dbSrv.TLSMode = cli.DatabaseTLSMode
+	dbSrv.TLSCA = cli.DatabaseTLSCA
+	dbSrv.TLSCert = cli.DatabaseTLSCert
+	dbSrv.TLSKey = cli.DatabaseTLSKey
+	dbSrv.Timezone = cli.DatabaseTimezone
+	dbSrv.MaxOpenConns = cli.DatabaseMaxOpenConns
+	dbSrv.MaxIdleConns = cli.DatabaseMaxIdleConns
+	dbSrv.ConnMaxLifetime = cli.DatabaseConnMaxLifetime
+	dbSrv.ConnectTimeout = cli.DatabaseConnectTimeout
+	dbSrv.DBIteration = tms.LatestIteration()
+	dbSrv.LockTimeout = cli.LockTimeout
+
+	switch cli.Command {
+	case cli.CommandStatus:
+		status(dbSrv)
+	case cli.CommandPlan:
+		steps, err := dbSrv.Plan()
+		if err != nil {
+			log.Fatal(err)
+		}
+		printSteps(steps)
+	case cli.CommandDown:
+		if cli.DryRun {
+			steps, err := dbSrv.PlanDown(cli.DownTo)
+			if err != nil {
+				log.Fatal(err)
+			}
+			printSteps(steps)
+			return
+		}
+		if err := dbSrv.MigrateDown(cli.DownTo); err != nil {
+			log.Fatal(err)
+		}
+	case cli.CommandPurge:
+		purge(dbSrv)
+	default:
+		migrate(dbSrv)
+	}
+}
+
+// purge permanently removes strains which were deleted longer ago than the configured age.
+func purge(dbSrv *tms.DBServer) {
+	if err := dbSrv.Open(); err != nil {
+		log.Fatal(err)
+	}
+	defer dbSrv.Close()
+	if err := dbSrv.CheckSchema(); err != nil {
+		log.Fatal(err)
+	}
+
+	before := time.Now().Add(-cli.OlderThan)
+	purged, err := tms.NewGormStore(dbSrv.DB).PurgeDeletedStrains(before)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("purged %d strains deleted before %s", purged, before.Format(time.RFC3339))
+}
+
+// migrate brings the database to the latest iteration and seeds it with strains.
+func migrate(dbSrv *tms.DBServer) {
 	if err := dbSrv.Migrate(); err != nil {
 		log.Fatal(err)
 	}
@@ -41,9 +103,50 @@ func main() {
 
 	log.Infof("populating database with strains from seed file %s", cli.SeedFile)
 	for _, repr := range strainReprs {
+		if err := repr.Validate(); err != nil {
+			log.WithError(err).Errorf("skipping invalid strain ID %d", repr.ID)
+			continue
+		}
 		repr.DB = dbSrv.DB
-		if err := repr.ReplaceInDB(); err != nil {
+		if _, err := repr.ReplaceInDB(tms.WriteOptions{Author: tms.SeedAuthor}); err != nil {
 			log.WithError(err).Errorf("population failed for strain ID %d", repr.ID)
 		}
 	}
 }
+
+// status prints the current iteration of the database along with applied and pending migrations.
+func status(dbSrv *tms.DBServer) {
+	status, err := dbSrv.Status()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("database iteration: %d (latest %d)\n\n", status.Iteration, status.Latest)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ITERATION\tSTATUS\tAPPLIED AT\tDESCRIPTION")
+	for _, ver := range status.Applied {
+		_, _ = fmt.Fprintf(w, "%d\tapplied\t%s\t%s\n", ver.Iteration, ver.CreatedAt.Format(time.RFC3339), ver.Description)
+	}
+	for _, m := range status.Pending {
+		_, _ = fmt.Fprintf(w, "%d\tpending\t-\t%s\n", m.Iteration, m.Description)
+	}
+	_ = w.Flush()
+}
+
+// printSteps prints the statements of each migration step.
+func printSteps(steps []tms.MigrationStep) {
+	if len(steps) == 0 {
+		fmt.Println("-- nothing to do")
+		return
+	}
+	for _, step := range steps {
+		fmt.Printf("-- iteration %d: %s\n", step.Iteration, step.Description)
+		for _, stmt := range step.Statements {
+			fmt.Printf("%s;\n", stmt)
+		}
+		if step.Rewrite != nil {
+			fmt.Println("-- followed by a data rewrite which is not shown as SQL")
+		}
+		fmt.Println()
+	}
+}
@@ -4,18 +4,40 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"time"
 )
 
 var (
-	Help                bool
-	Version             bool
-	Port                int32
-	DatabaseUsername    string
-	DatabasePassword    string
-	DatabaseName        string
-	LogLevel            string
-	LogFormat           string
-	PrettyPrintJsonLogs bool
+	Help                    bool
+	Version                 bool
+	Port                    int32
+	Storage                 string
+	SeedFile                string
+	AutoMigrate             bool
+	SchemaMismatch          string
+	RequireIfMatch          bool
+	CacheControl            string
+	TrustedProxies          []string
+	DatabaseDriver          string
+	DatabasePath            string
+	DatabaseUsername        string
+	DatabasePassword        string
+	DatabaseName            string
+	DatabaseHost            string
+	DatabasePort            int
+	DatabaseSocket          string
+	DatabaseTLSMode         string
+	DatabaseTLSCA           string
+	DatabaseTLSCert         string
+	DatabaseTLSKey          string
+	DatabaseTimezone        string
+	DatabaseMaxOpenConns    int
+	DatabaseMaxIdleConns    int
+	DatabaseConnMaxLifetime time.Duration
+	DatabaseConnectTimeout  time.Duration
+	LogLevel                string
+	LogFormat               string
+	PrettyPrintJsonLogs     bool
 )
 
 // Init performs setup for the application CLI commands and flags, setting application version as provided.
@@ -32,9 +54,30 @@ func Init(appName, version string) {
 	cmd.PersistentFlags().BoolVarP(&Help, "help", "h", false, "Display this help and exit.")
 	cmd.PersistentFlags().BoolVar(&Version, "version", false, "Print the application version and exit.")
 	cmd.PersistentFlags().Int32VarP(&Port, "port", "P", 8888, "Port which the server will listen on.")
+	cmd.PersistentFlags().StringVar(&Storage, "storage", "database", "Where strains are stored, one of database, memory.")
+	cmd.PersistentFlags().StringVar(&SeedFile, "seed", "", "Path to JSON strains file which will seed the storage on startup.")
+	cmd.PersistentFlags().BoolVar(&AutoMigrate, "auto-migrate", false, "Migrate the database to the latest schema before serving.")
+	cmd.PersistentFlags().StringVar(&SchemaMismatch, "schema-mismatch", "refuse", "What to do when the database schema is not supported, one of refuse, read-only.  Schemas older than the server supports are always refused.")
+	cmd.PersistentFlags().BoolVar(&RequireIfMatch, "require-if-match", false, "Reject writes to strains without an If-Match header, so that clients cannot overwrite changes they have not seen.")
+	cmd.PersistentFlags().StringVar(&CacheControl, "cache-control", "no-cache", "Cache-Control header sent with strains, empty to send none.")
+	cmd.PersistentFlags().StringSliceVar(&TrustedProxies, "trusted-proxy", nil, "IP address or CIDR network of a proxy whose X-Forwarded-Proto and X-Forwarded-Host headers are used in links, can be repeated.")
+	cmd.PersistentFlags().StringVar(&DatabaseDriver, "db-driver", "mysql", "Database driver should be one of mysql, sqlite.")
+	cmd.PersistentFlags().StringVar(&DatabasePath, "db-path", "./tms.db", "Path to the database file when using the sqlite driver.")
 	cmd.PersistentFlags().StringVarP(&DatabaseUsername, "db-username", "u", "root", "Database username.")
 	cmd.PersistentFlags().StringVarP(&DatabasePassword, "db-password", "p", "password", "Database password.")
 	cmd.PersistentFlags().StringVar(&DatabaseName, "db-name", "so_many_strains", "Name of the logical database.")
+	cmd.PersistentFlags().StringVar(&DatabaseHost, "db-host", "127.0.0.1", "Hostname or IP address of the MySQL server.")
+	cmd.PersistentFlags().IntVar(&DatabasePort, "db-port", 3306, "Port of the MySQL server.")
+	cmd.PersistentFlags().StringVar(&DatabaseSocket, "db-socket", "", "Path to a unix socket for the MySQL server, used instead of host and port.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSMode, "db-tls", "disabled", "MySQL connection encryption should be one of disabled, verify, skip-verify.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSCA, "db-tls-ca", "", "Path to the PEM certificate authority which signed the MySQL server certificate.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSCert, "db-tls-cert", "", "Path to the PEM client certificate for MySQL.")
+	cmd.PersistentFlags().StringVar(&DatabaseTLSKey, "db-tls-key", "", "Path to the PEM client key for MySQL.")
+	cmd.PersistentFlags().StringVar(&DatabaseTimezone, "db-timezone", "Local", "Timezone of time values read from MySQL.")
+	cmd.PersistentFlags().IntVar(&DatabaseMaxOpenConns, "db-max-open-conns", 0, "Maximum open database connections, 0 for no limit.")
+	cmd.PersistentFlags().IntVar(&DatabaseMaxIdleConns, "db-max-idle-conns", 2, "Maximum idle database connections kept in the pool.")
+	cmd.PersistentFlags().DurationVar(&DatabaseConnMaxLifetime, "db-conn-max-lifetime", 0, "How long a database connection may be reused, 0 to reuse forever.")
+	cmd.PersistentFlags().DurationVar(&DatabaseConnectTimeout, "db-connect-timeout", 30*time.Second, "How long to keep retrying until the database is reachable.")
 	cmd.PersistentFlags().StringVarP(&LogLevel, "log-level", "l", "info", "Log level should be one of trace, debug, info, warn, error, fatal.")
 	cmd.PersistentFlags().StringVar(&LogFormat, "log-format", "text", "Log format should be one of text, json.")
 	cmd.PersistentFlags().BoolVar(&PrettyPrintJsonLogs, "pretty-json", false, "If writing JSON logs, pretty print those logs.")
@@ -23,19 +23,97 @@ func main() {
 	cli.Init(appName, buildVersion)
 	tms.InitLogger(os.Stderr, cli.LogLevel, cli.LogFormat, cli.PrettyPrintJsonLogs)
 
-	db := tms.DBServer{
-		Username: cli.DatabaseUsername,
-		Password: cli.DatabasePassword,
-		Name:     cli.DatabaseName,
+	var store tms.StrainStore
+	var readOnly bool
+	suggestions := tms.NewSuggestIndex()
+	switch cli.Storage {
+	case "database":
+		db := tms.DBServer{
+			Driver:          cli.DatabaseDriver,
+			Path:            cli.DatabasePath,
+			Username:        cli.DatabaseUsername,
+			Password:        cli.DatabasePassword,
+			Name:            cli.DatabaseName,
+			Host:            cli.DatabaseHost,
+			Port:            cli.DatabasePort,
+			Socket:          cli.DatabaseSocket,
+			TLSMode:         cli.DatabaseTLSMode,
+			TLSCA:           cli.DatabaseTLSCA,
+			TLSCert:         cli.DatabaseTLSCert,
+			TLSKey:          cli.DatabaseTLSKey,
+			Timezone:        cli.DatabaseTimezone,
+			MaxOpenConns:    cli.DatabaseMaxOpenConns,
+			MaxIdleConns:    cli.DatabaseMaxIdleConns,
+			ConnMaxLifetime: cli.DatabaseConnMaxLifetime,
+			ConnectTimeout:  cli.DatabaseConnectTimeout,
+		}
+		if cli.AutoMigrate {
+			if err := db.Migrate(); err != nil && err != tms.ErrDatabaseVersionNewer {
+				log.Fatal(err)
+			}
+		} else if err := db.Open(); err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := db.CheckSchema(); err != nil {
+			switch cli.SchemaMismatch {
+			case "read-only":
+				if err := db.CheckSchemaReadable(); err != nil {
+					log.WithError(err).Fatal("database schema cannot be read, refusing to start")
+				}
+				log.WithError(err).Warn("database schema is not supported, starting in read-only mode")
+				readOnly = true
+			case "refuse":
+				log.WithError(err).Fatal("database schema is not supported, refusing to start")
+			default:
+				log.Fatalf("unexpected schema mismatch option %s", cli.SchemaMismatch)
+			}
+		}
+		if err := suggestions.LoadFromDB(db.DB); err != nil {
+			if !readOnly {
+				log.WithError(err).Fatal("unable to load suggestions")
+			}
+			log.WithError(err).Warn("unable to load suggestions, nothing will be suggested")
+		}
+		store = tms.NewGormStore(db.DB)
+	case "memory":
+		log.Warn("using in-memory storage, strains will not be persisted")
+		store = tms.NewMemoryStore()
+	default:
+		log.Fatalf("unexpected storage %s", cli.Storage)
+	}
+	fullText := tms.NewTextIndex()
+	if err := fullText.Load(store); err != nil {
+		if !readOnly {
+			log.WithError(err).Fatal("unable to build full text index")
+		}
+		log.WithError(err).Warn("unable to build full text index, full text searches will find nothing")
+	}
+	store = tms.NewIndexedStore(store, suggestions, fullText)
+
+	if cli.SeedFile != "" {
+		if readOnly {
+			log.Warnf("not seeding from %s while read-only", cli.SeedFile)
+		} else {
+			seed(store, cli.SeedFile)
+		}
 	}
-	if err := db.Open(); err != nil {
-		log.Fatal(err)
+
+	trustedProxies, err := tms.ParseTrustedProxies(cli.TrustedProxies)
+	if err != nil {
+		log.WithError(err).Fatal("invalid trusted proxy")
 	}
-	defer db.Close()
 
 	srv := tms.Server{
-		Port: cli.Port,
-		DB:   db.DB,
+		Port:           cli.Port,
+		Store:          store,
+		ReadOnly:       readOnly,
+		RequireIfMatch: cli.RequireIfMatch,
+		CacheControl:   cli.CacheControl,
+		Suggestions:    suggestions,
+		FullText:       fullText,
+		TrustedProxies: trustedProxies,
 	}
 
 	go HandleInterrupt()
@@ -43,6 +121,31 @@ func main() {
 	log.Fatal(srv.ListenAndServe())
 }
 
+// seed populates the store with strains from the seed file.
+func seed(store tms.StrainStore, path string) {
+	log.Tracef("reading seed file %s", path)
+	seedFile, err := os.Open(path)
+	if err != nil {
+		log.WithError(err).Fatalf("unable to read seed file %s", path)
+	}
+	defer seedFile.Close()
+	strainReprs, err := tms.ParseStrains(seedFile)
+	if err != nil {
+		log.WithError(err).Fatalf("unable to parse seed file %s", path)
+	}
+
+	log.Infof("populating storage with strains from seed file %s", path)
+	for _, repr := range strainReprs {
+		if err := repr.Validate(); err != nil {
+			log.WithError(err).Errorf("skipping invalid strain ID %d", repr.ID)
+			continue
+		}
+		if _, err := store.ReplaceStrain(repr, tms.WriteOptions{Author: tms.SeedAuthor}); err != nil {
+			log.WithError(err).Errorf("population failed for strain ID %d", repr.ID)
+		}
+	}
+}
+
 // HandleInterrupt will immediately terminate the server if it detects an interrupt signal.
 func HandleInterrupt() {
 	sigs := make(chan os.Signal, 1)
@@ -3,11 +3,13 @@ module github.com/swtch1/too_many_strains
 go 1.13
 
 require (
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/gorilla/mux v1.7.3
 	github.com/jinzhu/gorm v1.9.11
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/errors v0.8.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
 	github.com/stretchr/testify v1.3.0
-	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/text v0.16.0
 )
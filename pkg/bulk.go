@@ -0,0 +1,190 @@
+package tms
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// BulkAction is the write a bulk write makes to each of its strains.
+type BulkAction string
+
+const (
+	// BulkCreate creates strains, failing for those which already exist.
+	BulkCreate BulkAction = "create"
+	// BulkReplace creates strains or replaces every attribute of those which already exist.
+	BulkReplace BulkAction = "replace"
+	// BulkDelete deletes strains, failing for those which do not exist.
+	BulkDelete BulkAction = "delete"
+)
+
+// BulkMode is what a bulk write does when some of its strains cannot be written.
+type BulkMode string
+
+const (
+	// BulkAtomic writes every strain or, if any of them cannot be written, none of them.
+	BulkAtomic BulkMode = "atomic"
+	// BulkBestEffort writes every strain which can be written, skipping those which cannot.
+	BulkBestEffort BulkMode = "best_effort"
+)
+
+const (
+	// NDJSONContentType is the media type of a stream of JSON values with one on each line.
+	NDJSONContentType = "application/x-ndjson"
+	// MaxBulkWrites is the most strains written by a single bulk write.
+	MaxBulkWrites = 1000
+	// MaxBulkBodySize is the largest body of a bulk write request, in bytes.
+	MaxBulkBodySize = 8 << 20
+)
+
+var (
+	ErrInvalidBulkMode   = fmt.Errorf("mode must be %s or %s", BulkAtomic, BulkBestEffort)
+	ErrTooManyBulkWrites = fmt.Errorf("at most %d strains can be written at once", MaxBulkWrites)
+	ErrBulkBodyTooLarge  = fmt.Errorf("the body of a bulk write can be at most %d bytes", MaxBulkBodySize)
+	// ErrBulkAborted is the error of a write which was not kept because another write of the same atomic bulk write
+	// failed.
+	ErrBulkAborted = errors.New("not written as another strain of the atomic bulk write could not be written")
+)
+
+// BulkWrite is a single write of a bulk write.
+type BulkWrite struct {
+	Action BulkAction
+	// Strain is the strain to create or replace.  Only its ID is used to delete it.
+	Strain StrainRepr
+}
+
+// BulkOutcome is the outcome of a single write of a bulk write.
+type BulkOutcome struct {
+	// Err is why the write failed, or nil if it was made.
+	Err error
+	// Created is set when the write created the strain, as a replace does when the strain does not exist.
+	Created bool
+}
+
+// ParseBulkMode parses the mode of a bulk write, which is BulkAtomic if empty.
+func ParseBulkMode(mode string) (BulkMode, error) {
+	switch BulkMode(mode) {
+	case "", BulkAtomic:
+		return BulkAtomic, nil
+	case BulkBestEffort:
+		return BulkBestEffort, nil
+	}
+	return "", ErrInvalidBulkMode
+}
+
+// ParseBulkStrains populates a StrainReprs from src, which is either a JSON list of strains or, when ndjson is set,
+// a strain on each line.  Unlike ParseStrains, a strain with unknown fields or fields of the wrong type does not stop
+// the others from being parsed, and its *ValidationError is returned at the same index of errs.  An error is
+// returned if src is not a list of JSON values, and ErrTooManyBulkWrites if it lists more than MaxBulkWrites.
+func ParseBulkStrains(src io.Reader, ndjson bool) (reprs StrainReprs, errs []error, err error) {
+	raw, err := readBulk(src, ndjson)
+	if err == ErrTooManyBulkWrites {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to unmarshal strains")
+	}
+	reprs = make(StrainReprs, len(raw))
+	errs = make([]error, len(raw))
+	for i, rb := range raw {
+		reprs[i], errs[i] = unmarshalStrain(rb)
+		if _, ok := errs[i].(*ValidationError); errs[i] != nil && !ok {
+			return nil, nil, errors.Wrapf(errs[i], "unable to unmarshal strain at index %d", i)
+		}
+	}
+	return reprs, errs, nil
+}
+
+// ParseStrainIDs parses a list of strain reference IDs from src, which is either a JSON list of IDs or, when ndjson is
+// set, an ID on each line.  ErrTooManyBulkWrites is returned if it lists more than MaxBulkWrites.
+func ParseStrainIDs(src io.Reader, ndjson bool) ([]uint, error) {
+	raw, err := readBulk(src, ndjson)
+	if err == ErrTooManyBulkWrites {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal strain IDs")
+	}
+	ids := make([]uint, len(raw))
+	for i, rb := range raw {
+		if err := json.Unmarshal(rb, &ids[i]); err != nil || ids[i] == 0 {
+			return nil, errors.Errorf("strain ID at index %d must be a positive integer", i)
+		}
+	}
+	return ids, nil
+}
+
+// readBulk splits src into the JSON values of a bulk write.  Blank lines between the values of ndjson are skipped.
+// The values are read one at a time, and ErrTooManyBulkWrites is returned as soon as there are more than
+// MaxBulkWrites of them, without reading the rest of src.
+func readBulk(src io.Reader, ndjson bool) ([]json.RawMessage, error) {
+	var raw []json.RawMessage
+	if !ndjson {
+		dec := json.NewDecoder(src)
+		if tok, err := dec.Token(); err != nil {
+			return nil, err
+		} else if tok != json.Delim('[') {
+			return nil, errors.New("not a JSON list")
+		}
+		for dec.More() {
+			if len(raw) == MaxBulkWrites {
+				return nil, ErrTooManyBulkWrites
+			}
+			var rb json.RawMessage
+			if err := dec.Decode(&rb); err != nil {
+				return nil, err
+			}
+			raw = append(raw, rb)
+		}
+		// the end of the list, which must be the end of src
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			if err == nil {
+				err = errors.New("data after the JSON list")
+			}
+			return nil, err
+		}
+		return raw, nil
+	}
+
+	r := bufio.NewReader(src)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			if !json.Valid(b) {
+				return nil, errors.Errorf("line %d is not valid JSON", line)
+			}
+			if len(raw) == MaxBulkWrites {
+				return nil, ErrTooManyBulkWrites
+			}
+			raw = append(raw, json.RawMessage(b))
+		}
+		if err == io.EOF {
+			return raw, nil
+		}
+	}
+}
+
+// abortBulk marks the writes of an atomic bulk write which did not fail themselves as aborted, once another of them
+// has failed and none of them are kept.  It reports whether any write failed.
+func abortBulk(outcomes []BulkOutcome) bool {
+	failed := false
+	for _, o := range outcomes {
+		failed = failed || o.Err != nil
+	}
+	if !failed {
+		return false
+	}
+	for i, o := range outcomes {
+		if o.Err == nil {
+			outcomes[i] = BulkOutcome{Err: ErrBulkAborted}
+		}
+	}
+	return true
+}
@@ -0,0 +1,235 @@
+package tms
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParsingBulkStrains(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		src       string
+		ndjson    bool
+		expIDs    []uint
+		expFields [][]string
+		expErr    string
+	}{
+		{"list", `[{"id":1,"name":"foo"},{"id":2,"name":"bar"}]`, false, []uint{1, 2}, [][]string{nil, nil}, ""},
+		{"ndjson", "{\"id\":1,\"name\":\"foo\"}\n\n  {\"id\":2,\"name\":\"bar\"}  \r\n", true, []uint{1, 2}, [][]string{nil, nil}, ""},
+		{"ndjson_without_final_newline", `{"id":1,"name":"foo"}`, true, []uint{1}, [][]string{nil}, ""},
+		{"empty_list", `[]`, false, []uint{}, [][]string{}, ""},
+		{"invalid_strain", `[{"id":1,"colour":"green"},{"id":"2"},{"id":3}]`, false, []uint{1, 0, 3}, [][]string{{"colour"}, {"id"}, nil}, ""},
+		{"not_a_list", `{"id":1,"name":"foo"}`, false, nil, nil, "unable to unmarshal strains"},
+		{"malformed_list", `[{"id":1,"name":"foo"}`, false, nil, nil, "unable to unmarshal strains"},
+		{"malformed_line", "{\"id\":1}\n{\"id\":2\n", true, nil, nil, "line 2 is not valid JSON"},
+		{"data_after_list", `[{"id":1}] {"id":2}`, false, nil, nil, "unable to unmarshal strains"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reprs, errs, err := ParseBulkStrains(bytes.NewBufferString(tt.src), tt.ndjson)
+			if tt.expErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tt.expErr)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			ids := []uint{}
+			fields := [][]string{}
+			for i, repr := range reprs {
+				ids = append(ids, repr.ID)
+				var f []string
+				if verr, ok := errs[i].(*ValidationError); ok {
+					for _, fe := range verr.Fields {
+						f = append(f, fe.Field)
+					}
+				}
+				fields = append(fields, f)
+			}
+			assert.Equal(t, tt.expIDs, ids)
+			assert.Equal(t, tt.expFields, fields)
+		})
+	}
+}
+
+func TestParsingStrainIDs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		src    string
+		ndjson bool
+		expIDs []uint
+		expErr string
+	}{
+		{"list", `[3, 1, 2]`, false, []uint{3, 1, 2}, ""},
+		{"ndjson", "3\n1\n\n2\n", true, []uint{3, 1, 2}, ""},
+		{"zero", `[1, 0]`, false, nil, "strain ID at index 1 must be a positive integer"},
+		{"negative", `[-1]`, false, nil, "strain ID at index 0 must be a positive integer"},
+		{"string", "1\n\"2\"", true, nil, "strain ID at index 1 must be a positive integer"},
+		{"strains", `[{"id":1}]`, false, nil, "strain ID at index 0 must be a positive integer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := ParseStrainIDs(bytes.NewBufferString(tt.src), tt.ndjson)
+			if tt.expErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Contains(t, err.Error(), tt.expErr)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expIDs, ids)
+		})
+	}
+}
+
+func TestParsingTooManyBulkWritesStopsReading(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// reading past the value after the last of MaxBulkWrites fails the test
+	unread := func(head string) io.Reader {
+		return io.MultiReader(strings.NewReader(head), readerFunc(func([]byte) (int, error) {
+			return 0, errors.New("read past the first write too many")
+		}))
+	}
+	list := "[" + strings.Repeat(`{"id":1},`, MaxBulkWrites+1)
+	ndjson := strings.Repeat("{\"id\":1}\n", MaxBulkWrites+1)
+
+	_, _, err := ParseBulkStrains(unread(list), false)
+	assert.Equal(ErrTooManyBulkWrites, err)
+	_, _, err = ParseBulkStrains(unread(ndjson), true)
+	assert.Equal(ErrTooManyBulkWrites, err)
+	_, err = ParseStrainIDs(unread("["+strings.Repeat("1,", MaxBulkWrites+1)), false)
+	assert.Equal(ErrTooManyBulkWrites, err)
+	_, err = ParseStrainIDs(unread(strings.Repeat("1\n", MaxBulkWrites+1)), true)
+	assert.Equal(ErrTooManyBulkWrites, err)
+
+	ids, err := ParseStrainIDs(strings.NewReader(strings.Repeat("1\n", MaxBulkWrites)), true)
+	assert.Nil(err)
+	assert.Len(ids, MaxBulkWrites)
+}
+
+// readerFunc is an io.Reader which reads by calling the function.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestParsingBulkMode(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	for mode, exp := range map[string]BulkMode{"": BulkAtomic, "atomic": BulkAtomic, "best_effort": BulkBestEffort} {
+		m, err := ParseBulkMode(mode)
+		assert.Nil(err)
+		assert.Equal(exp, m)
+	}
+	_, err := ParseBulkMode("all")
+	assert.Equal(ErrInvalidBulkMode, err)
+}
+
+func TestMemoryStoreWritingStrainsInBulk(t *testing.T) {
+	t.Parallel()
+	testWritingStrainsInBulk(t, NewMemoryStore(), 1, 2, 3)
+}
+
+// testWritingStrainsInBulk tests bulk writes through store, using strains with the reference IDs a, b and c which
+// must not exist yet.
+func testWritingStrainsInBulk(t *testing.T, store StrainStore, a, b, c uint) {
+	assert := assert.New(t)
+	strain := func(id uint, name string) StrainRepr {
+		return StrainRepr{ID: id, Name: name, Race: "Indica", Flavors: []string{"earthy"}}
+	}
+	write := func(action BulkAction, repr StrainRepr) BulkWrite {
+		return BulkWrite{Action: action, Strain: repr}
+	}
+	get := func(id uint) Strain {
+		s, err := store.StrainByRefID(id)
+		assert.Nil(err)
+		return s
+	}
+
+	outcomes, err := store.WriteStrains([]BulkWrite{
+		write(BulkCreate, strain(a, "Afpak")),
+		write(BulkCreate, strain(b, "Afghani")),
+	}, BulkAtomic, WriteOptions{Author: "alice"})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Created: true}, {Created: true}}, outcomes)
+	s := get(a)
+	assert.Equal("indica", s.Race)
+	assert.Equal("Earthy", s.ToStrainRepr().Flavors[0])
+	history, err := store.StrainHistory(b)
+	assert.Nil(err)
+	if assert.Len(history, 1) {
+		assert.Equal("alice", history[0].Author)
+	}
+
+	// an atomic write which fails in part writes nothing
+	failing := []BulkWrite{
+		write(BulkCreate, strain(c, "Alaska")),
+		write(BulkReplace, strain(a, "Afpak Kush")),
+		write(BulkCreate, strain(b, "Afghani")),
+	}
+	outcomes, err = store.WriteStrains(failing, BulkAtomic, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Err: ErrBulkAborted}, {Err: ErrBulkAborted}, {Err: ErrRecordAlreadyExists}}, outcomes)
+	_, err = store.StrainByRefID(c)
+	assert.Equal(ErrNotExists, err)
+	_, err = store.StrainHistory(c)
+	assert.Equal(ErrNotExists, err)
+	s = get(a)
+	assert.Equal("Afpak", s.Name)
+	assert.Equal(uint(1), s.Revision)
+
+	// while a best effort write makes the writes which can be made
+	outcomes, err = store.WriteStrains(failing, BulkBestEffort, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Created: true}, {}, {Err: ErrRecordAlreadyExists}}, outcomes)
+	assert.Equal("Alaska", get(c).Name)
+	s = get(a)
+	assert.Equal("Afpak Kush", s.Name)
+	assert.Equal(uint(2), s.Revision)
+
+	deletes := []BulkWrite{write(BulkDelete, StrainRepr{ID: b}), write(BulkDelete, StrainRepr{ID: b})}
+	outcomes, err = store.WriteStrains(deletes, BulkAtomic, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Err: ErrBulkAborted}, {Err: ErrNotExists}}, outcomes)
+	assert.Equal("Afghani", get(b).Name)
+	outcomes, err = store.WriteStrains(deletes, BulkBestEffort, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{}, {Err: ErrNotExists}}, outcomes)
+	_, err = store.StrainByRefID(b)
+	assert.Equal(ErrNotExists, err)
+
+	// writes of an atomic write see the writes before them
+	outcomes, err = store.WriteStrains([]BulkWrite{
+		write(BulkCreate, strain(b, "Afghani")),
+		write(BulkReplace, strain(b, "Afghani #1")),
+		write(BulkDelete, StrainRepr{ID: c}),
+	}, BulkAtomic, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Created: true}, {}, {}}, outcomes)
+	assert.Equal("Afghani #1", get(b).Name)
+	_, err = store.StrainByRefID(c)
+	assert.Equal(ErrNotExists, err)
+
+	// a replace creates a strain which does not exist, as it does on its own
+	outcomes, err = store.WriteStrains([]BulkWrite{
+		write(BulkReplace, strain(c, "Alaska")),
+		write(BulkReplace, strain(c, "Alaska #1")),
+	}, BulkBestEffort, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Created: true}, {}}, outcomes)
+	assert.Equal("Alaska #1", get(c).Name)
+}
@@ -1,30 +1,110 @@
 package tms
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
 )
 
-const DBConnectOptions = "charset=utf8&parseTime=True&loc=Local"
+const (
+	// DefaultHost and DefaultPort are where MySQL is reached when no host, port or socket is configured.
+	DefaultHost = "127.0.0.1"
+	DefaultPort = 3306
+	// SQLiteConnectOptions are appended to the SQLite database path.  Writers wait on each other rather than
+	// failing immediately with a locked database, and transactions take the write lock when they begin so that
+	// a transaction which reads before writing cannot deadlock with another writer.
+	SQLiteConnectOptions = "_busy_timeout=5000&_txlock=immediate"
+)
+
+const (
+	// TLSModeDisabled connects to MySQL without encryption.
+	TLSModeDisabled = "disabled"
+	// TLSModeVerify encrypts the MySQL connection and verifies the server certificate.
+	TLSModeVerify = "verify"
+	// TLSModeSkipVerify encrypts the MySQL connection without verifying the server certificate.
+	TLSModeSkipVerify = "skip-verify"
+)
+
+const (
+	// connectBackoffStart and connectBackoffMax bound the wait between attempts to reach the database.
+	connectBackoffStart = 250 * time.Millisecond
+	connectBackoffMax   = 10 * time.Second
+)
+
+const (
+	// DriverMySQL connects to a MySQL database server.
+	DriverMySQL = "mysql"
+	// DriverSQLite uses a SQLite database file, for single node and embedded deployments.
+	DriverSQLite = "sqlite"
+)
 
 var (
 	ErrDatabaseNameNotSet     = errors.New("database name was not set")
 	ErrDatabaseUsernameNotSet = errors.New("database username was not set")
+	ErrDatabasePathNotSet     = errors.New("database path was not set")
+	ErrUnsupportedDriver      = errors.New("unsupported database driver")
+	ErrUnsupportedTLSMode     = errors.New("unsupported TLS mode")
+	ErrInvalidTLSCA           = errors.New("no certificates found in TLS certificate authority file")
 	ErrDatabaseVersionNewer   = errors.New("the actual database version is newer than the desired migration version")
+	ErrDatabaseVersionOlder   = errors.New("the actual database version is older than the desired rollback version")
 )
 
 // DBServer is the database server where records will be stored and queried.
 type DBServer struct {
+	// Driver is the database backend, one of DriverMySQL or DriverSQLite.  DriverMySQL is used if unset.
+	Driver string
+	// Path is the SQLite database file, which will be created if it does not exist.  Only used with DriverSQLite.
+	Path string
 	// Name of the logical database on the server.
 	Name string
-	// DBIteration tracks the current iteration of the database schema.  Migrate() must be called on the
-	// database to ensure the current schema is up to date with DBIteration.
+	// DBIteration is the desired iteration of the database schema.  Migrate() must be called on the
+	// database to ensure the current schema is up to date with DBIteration.  The latest iteration is used if unset.
 	DBIteration uint
+	// Migrations are applied to the database by Migrate().  The package Migrations are used if unset.
+	Migrations []Migration
+	// MinIteration is the oldest schema iteration accepted by CheckSchema().  MinSchemaIteration is used if unset.
+	MinIteration uint
+	// LockTimeout is how long Migrate() waits for other instances to finish migrating the same database.
+	// DefaultMigrationLockTimeout is used if unset.
+	LockTimeout time.Duration
 	Username    string
 	Password    string
+	// Host is the hostname or IP address of the MySQL server.  DefaultHost is used if unset.
+	Host string
+	// Port is the port of the MySQL server.  DefaultPort is used if unset.
+	Port int
+	// Socket is the path of a unix socket to reach MySQL through.  Host and Port are ignored if it is set.
+	Socket string
+	// TLSMode is how the MySQL connection is encrypted, one of TLSModeDisabled, TLSModeVerify or TLSModeSkipVerify.
+	// TLSModeDisabled is used if unset.
+	TLSMode string
+	// TLSCA is the path to a PEM encoded certificate authority which signed the MySQL server certificate.
+	TLSCA string
+	// TLSCert and TLSKey are paths to a PEM encoded client certificate and key, for servers which require them.
+	TLSCert string
+	TLSKey  string
+	// Timezone is the location of time values read from MySQL, such as "UTC" or "America/Chicago".  The local
+	// timezone is used if unset.
+	Timezone string
+	// MaxOpenConns limits the connections open to the database.  There is no limit if unset.
+	MaxOpenConns int
+	// MaxIdleConns limits the idle connections kept in the pool.  The database/sql default is used if unset.
+	MaxIdleConns int
+	// ConnMaxLifetime is how long a connection may be reused.  Connections are reused forever if unset.
+	ConnMaxLifetime time.Duration
+	// ConnectTimeout is how long to keep retrying, with backoff, until the database is reachable.  The database is
+	// only tried once if unset.
+	ConnectTimeout time.Duration
 
 	// DB is the database connection through which all transactions are brokered.
 	DB *gorm.DB
@@ -47,81 +127,330 @@ func (srv *DBServer) Open() error {
 		return err
 	}
 
-	db, err := gorm.Open("mysql", fmt.Sprintf("%s:%s@/%s?%s", srv.Username, srv.Password, srv.Name, DBConnectOptions))
+	db, err := srv.connect(srv.Name)
 	if err != nil {
-		return errors.Wrapf(err, "unable to connect to database '%s", srv.Name)
+		return err
 	}
-	srv.isOpen = true
 	db.SingularTable(true)
+	// timestamps are written in UTC, whatever the local time zone, so that SQLite compares them correctly as text
+	db.SetNowFuncOverride(dbNow)
 	// handle and log errors as they are received
 	db.LogMode(false)
-	// don't timeout our connection
-	db.DB().SetConnMaxLifetime(0)
-
-	if err := db.DB().Ping(); err != nil {
-		return errors.Wrapf(err, "unable to ping database %s after connection", srv.Name)
+	db.DB().SetConnMaxLifetime(srv.ConnMaxLifetime)
+	if srv.MaxIdleConns > 0 {
+		db.DB().SetMaxIdleConns(srv.MaxIdleConns)
+	}
+	db.DB().SetMaxOpenConns(srv.MaxOpenConns)
+	if srv.driver() == DriverSQLite {
+		// SQLite allows a single writer, so funnel everything through one connection instead of failing
+		// with locking errors under concurrent use
+		db.DB().SetMaxOpenConns(1)
 	}
+	srv.isOpen = true
 
 	srv.DB = db
 	return nil
 }
 
+// dbNow is the time written to the database as the current time.
+func dbNow() time.Time {
+	return time.Now().UTC()
+}
+
 // Close terminates the connection with the database.
 func (srv *DBServer) Close() error {
 	srv.isOpen = false
 	return srv.DB.Close()
 }
 
-// Migrate will migrate the database to ensure the current version of the schema.
+// Migrate will migrate the database from its current iteration to DBIteration, applying each pending migration
+// in order.  Each migration runs in its own transaction and is recorded in the database version table.  On SQLite a
+// migration which fails is rolled back entirely.  MySQL commits schema changes as they are made, so a migration
+// which fails there may be left partly applied and unrecorded, and is run again in full by the next Migrate().
+// Instances migrating the same database take turns, so each migration is recorded exactly once.
 func (srv *DBServer) Migrate() error {
-	if srv.DBIteration == 0 {
-		srv.DBIteration = 1
-	}
-
 	if err := srv.ensureDatabase(); err != nil {
 		return errors.Wrap(err, "unable to create database")
 	}
-	if !srv.isOpen {
-		if err := srv.Open(); err != nil {
-			return errors.Wrapf(err, "unable to open database connection")
+	if err := srv.prepareMigrations(); err != nil {
+		return err
+	}
+	unlock, err := srv.lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := srv.DB.AutoMigrate(&DatabaseVer{}).Error; err != nil {
+		return errors.Wrap(err, "unable to create database version table")
+	}
+
+	steps, err := srv.Plan()
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		log.Infof("database version %d is already the latest", srv.DBIteration)
+		return nil
+	}
+	log.Infof("database is behind desired version %d, migrating", srv.DBIteration)
+
+	for _, step := range steps {
+		log.Infof("applying migration %d: %s", step.Iteration, step.Description)
+		ver := DatabaseVer{Iteration: step.Iteration, Description: step.Description}
+		record := func(tx *gorm.DB) error {
+			return tx.Create(&ver).Error
+		}
+		if err := srv.runStep(step, record); err != nil {
+			return errors.Wrapf(err, "unable to update database to iteration %d", step.Iteration)
 		}
 	}
+	return nil
+}
 
-	srv.DB.SingularTable(true)
-	srv.DB.AutoMigrate(
-		&DatabaseVer{},
-		&Strain{},
-		&Flavor{},
-		&Effect{},
-	)
-	if err := srv.updateSchemaVersion(); err != nil {
-		return errors.Wrapf(err, "unable to update database to iteration %d", srv.DBIteration)
+// MigrateDown rolls the database back from its current iteration to the given iteration, reversing each applied
+// migration in turn.  Rolling back to iteration 0 removes every table managed by the migrations.
+func (srv *DBServer) MigrateDown(to uint) error {
+	if err := srv.prepareMigrations(); err != nil {
+		return err
+	}
+	unlock, err := srv.lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	steps, err := srv.PlanDown(to)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		log.Infof("database version %d is already at the desired version", to)
+		return nil
+	}
+
+	for _, step := range steps {
+		log.Infof("rolling back migration %d: %s", step.Iteration, step.Description)
+		iteration := step.Iteration
+		unrecord := func(tx *gorm.DB) error {
+			return tx.Unscoped().Where("iteration = ?", iteration).Delete(&DatabaseVer{}).Error
+		}
+		if err := srv.runStep(step, unrecord); err != nil {
+			return errors.Wrapf(err, "unable to roll back database from iteration %d", step.Iteration)
+		}
 	}
 	return nil
 }
 
-// updateSchemaVersion ensures the database version is set in the database.
-func (srv *DBServer) updateSchemaVersion() error {
-	var verFromDB DatabaseVer
-	srv.DB.Last(&verFromDB)
+// MigrationStep is a migration along with the statements which will run for it on this database.
+type MigrationStep struct {
+	Migration
+	Statements []string
+	// Rewrite is run after Statements to rewrite data in Go, if set.  Only steps up have a rewrite.
+	Rewrite func(tx *gorm.DB) error
+}
+
+// Plan gets the steps which Migrate() would run to bring the database to DBIteration, without running them.
+func (srv *DBServer) Plan() ([]MigrationStep, error) {
+	if err := srv.prepareMigrations(); err != nil {
+		return nil, err
+	}
+	current, err := srv.SchemaIteration()
+	if err != nil {
+		return nil, err
+	}
+	if current > srv.DBIteration {
+		log.Debugf("version from database %d is greater than desired iteration %d", current, srv.DBIteration)
+		return nil, ErrDatabaseVersionNewer
+	}
+
+	var steps []MigrationStep
+	for _, m := range srv.migrations() {
+		if m.Iteration > current && m.Iteration <= srv.DBIteration {
+			steps = append(steps, MigrationStep{Migration: m, Statements: m.Up[srv.driver()], Rewrite: m.UpRewrite})
+		}
+	}
+	return steps, nil
+}
+
+// PlanDown gets the steps which MigrateDown() would run to bring the database back to the given iteration,
+// without running them.
+func (srv *DBServer) PlanDown(to uint) ([]MigrationStep, error) {
+	if err := srv.prepareMigrations(); err != nil {
+		return nil, err
+	}
+	current, err := srv.SchemaIteration()
+	if err != nil {
+		return nil, err
+	}
+	if current < to {
+		log.Debugf("version from database %d is less than desired iteration %d", current, to)
+		return nil, ErrDatabaseVersionOlder
+	}
+
+	var steps []MigrationStep
+	migrations := srv.migrations()
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Iteration <= current && m.Iteration > to {
+			steps = append(steps, MigrationStep{Migration: m, Statements: m.Down[srv.driver()]})
+		}
+	}
+	return steps, nil
+}
+
+// MigrationStatus describes which migrations have been applied to the database.
+type MigrationStatus struct {
+	// Iteration is the current iteration of the database schema.
+	Iteration uint
+	// Latest is the iteration the database will be on once all migrations are applied.
+	Latest uint
+	// Applied holds the record of each applied migration, in order.
+	Applied []DatabaseVer
+	// Pending holds each migration which has not been applied, in order.
+	Pending []Migration
+}
+
+// Status gets the migration status of the database.
+func (srv *DBServer) Status() (MigrationStatus, error) {
+	status := MigrationStatus{Latest: latestIteration(srv.migrations())}
+	if err := srv.prepareMigrations(); err != nil {
+		return status, err
+	}
+	var err error
+	status.Iteration, err = srv.SchemaIteration()
+	if err != nil {
+		return status, err
+	}
+	if status.Iteration > 0 {
+		if err := srv.DB.Order("iteration").Find(&status.Applied).Error; err != nil {
+			return status, errors.Wrap(err, "unable to get applied migrations")
+		}
+	}
+	for _, m := range srv.migrations() {
+		if m.Iteration > status.Iteration {
+			status.Pending = append(status.Pending, m)
+		}
+	}
+	return status, nil
+}
+
+// CheckSchema ensures the database schema is on an iteration this server supports, which is any iteration from
+// MinIteration through the latest migration.
+func (srv *DBServer) CheckSchema() error {
+	current, err := srv.SchemaIteration()
+	if err != nil {
+		return err
+	}
+	min := srv.MinIteration
+	if min == 0 {
+		min = MinSchemaIteration
+	}
+	latest := latestIteration(srv.migrations())
 	switch {
-	case verFromDB.Iteration > srv.DBIteration:
-		log.Debugf("version from database %d is greater than current iteration %d", verFromDB.Iteration, srv.DBIteration)
-		return ErrDatabaseVersionNewer
-	case verFromDB.Iteration == srv.DBIteration:
-		log.Infof("database version %d is already the latest", verFromDB.Iteration)
+	case current < min:
+		return errors.Wrapf(ErrSchemaTooOld, "database is on iteration %d, server supports iterations %d through %d", current, min, latest)
+	case current > latest:
+		return errors.Wrapf(ErrSchemaTooNew, "database is on iteration %d, server supports iterations %d through %d", current, min, latest)
+	}
+	log.Debugf("database schema iteration %d is supported", current)
+	return nil
+}
+
+// CheckSchemaReadable ensures a server which only reads can run against the database schema.  Unlike CheckSchema()
+// it accepts schemas newer than the latest migration, which a newer server may have migrated the database to, but
+// not schemas older than MinIteration, which lack the columns and canonical vocabulary that every read depends on.
+func (srv *DBServer) CheckSchemaReadable() error {
+	err := srv.CheckSchema()
+	if errors.Cause(err) == ErrSchemaTooNew {
+		log.WithError(err).Debug("database schema is newer than supported, but can be read")
 		return nil
-	default:
-		log.Infof("database version %d is behind desired version %d, updating version tracking table", verFromDB.Iteration, srv.DBIteration)
 	}
+	return err
+}
 
-	ver := DatabaseVer{Iteration: srv.DBIteration}
-	return srv.DB.Assign(ver).FirstOrCreate(&ver).Error
+// SchemaIteration gets the iteration of the last migration applied to the database.  Zero is returned if no
+// migrations have been applied.
+func (srv *DBServer) SchemaIteration() (uint, error) {
+	if !srv.DB.HasTable(&DatabaseVer{}) {
+		return 0, nil
+	}
+	var ver DatabaseVer
+	err := srv.DB.Order("iteration desc").First(&ver).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to get database version")
+	}
+	return ver.Iteration, nil
+}
+
+// prepareMigrations validates the migrations and ensures the database connection is open.
+func (srv *DBServer) prepareMigrations() error {
+	if err := validateMigrations(srv.migrations(), srv.driver()); err != nil {
+		return errors.Wrap(err, "invalid migrations")
+	}
+	if srv.DBIteration == 0 {
+		srv.DBIteration = latestIteration(srv.migrations())
+	}
+	if !srv.isOpen {
+		if err := srv.Open(); err != nil {
+			return errors.Wrapf(err, "unable to open database connection")
+		}
+	}
+	srv.DB.SingularTable(true)
+	return nil
+}
+
+// runStep runs the statements and rewrite of the migration step and then record, all in one transaction.  record is
+// used to update the database version table.
+func (srv *DBServer) runStep(step MigrationStep, record func(tx *gorm.DB) error) error {
+	tx := srv.DB.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "unable to begin transaction")
+	}
+	for _, stmt := range step.Statements {
+		if err := tx.Exec(stmt).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed statement %s", stmt)
+		}
+	}
+	if step.Rewrite != nil {
+		if err := step.Rewrite(tx); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to rewrite data")
+		}
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to record database version")
+	}
+	return tx.Commit().Error
+}
+
+// migrations gets the migrations which apply to this database.
+func (srv *DBServer) migrations() []Migration {
+	if srv.Migrations == nil {
+		return Migrations
+	}
+	return srv.Migrations
 }
 
 // validateConfig ensures that initial values are set so that we can short-circuit configurations
 // that could cause more obscure errors down the line.
 func (srv *DBServer) validateConfig() error {
+	switch srv.driver() {
+	case DriverMySQL:
+	case DriverSQLite:
+		if srv.Path == "" {
+			return ErrDatabasePathNotSet
+		}
+		return nil
+	default:
+		return errors.Wrap(ErrUnsupportedDriver, srv.Driver)
+	}
+
 	if srv.Name == "" {
 		return ErrDatabaseNameNotSet
 	}
@@ -136,8 +465,12 @@ func (srv *DBServer) ensureDatabase() (err error) {
 	if err := srv.validateConfig(); err != nil {
 		return err
 	}
+	if srv.driver() == DriverSQLite {
+		// the database file is created when it is opened
+		return nil
+	}
 
-	db, err := gorm.Open("mysql", fmt.Sprintf("%s:%s@/?%s", srv.Username, srv.Password, DBConnectOptions))
+	db, err := srv.connect("")
 	if err != nil {
 		return errors.Wrapf(err, "unable to create database %s", srv.Name)
 	}
@@ -145,10 +478,131 @@ func (srv *DBServer) ensureDatabase() (err error) {
 		err = db.Close()
 	}()
 
-	if err := db.DB().Ping(); err != nil {
-		return errors.Wrapf(err, "unable to ping database %s after connection", srv.Name)
-	}
-
 	db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;", srv.Name))
 	return nil
 }
+
+// driver gets the configured database driver, defaulting to DriverMySQL.
+func (srv *DBServer) driver() string {
+	if srv.Driver == "" {
+		return DriverMySQL
+	}
+	return srv.Driver
+}
+
+// connect opens and pings the named database, retrying with backoff until ConnectTimeout has passed.
+func (srv *DBServer) connect(dbName string) (*gorm.DB, error) {
+	dialect, dsn, err := srv.dataSource(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(srv.ConnectTimeout)
+	backoff := connectBackoffStart
+	for {
+		// gorm pings the database as it opens
+		db, err := gorm.Open(dialect, dsn)
+		if err == nil {
+			return db, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, errors.Wrapf(err, "unable to connect to database %s", srv.Name)
+		}
+		log.WithError(err).Infof("database %s is not reachable, retrying in %s", srv.Name, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > connectBackoffMax {
+			backoff = connectBackoffMax
+		}
+	}
+}
+
+// dataSource gets the gorm dialect and data source name for the named database.
+func (srv *DBServer) dataSource(dbName string) (dialect string, dsn string, err error) {
+	if srv.driver() == DriverSQLite {
+		return "sqlite3", fmt.Sprintf("file:%s?%s", srv.Path, SQLiteConnectOptions), nil
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = srv.Username
+	cfg.Passwd = srv.Password
+	cfg.DBName = dbName
+	cfg.ParseTime = true
+	cfg.Params = map[string]string{"charset": "utf8"}
+	if srv.Socket != "" {
+		cfg.Net = "unix"
+		cfg.Addr = srv.Socket
+	} else {
+		host, port := srv.Host, srv.Port
+		if host == "" {
+			host = DefaultHost
+		}
+		if port == 0 {
+			port = DefaultPort
+		}
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	cfg.Loc = time.Local
+	if srv.Timezone != "" {
+		cfg.Loc, err = time.LoadLocation(srv.Timezone)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "invalid timezone %s", srv.Timezone)
+		}
+	}
+
+	cfg.TLSConfig, err = srv.tlsConfig()
+	if err != nil {
+		return "", "", err
+	}
+	return "mysql", cfg.FormatDSN(), nil
+}
+
+// tlsConfig gets the name of the MySQL driver TLS configuration to connect with.  When certificate files are
+// configured a custom TLS configuration is registered with the driver.
+func (srv *DBServer) tlsConfig() (string, error) {
+	switch srv.TLSMode {
+	case "", TLSModeDisabled:
+		return "false", nil
+	case TLSModeVerify, TLSModeSkipVerify:
+	default:
+		return "", errors.Wrap(ErrUnsupportedTLSMode, srv.TLSMode)
+	}
+
+	if srv.TLSCA == "" && srv.TLSCert == "" && srv.TLSKey == "" {
+		if srv.TLSMode == TLSModeSkipVerify {
+			return "skip-verify", nil
+		}
+		return "true", nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: srv.TLSMode == TLSModeSkipVerify}
+	if srv.Host != "" {
+		cfg.ServerName = srv.Host
+	}
+	if srv.TLSCA != "" {
+		pem, err := ioutil.ReadFile(srv.TLSCA)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to read TLS certificate authority %s", srv.TLSCA)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", errors.Wrap(ErrInvalidTLSCA, srv.TLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+	if srv.TLSCert != "" || srv.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(srv.TLSCert, srv.TLSKey)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to load TLS client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	name := fmt.Sprintf("tms-%s", srv.Name)
+	if err := mysql.RegisterTLSConfig(name, cfg); err != nil {
+		return "", errors.Wrap(err, "unable to register TLS configuration")
+	}
+	return name, nil
+}
@@ -1,8 +1,10 @@
 package tms
 
 import (
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestCreateDatabaseErrorsIfNameNotSet(t *testing.T) {
@@ -26,3 +28,114 @@ func TestCreateDatabaseErrorsIfUsernameNotSet(t *testing.T) {
 	}
 	assert.Equal(ErrDatabaseUsernameNotSet, db.ensureDatabase())
 }
+
+func TestCreateDatabaseErrorsIfSQLitePathNotSet(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	db := DBServer{
+		Driver: DriverSQLite,
+	}
+	assert.Equal(ErrDatabasePathNotSet, db.ensureDatabase())
+}
+
+func TestOpenDatabaseErrorsOnUnsupportedDriver(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	db := DBServer{
+		Driver:   "oracle",
+		Name:     "some_db",
+		Username: "someusername",
+	}
+	assert.Equal(ErrUnsupportedDriver, errors.Cause(db.Open()))
+}
+
+func TestBuildingMySQLDataSource(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		name   string
+		srv    DBServer
+		expDSN string
+	}{
+		{
+			"defaults",
+			DBServer{Name: "db", Username: "user", Password: "pass", Timezone: "UTC"},
+			"user:pass@tcp(127.0.0.1:3306)/db?parseTime=true&tls=false&charset=utf8",
+		},
+		{
+			"host_and_port",
+			DBServer{Name: "db", Username: "user", Host: "mysql.internal", Port: 3307, Timezone: "UTC"},
+			"user@tcp(mysql.internal:3307)/db?parseTime=true&tls=false&charset=utf8",
+		},
+		{
+			"socket",
+			DBServer{Name: "db", Username: "user", Host: "ignored", Socket: "/var/run/mysqld.sock", Timezone: "UTC"},
+			"user@unix(/var/run/mysqld.sock)/db?parseTime=true&tls=false&charset=utf8",
+		},
+		{
+			"timezone",
+			DBServer{Name: "db", Username: "user", Timezone: "America/Chicago"},
+			"user@tcp(127.0.0.1:3306)/db?loc=America%2FChicago&parseTime=true&tls=false&charset=utf8",
+		},
+		{
+			"tls_verify",
+			DBServer{Name: "db", Username: "user", Timezone: "UTC", TLSMode: TLSModeVerify},
+			"user@tcp(127.0.0.1:3306)/db?parseTime=true&tls=true&charset=utf8",
+		},
+		{
+			"tls_skip_verify",
+			DBServer{Name: "db", Username: "user", Timezone: "UTC", TLSMode: TLSModeSkipVerify},
+			"user@tcp(127.0.0.1:3306)/db?parseTime=true&tls=skip-verify&charset=utf8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialect, dsn, err := tt.srv.dataSource(tt.srv.Name)
+			assert.Nil(err)
+			assert.Equal("mysql", dialect)
+			assert.Equal(tt.expDSN, dsn)
+		})
+	}
+}
+
+func TestBuildingDataSourceWithInvalidConfigReturnsError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		name   string
+		srv    DBServer
+		expErr error
+	}{
+		{"tls_mode", DBServer{TLSMode: "sometimes"}, ErrUnsupportedTLSMode},
+		{"tls_ca", DBServer{TLSMode: TLSModeVerify, TLSCA: "dbsrv_test.go"}, ErrInvalidTLSCA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.srv.dataSource("db")
+			assert.Equal(tt.expErr, errors.Cause(err))
+		})
+	}
+}
+
+func TestConnectingRetriesUntilTimeout(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// nothing listens on port 1, so every attempt is refused
+	db := DBServer{
+		Name:           "some_db",
+		Username:       "someusername",
+		Port:           1,
+		ConnectTimeout: time.Second,
+	}
+	start := time.Now()
+	assert.NotNil(db.Open())
+	assert.True(time.Since(start) >= 500*time.Millisecond, "expected connection to be retried")
+	assert.False(db.isOpen)
+}
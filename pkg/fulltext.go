@@ -0,0 +1,253 @@
+package tms
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var ErrSearchQueryMissing = errors.New("q must contain at least one word to search for")
+
+// textField is a field of a strain which is searched by the full text index.
+type textField int
+
+const (
+	fieldName textField = iota
+	fieldRace
+	fieldFlavors
+	fieldEffects
+	numTextFields
+)
+
+// textFieldNames name the fields in search highlights.
+var textFieldNames = [numTextFields]string{"name", "race", "flavors", "effects"}
+
+// textFieldWeights are how much a match in each field counts towards the score, so that a word in the name of a
+// strain counts for more than the same word in its traits.
+var textFieldWeights = [numTextFields]float64{2, 1, 1, 1}
+
+// Parameters of BM25 ranking.  bm25K1 sets how quickly repeating a word stops adding to the score and bm25B how much
+// long strains are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// textDoc is a strain in the full text index.
+type textDoc struct {
+	repr StrainRepr
+	// freqs counts the occurrences of each term in each field.
+	freqs map[string]*[numTextFields]int
+	// length is the number of terms in the strain, weighted by field.
+	length float64
+}
+
+// TextResult is a strain found by a full text search.
+type TextResult struct {
+	// Score is the BM25 relevance of the strain to the search.  Higher scores are more relevant.
+	Score float64 `json:"score"`
+	// Highlights lists the values of each field which matched the search, keyed on the field name.
+	Highlights map[string][]string `json:"highlights"`
+	Strain     StrainRepr          `json:"strain"`
+}
+
+// TextIndex is an in-process inverted index of the names, races, flavors and effects of strains, for free text
+// search ranked with BM25.  TextIndex is safe for concurrent use.
+type TextIndex struct {
+	mu   sync.RWMutex
+	docs map[uint]*textDoc
+	// postings holds the reference IDs of the strains which have each term.
+	postings map[string]map[uint]bool
+	// totalLength is the sum of the lengths of every strain.
+	totalLength float64
+}
+
+// NewTextIndex creates an empty TextIndex.
+func NewTextIndex() *TextIndex {
+	return &TextIndex{
+		docs:     make(map[uint]*textDoc),
+		postings: make(map[string]map[uint]bool),
+	}
+}
+
+// Load puts every strain in the store in the index.
+func (idx *TextIndex) Load(store StrainStore) error {
+	page, err := store.SearchStrains(StrainQuery{}, ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "unable to get strains to index")
+	}
+	for _, s := range page.Strains {
+		idx.Put(s.ToStrainRepr())
+	}
+	return nil
+}
+
+// Put adds the strain to the index, replacing it if it is already indexed.
+func (idx *TextIndex) Put(repr StrainRepr) {
+	doc := &textDoc{repr: repr, freqs: make(map[string]*[numTextFields]int)}
+	for f, values := range textFieldValues(repr) {
+		for _, v := range values {
+			for _, term := range tokenize(v) {
+				freq, ok := doc.freqs[term]
+				if !ok {
+					freq = &[numTextFields]int{}
+					doc.freqs[term] = freq
+				}
+				freq[f]++
+				doc.length += textFieldWeights[f]
+			}
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(repr.ID)
+	idx.docs[repr.ID] = doc
+	idx.totalLength += doc.length
+	for term := range doc.freqs {
+		ids, ok := idx.postings[term]
+		if !ok {
+			ids = make(map[uint]bool)
+			idx.postings[term] = ids
+		}
+		ids[repr.ID] = true
+	}
+}
+
+// Remove removes the strain with the given reference ID from the index.
+func (idx *TextIndex) Remove(id uint) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+// remove removes a strain from the index.  The caller must hold the write lock.
+func (idx *TextIndex) remove(id uint) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for term := range doc.freqs {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLength -= doc.length
+	delete(idx.docs, id)
+}
+
+// Search finds the strains which have any of the words of the query, most relevant first, and returns limit of them
+// after skipping offset along with the number of strains found.  Every strain found is returned if limit is zero.
+// Strains as relevant as each other are ordered by reference ID.  ErrSearchQueryMissing is returned if the query
+// has no words.
+func (idx *TextIndex) Search(query string, offset, limit int) ([]TextResult, int, error) {
+	terms := unique(tokenize(query))
+	if len(terms) == 0 {
+		return nil, 0, ErrSearchQueryMissing
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	n := float64(len(idx.docs))
+	avgLength := idx.totalLength / n
+	scores := make(map[uint]float64)
+	for _, term := range terms {
+		ids := idx.postings[term]
+		df := float64(len(ids))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id := range ids {
+			doc := idx.docs[id]
+			var tf float64
+			for f, count := range doc.freqs[term] {
+				tf += textFieldWeights[f] * float64(count)
+			}
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*doc.length/avgLength))
+		}
+	}
+
+	results := make([]TextResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, TextResult{Score: score, Strain: idx.docs[id].repr})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Strain.ID < results[j].Strain.ID
+	})
+
+	total := len(results)
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Highlights = highlight(results[i].Strain, terms)
+	}
+	return results, total, nil
+}
+
+// highlight lists the values of each field of the strain which have any of the terms.
+func highlight(repr StrainRepr, terms []string) map[string][]string {
+	highlights := make(map[string][]string)
+	for f, values := range textFieldValues(repr) {
+		for _, v := range values {
+			for _, term := range tokenize(v) {
+				if contains(terms, term) {
+					highlights[textFieldNames[f]] = append(highlights[textFieldNames[f]], v)
+					break
+				}
+			}
+		}
+	}
+	return highlights
+}
+
+// textFieldValues are the values of each searched field of the strain.
+func textFieldValues(repr StrainRepr) [numTextFields][]string {
+	var values [numTextFields][]string
+	values[fieldName] = []string{repr.Name}
+	values[fieldRace] = []string{repr.Race}
+	values[fieldFlavors] = repr.Flavors
+	for _, effects := range [][]string{repr.Effects.Positive, repr.Effects.Negative, repr.Effects.Medical} {
+		values[fieldEffects] = append(values[fieldEffects], effects...)
+	}
+	values[fieldEffects] = unique(values[fieldEffects])
+	return values
+}
+
+// tokenize splits text into lower case words and stems them.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = stem(w)
+	}
+	return words
+}
+
+// stem strips common English suffixes so that different forms of a word match each other, such as relaxed and
+// relaxing.  It is deliberately light, and leaves short words alone.
+func stem(word string) string {
+	switch {
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		return word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "ing") && len(word) > 5:
+		return word[:len(word)-3]
+	case strings.HasSuffix(word, "ed") && len(word) > 4:
+		return word[:len(word)-2]
+	case strings.HasSuffix(word, "s") && len(word) > 3 &&
+		!strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		return word[:len(word)-1]
+	}
+	return word
+}
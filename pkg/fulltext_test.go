@@ -0,0 +1,281 @@
+package tms
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// textSearchableStrains are strains which share words across their names, races and traits.
+func textSearchableStrains() []StrainRepr {
+	reprs := []StrainRepr{
+		{ID: 1, Name: "Blue Dream", Race: "sativa", Flavors: []string{"Sweet", "Berry"}},
+		{ID: 2, Name: "Sweet Tooth", Race: "indica", Flavors: []string{"Sweet"}},
+		{ID: 3, Name: "Green Crack", Race: "sativa", Flavors: []string{"Citrus"}},
+		{ID: 4, Name: "Northern Lights", Race: "indica", Flavors: []string{"Earthy"}},
+	}
+	reprs[0].Effects.Positive = []string{"Relaxed", "Happy"}
+	reprs[1].Effects.Positive = []string{"Sleepy"}
+	reprs[2].Effects.Positive = []string{"Energetic"}
+	reprs[3].Effects.Positive = []string{"Relaxed"}
+	return reprs
+}
+
+func TestStemmingWords(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		word string
+		exp  string
+	}{
+		{"relaxing", "relax"},
+		{"relaxed", "relax"},
+		{"relax", "relax"},
+		{"berries", "berry"},
+		{"flavors", "flavor"},
+		{"citrus", "citrus"},
+		{"grass", "grass"},
+		{"og", "og"},
+		{"bed", "bed"},
+	}
+	for _, tt := range tests {
+		assert.Equal(tt.exp, stem(tt.word), tt.word)
+	}
+	assert.Equal([]string{"blue", "dream", "100", "og"}, tokenize("Blue-Dream (100% OG)"))
+}
+
+func TestFullTextSearch(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	idx := NewTextIndex()
+	for _, repr := range textSearchableStrains() {
+		idx.Put(repr)
+	}
+
+	results, total, err := idx.Search("sweet relaxing sativa", 0, 0)
+	assert.Nil(err)
+	assert.Equal(4, total)
+	var ids []uint
+	for _, r := range results {
+		ids = append(ids, r.Strain.ID)
+	}
+	assert.Equal(uint(1), ids[0], "the strain matching every word should be first")
+	assert.Equal(uint(2), ids[1], "a word in the name should count for more than the same word in a trait")
+	assert.Equal(map[string][]string{
+		"race":    {"sativa"},
+		"flavors": {"Sweet"},
+		"effects": {"Relaxed"},
+	}, results[0].Highlights)
+	assert.Equal(map[string][]string{
+		"name":    {"Sweet Tooth"},
+		"flavors": {"Sweet"},
+	}, results[1].Highlights)
+	for i := 1; i < len(results); i++ {
+		assert.True(results[i-1].Score >= results[i].Score)
+	}
+
+	results, total, err = idx.Search("sweet relaxing sativa", 1, 2)
+	assert.Nil(err)
+	assert.Equal(4, total)
+	if assert.Len(results, 2) {
+		assert.Equal(ids[1], results[0].Strain.ID)
+	}
+
+	// putting a strain again replaces it
+	green := textSearchableStrains()[2]
+	green.Race = "hybrid"
+	idx.Put(green)
+	results, _, err = idx.Search("sativa", 0, 0)
+	assert.Nil(err)
+	if assert.Len(results, 1) {
+		assert.Equal(uint(1), results[0].Strain.ID)
+	}
+
+	idx.Remove(1)
+	results, total, err = idx.Search("sativa", 0, 0)
+	assert.Nil(err)
+	assert.Empty(results)
+	assert.Equal(0, total)
+
+	_, _, err = idx.Search(" -- ", 0, 0)
+	assert.Equal(ErrSearchQueryMissing, err)
+}
+
+func TestIndexedStoreKeepsFullTextIndexCurrent(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	mem := NewMemoryStore()
+	for _, repr := range textSearchableStrains() {
+		assert.Nil(mem.CreateStrain(repr, WriteOptions{}))
+	}
+	idx := NewTextIndex()
+	assert.Nil(idx.Load(mem))
+	store := NewIndexedStore(mem, idx)
+
+	found := func(q string) []uint {
+		results, _, err := idx.Search(q, 0, 0)
+		assert.Nil(err)
+		var ids []uint
+		for _, r := range results {
+			ids = append(ids, r.Strain.ID)
+		}
+		return ids
+	}
+
+	assert.Equal([]uint{3}, found("crack"))
+	_, err := store.ReplaceStrain(StrainRepr{ID: 3, Name: "Green Crack", Flavors: []string{"Mango"}}, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]uint{3}, found("mango"))
+	assert.Nil(store.DeleteStrain(3, WriteOptions{}))
+	assert.Empty(found("mango"))
+	assert.Nil(store.RestoreStrain(3))
+	assert.Equal([]uint{3}, found("mango"))
+
+	// failed writes change nothing
+	_, err = store.ReplaceStrain(StrainRepr{ID: 3, Name: "Lemon"},
+		WriteOptions{IfMatch: &Precondition{Versions: []StrainVersion{{StrainID: 3, Revision: 1}}}})
+	assert.Equal(ErrPreconditionFailed, err)
+	assert.Empty(found("lemon"))
+
+	outcomes, err := store.WriteStrains([]BulkWrite{
+		{Action: BulkReplace, Strain: StrainRepr{ID: 3, Name: "Lemon Haze"}},
+		{Action: BulkCreate, Strain: StrainRepr{ID: 99, Name: "Lemon Kush"}},
+	}, BulkBestEffort, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{}, {Created: true}}, outcomes)
+	assert.Empty(found("mango"))
+	assert.ElementsMatch([]uint{3, 99}, found("lemon"))
+
+	// only writes which were kept change the index
+	outcomes, err = store.WriteStrains([]BulkWrite{
+		{Action: BulkDelete, Strain: StrainRepr{ID: 99}},
+		{Action: BulkCreate, Strain: StrainRepr{ID: 3, Name: "Mango Kush"}},
+	}, BulkAtomic, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{Err: ErrBulkAborted}, {Err: ErrRecordAlreadyExists}}, outcomes)
+	assert.ElementsMatch([]uint{3, 99}, found("lemon"))
+	assert.Empty(found("mango"))
+}
+
+func TestIndexedStoreIndexesTheStrainStoredLast(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	mem := NewMemoryStore()
+	idx := NewTextIndex()
+	store := NewIndexedStore(mem, idx)
+
+	names := []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo", "Foxtrot", "Golf", "Hotel"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_, err := store.ReplaceStrain(StrainRepr{ID: 1, Name: name, Race: " Sativa "}, WriteOptions{})
+			assert.Nil(err)
+		}(name)
+	}
+	wg.Wait()
+
+	stored, err := mem.StrainByRefID(1)
+	assert.Nil(err)
+	for _, name := range names {
+		results, _, err := idx.Search(name, 0, 0)
+		assert.Nil(err)
+		if name != stored.Name {
+			assert.Empty(results, name)
+			continue
+		}
+		if assert.Len(results, 1) {
+			assert.Equal(stored.ToStrainRepr(), results[0].Strain)
+			assert.Equal("sativa", results[0].Strain.Race)
+		}
+	}
+}
+
+// stallingStore is a MemoryStore whose replaces of one strain wait until they are let through.
+type stallingStore struct {
+	*MemoryStore
+	stalled uint
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s stallingStore) ReplaceStrain(repr StrainRepr, opts WriteOptions) (bool, error) {
+	if repr.ID == s.stalled {
+		close(s.entered)
+		<-s.release
+	}
+	return s.MemoryStore.ReplaceStrain(repr, opts)
+}
+
+func TestIndexedStoreOnlyHoldsUpWritesToTheSameStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	stalling := stallingStore{MemoryStore: NewMemoryStore(), stalled: 1, entered: make(chan struct{}), release: make(chan struct{})}
+	store := NewIndexedStore(stalling, NewTextIndex())
+
+	stalled := make(chan error, 1)
+	go func() {
+		_, err := store.ReplaceStrain(StrainRepr{ID: 1, Name: "Blue Dream"}, WriteOptions{})
+		stalled <- err
+	}()
+	<-stalling.entered
+
+	other := make(chan error, 1)
+	go func() {
+		other <- store.CreateStrain(StrainRepr{ID: 2, Name: "Green Crack"}, WriteOptions{})
+	}()
+	select {
+	case err := <-other:
+		assert.Nil(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("a write to another strain waited for the stalled write")
+	}
+
+	// a write to the same strain waits for the stalled one
+	same := make(chan error, 1)
+	go func() {
+		same <- store.DeleteStrain(1, WriteOptions{})
+	}()
+	select {
+	case <-same:
+		t.Fatal("a write to the stalled strain did not wait for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stalling.release)
+	assert.Nil(<-stalled)
+	assert.Nil(<-same)
+	assert.Empty(store.locks.locks, "locks should only be kept while they are held")
+}
+
+// unreadableStore is a MemoryStore whose strains cannot be read back once they have been written.
+type unreadableStore struct {
+	*MemoryStore
+}
+
+func (unreadableStore) StrainByRefID(id uint) (Strain, error) {
+	return Strain{}, errors.New("connection lost")
+}
+
+func TestIndexedStoreKeepsWritesWhichCannotBeReadBack(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	mem := NewMemoryStore()
+	idx := NewTextIndex()
+	store := NewIndexedStore(unreadableStore{mem}, idx)
+
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 1, Name: "Blue Dream"}, WriteOptions{}))
+	assert.Nil(store.PatchStrain(1, mustParsePatch(t, MergePatchContentType, `{"name":"Green Dream"}`), WriteOptions{}))
+	assert.Nil(store.DeleteStrain(1, WriteOptions{}))
+	assert.Nil(store.RestoreStrain(1))
+	s, err := mem.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal("Green Dream", s.Name)
+}
@@ -0,0 +1,183 @@
+package tms
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+)
+
+// StrainIndex is an in-process index of strains, kept current as strains are written by IndexedStore.
+type StrainIndex interface {
+	// Put adds the strain to the index, replacing it if it is already indexed.
+	Put(repr StrainRepr)
+	// Remove removes the strain with the given reference ID from the index.
+	Remove(id uint)
+}
+
+// IndexedStore is a StrainStore which keeps in-process indexes current with every strain written through it, so
+// that new names, flavors and effects can be found as soon as they are written.
+type IndexedStore struct {
+	StrainStore
+	Indexes []StrainIndex
+
+	// locks are held on the strains of each write until they are indexed, so that concurrent writes to the same
+	// strain cannot leave the indexes with a strain other than the one stored last.  Writes to other strains are
+	// not held up, as the store itself keeps concurrent writes apart.
+	locks strainLocks
+}
+
+// NewIndexedStore wraps store so that strains written through it are put in the indexes.
+func NewIndexedStore(store StrainStore, indexes ...StrainIndex) *IndexedStore {
+	return &IndexedStore{StrainStore: store, Indexes: indexes}
+}
+
+// CreateStrain stores a new strain and puts it in the indexes.
+func (s *IndexedStore) CreateStrain(repr StrainRepr, opts WriteOptions) error {
+	defer s.locks.lock(repr.ID)()
+	if err := s.StrainStore.CreateStrain(repr, opts); err != nil {
+		return err
+	}
+	s.reindex(repr.ID)
+	return nil
+}
+
+// ReplaceStrain creates or replaces the strain and puts it in the indexes.
+func (s *IndexedStore) ReplaceStrain(repr StrainRepr, opts WriteOptions) (bool, error) {
+	defer s.locks.lock(repr.ID)()
+	created, err := s.StrainStore.ReplaceStrain(repr, opts)
+	if err != nil {
+		return false, err
+	}
+	s.reindex(repr.ID)
+	return created, nil
+}
+
+// PatchStrain applies the patch to the strain and puts the patched strain in the indexes.
+func (s *IndexedStore) PatchStrain(id uint, patch Patch, opts WriteOptions) error {
+	defer s.locks.lock(id)()
+	if err := s.StrainStore.PatchStrain(id, patch, opts); err != nil {
+		return err
+	}
+	s.reindex(id)
+	return nil
+}
+
+// DeleteStrain removes the strain and removes it from the indexes.
+func (s *IndexedStore) DeleteStrain(id uint, opts WriteOptions) error {
+	defer s.locks.lock(id)()
+	if err := s.StrainStore.DeleteStrain(id, opts); err != nil {
+		return err
+	}
+	s.remove(id)
+	return nil
+}
+
+// WriteStrains makes the writes and updates the indexes with those which were made.
+func (s *IndexedStore) WriteStrains(writes []BulkWrite, mode BulkMode, opts WriteOptions) ([]BulkOutcome, error) {
+	ids := make([]uint, len(writes))
+	for i, w := range writes {
+		ids[i] = w.Strain.ID
+	}
+	defer s.locks.lock(ids...)()
+	outcomes, err := s.StrainStore.WriteStrains(writes, mode, opts)
+	if err != nil {
+		return outcomes, err
+	}
+	for i, w := range writes {
+		switch {
+		case outcomes[i].Err != nil:
+		case w.Action == BulkDelete:
+			s.remove(w.Strain.ID)
+		default:
+			s.reindex(w.Strain.ID)
+		}
+	}
+	return outcomes, nil
+}
+
+// RestoreStrain brings back the deleted strain and puts it back in the indexes.
+func (s *IndexedStore) RestoreStrain(id uint) error {
+	defer s.locks.lock(id)()
+	if err := s.StrainStore.RestoreStrain(id); err != nil {
+		return err
+	}
+	s.reindex(id)
+	return nil
+}
+
+// reindex reads the strain with the given reference ID back from the store and puts it in the indexes as it was
+// stored.  The write has already been made by then, so a strain which cannot be read back is logged rather than
+// failing the write, and stays out of date in the indexes until it is next written.  The caller must hold the lock on the strain.
+func (s *IndexedStore) reindex(id uint) {
+	strain, err := s.StrainStore.StrainByRefID(id)
+	if err == ErrNotExists {
+		s.remove(id)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Errorf("unable to read strain %d back to index it", id)
+		return
+	}
+	repr := strain.ToStrainRepr()
+	for _, idx := range s.Indexes {
+		idx.Put(repr)
+	}
+}
+
+// remove removes the strain with the given reference ID from the indexes.  The caller must hold the lock on the
+// strain.
+func (s *IndexedStore) remove(id uint) {
+	for _, idx := range s.Indexes {
+		idx.Remove(id)
+	}
+}
+
+// strainLocks are locks on strains by reference ID.  A lock is only kept while a write holds or waits for it.
+type strainLocks struct {
+	mu    sync.Mutex
+	locks map[uint]*strainLock
+}
+
+// strainLock is the lock on a single strain and the number of writes which hold or wait for it.
+type strainLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the strains with the given reference IDs and returns the function which unlocks them.  The strains are
+// locked in order, so that writes of overlapping strains cannot deadlock.
+func (l *strainLocks) lock(ids ...uint) func() {
+	sorted := append([]uint(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var held []uint
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		l.mu.Lock()
+		if l.locks == nil {
+			l.locks = make(map[uint]*strainLock)
+		}
+		sl, ok := l.locks[id]
+		if !ok {
+			sl = &strainLock{}
+			l.locks[id] = sl
+		}
+		sl.refs++
+		l.mu.Unlock()
+		sl.Lock()
+		held = append(held, id)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, id := range held {
+			sl := l.locks[id]
+			sl.Unlock()
+			if sl.refs--; sl.refs == 0 {
+				delete(l.locks, id)
+			}
+		}
+	}
+}
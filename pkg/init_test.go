@@ -1,11 +1,13 @@
 package tms
 
 import (
+	"flag"
 	"fmt"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,6 +16,11 @@ var (
 	// configured with `go test ./... -args -Integration=true`
 	Integration      bool
 	TestDatabaseName = "test_db"
+	// TestDatabaseDriver is the database driver integration tests run against, and can be
+	// configured with `go test ./... -tags=integration -args -db-driver=sqlite`
+	TestDatabaseDriver = flag.String("db-driver", DriverMySQL, "database driver for integration tests, one of mysql, sqlite")
+	// TestDatabasePath is the SQLite database file used when integration testing against SQLite.
+	TestDatabasePath = filepath.Join(os.TempDir(), "tms_test_db.sqlite")
 	// TestDB which can be used by all tests concurrently.  The
 	TestDB *gorm.DB
 )
@@ -23,6 +30,7 @@ func TestMain(m *testing.M) {
 	// don't produce normal logs during tests
 	log.SetOutput(nopWriter{})
 
+	flag.Parse()
 	setupDB()
 	code := m.Run()
 	cleanupTables()
@@ -32,7 +40,7 @@ func TestMain(m *testing.M) {
 // setupDB just creates a test database we can integrate with.
 func setupDB() {
 	setup := func() {
-		dbSrv := NewDBServer(TestDatabaseName, "root", "password")
+		dbSrv := newTestDBServer()
 		if err := dbSrv.Migrate(); err != nil {
 			panic(errors.Wrap(err, "unable to migrate test db"))
 		}
@@ -59,7 +67,7 @@ func setupDB() {
 func cleanupTables() {
 	// TODO: dropping the database would be better here but initial attempts failed.  this
 	// TODO: method is more brittle, but will do for now.
-	dbSrv := NewDBServer(TestDatabaseName, "root", "password")
+	dbSrv := newTestDBServer()
 	if err := dbSrv.Open(); err != nil {
 		fmt.Printf("%s: unable to open test db", err)
 	}
@@ -71,6 +79,8 @@ func cleanupTables() {
 			"flavor",
 			"strain_effects",
 			"strain_flavors",
+			"strain_revision",
+			"migration_lock",
 		}
 		for _, tbl := range tables {
 			if dbSrv.DB.HasTable(tbl) {
@@ -80,6 +90,14 @@ func cleanupTables() {
 	}
 }
 
+// newTestDBServer creates a DBServer for the test database using the configured driver.
+func newTestDBServer() *DBServer {
+	dbSrv := NewDBServer(TestDatabaseName, "root", "password")
+	dbSrv.Driver = *TestDatabaseDriver
+	dbSrv.Path = TestDatabasePath
+	return dbSrv
+}
+
 type nopWriter struct{}
 
 func (w nopWriter) Write(p []byte) (int, error) {
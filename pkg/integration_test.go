@@ -3,9 +3,18 @@
 package tms
 
 import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Unique hands out a number that nobody else is using
@@ -34,7 +43,7 @@ func TestMigrateDatabase(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.tableName, func(t *testing.T) {
 			// this is done in the test main setup, but that's too far from here to count on it always
-			dbSrv := NewDBServer(TestDatabaseName, "root", "password")
+			dbSrv := newTestDBServer()
 			assert.Nil(dbSrv.Migrate())
 			assert.Nil(dbSrv.Open())
 			assert.True(dbSrv.DB.HasTable(tt.tableName))
@@ -42,6 +51,251 @@ func TestMigrateDatabase(t *testing.T) {
 	}
 }
 
+func TestMigratingDatabaseStepByStep(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "step_by_step")
+	defer cleanup()
+	dbSrv.Migrations = widgetMigrations()
+
+	dbSrv.DBIteration = 1
+	assert.Nil(dbSrv.Migrate())
+	iteration, err := dbSrv.SchemaIteration()
+	assert.Nil(err)
+	assert.Equal(uint(1), iteration)
+	assert.True(dbSrv.DB.HasTable("widget"))
+	assert.False(dbSrv.DB.HasTable("gadget"))
+
+	dbSrv.DBIteration = 2
+	assert.Nil(dbSrv.Migrate())
+	iteration, err = dbSrv.SchemaIteration()
+	assert.Nil(err)
+	assert.Equal(uint(2), iteration)
+	assert.True(dbSrv.DB.HasTable("gadget"))
+
+	// every applied migration is recorded
+	var vers []DatabaseVer
+	assert.Nil(dbSrv.DB.Order("iteration").Find(&vers).Error)
+	assert.Len(vers, 2)
+	assert.Equal("create gadget", vers[1].Description)
+
+	// the database cannot be migrated backwards
+	dbSrv.DBIteration = 1
+	assert.Equal(ErrDatabaseVersionNewer, dbSrv.Migrate())
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "rollback")
+	defer cleanup()
+	dbSrv.Migrations = widgetMigrations()
+	assert.Nil(dbSrv.Migrate())
+
+	both := func(stmts ...string) Statements {
+		return Statements{DriverMySQL: stmts, DriverSQLite: stmts}
+	}
+	dbSrv.Migrations = append(dbSrv.Migrations, Migration{
+		Iteration:   3,
+		Description: "broken backfill",
+		Up:          both("INSERT INTO widget (id) VALUES (1)", "INSERT INTO no_such_table VALUES (1)"),
+		Down:        both("DELETE FROM widget"),
+	})
+	dbSrv.DBIteration = 3
+	assert.NotNil(dbSrv.Migrate())
+
+	iteration, err := dbSrv.SchemaIteration()
+	assert.Nil(err)
+	assert.Equal(uint(2), iteration)
+	var count int
+	assert.Nil(dbSrv.DB.Table("widget").Count(&count).Error)
+	assert.Equal(0, count, "statements of the failed migration should be rolled back")
+}
+
+func TestRollingBackMigrations(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "roll_back")
+	defer cleanup()
+	dbSrv.Migrations = widgetMigrations()
+	assert.Nil(dbSrv.Migrate())
+
+	// planning does not change anything
+	steps, err := dbSrv.PlanDown(0)
+	assert.Nil(err)
+	if assert.Len(steps, 2) {
+		assert.Equal(uint(2), steps[0].Iteration)
+		assert.Equal([]string{"DROP TABLE gadget"}, steps[0].Statements)
+		assert.Equal(uint(1), steps[1].Iteration)
+	}
+	assert.True(dbSrv.DB.HasTable("gadget"))
+
+	assert.Nil(dbSrv.MigrateDown(1))
+	status, err := dbSrv.Status()
+	assert.Nil(err)
+	assert.Equal(uint(1), status.Iteration)
+	assert.Equal(uint(2), status.Latest)
+	assert.Len(status.Applied, 1)
+	if assert.Len(status.Pending, 1) {
+		assert.Equal(uint(2), status.Pending[0].Iteration)
+	}
+	assert.False(dbSrv.DB.HasTable("gadget"))
+	assert.True(dbSrv.DB.HasTable("widget"))
+
+	// a rolled back migration can be applied again
+	steps, err = dbSrv.Plan()
+	assert.Nil(err)
+	assert.Len(steps, 1)
+	assert.Nil(dbSrv.Migrate())
+	assert.True(dbSrv.DB.HasTable("gadget"))
+
+	assert.Equal(ErrDatabaseVersionOlder, dbSrv.MigrateDown(3))
+	assert.Nil(dbSrv.MigrateDown(0))
+	assert.False(dbSrv.DB.HasTable("widget"))
+}
+
+func TestConcurrentMigrationsRunOnce(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "concurrent")
+	defer cleanup()
+
+	// the widget migrations fail if they are run twice, as the tables already exist
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instance := *dbSrv
+			instance.DB = nil
+			instance.Migrations = widgetMigrations()
+			assert.Nil(instance.Open())
+			defer instance.Close()
+			assert.Nil(instance.Migrate())
+		}()
+	}
+	wg.Wait()
+
+	var count int
+	assert.Nil(dbSrv.DB.Model(&DatabaseVer{}).Count(&count).Error)
+	assert.Equal(2, count)
+}
+
+func TestMigrationLockTimesOut(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	holder, cleanup := newScratchDBServer(t, "lock_timeout")
+	defer cleanup()
+	unlock, err := holder.lockMigrations()
+	assert.Nil(err)
+
+	waiter := *holder
+	waiter.DB = nil
+	waiter.Migrations = widgetMigrations()
+	waiter.LockTimeout = time.Second
+	assert.Nil(waiter.Open())
+	defer waiter.Close()
+	assert.Equal(ErrMigrationLockTimeout, errors.Cause(waiter.Migrate()))
+
+	// once the lock is released the waiter can migrate
+	unlock()
+	assert.Nil(waiter.Migrate())
+}
+
+func TestMigratingThroughASingleConnection(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "single_conn")
+	defer cleanup()
+	dbSrv.Migrations = widgetMigrations()
+	dbSrv.MaxOpenConns = 1
+	dbSrv.DB.DB().SetMaxOpenConns(1)
+
+	// the migration lock must not take the only connection of the pool
+	done := make(chan error, 1)
+	go func() {
+		done <- dbSrv.Migrate()
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("migration through a single connection did not finish")
+	}
+}
+
+func TestCheckingSchemaCompatibility(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "compatibility")
+	defer cleanup()
+	dbSrv.Migrations = widgetMigrations()
+	dbSrv.MinIteration = 1
+
+	assert.Equal(ErrSchemaTooOld, errors.Cause(dbSrv.CheckSchema()))
+
+	assert.Nil(dbSrv.Migrate())
+	assert.Nil(dbSrv.CheckSchema())
+
+	// a server which only knows the first migration is too old for the database
+	dbSrv.Migrations = widgetMigrations()[:1]
+	assert.Equal(ErrSchemaTooNew, errors.Cause(dbSrv.CheckSchema()))
+}
+
+func TestStartingReadOnly(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// a schema from before strains had revisions cannot be read, even read-only
+	old, cleanup := newScratchDBServer(t, "read_only_old")
+	defer cleanup()
+	old.DBIteration = 3
+	assert.Nil(old.Migrate())
+	assert.Equal(ErrSchemaTooOld, errors.Cause(old.CheckSchema()))
+	assert.Equal(ErrSchemaTooOld, errors.Cause(old.CheckSchemaReadable()))
+
+	// a schema migrated by a newer server can
+	newer, cleanup := newScratchDBServer(t, "read_only_newer")
+	defer cleanup()
+	newer.Migrations = append(append([]Migration(nil), Migrations...), Migration{
+		Iteration:   LatestIteration() + 1,
+		Description: "add a column this server does not know",
+		Up: Statements{
+			DriverMySQL:  {"ALTER TABLE `strain` ADD COLUMN `rating` int"},
+			DriverSQLite: {`ALTER TABLE "strain" ADD COLUMN "rating" integer`},
+		},
+		Down: Statements{
+			DriverMySQL:  {"ALTER TABLE `strain` DROP COLUMN `rating`"},
+			DriverSQLite: {`ALTER TABLE "strain" DROP COLUMN "rating"`},
+		},
+	})
+	assert.Nil(newer.Migrate())
+	repr := StrainRepr{ID: 1, Name: "Afpak", Race: "hybrid", Flavors: []string{"Pine"}}
+	assert.Nil(NewGormStore(newer.DB).CreateStrain(repr, WriteOptions{}))
+
+	newer.Migrations = nil
+	assert.Equal(ErrSchemaTooNew, errors.Cause(newer.CheckSchema()))
+	assert.Nil(newer.CheckSchemaReadable())
+	suggestions := NewSuggestIndex()
+	assert.Nil(suggestions.LoadFromDB(newer.DB))
+	fullText := NewTextIndex()
+	assert.Nil(fullText.Load(NewGormStore(newer.DB)))
+	srv := Server{Store: NewGormStore(newer.DB), ReadOnly: true, Suggestions: suggestions, FullText: fullText}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/strains/id/1", nil)
+	w := serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"name":"Afpak"`)
+	assert.Equal([]Suggestion{{SuggestFlavor, "Pine"}}, suggestions.Suggest("pin", nil, 10))
+}
+
 func TestCreatingStrainInDBUpdatesName(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
@@ -143,7 +397,7 @@ func TestGettingStrainFromFlavorsFromDBByID(t *testing.T) {
 			for _, f := range tt.flavors {
 				var match bool
 				for _, fFromDB := range flavors {
-					if f.Name == fFromDB.Name {
+					if CanonicalTrait(f.Name) == fFromDB.Name {
 						match = true
 					}
 				}
@@ -196,7 +450,7 @@ func TestGettingEffectsFromFlavorsFromDBByID(t *testing.T) {
 			for _, e := range tt.effects {
 				var match bool
 				for _, eFromDB := range effectsFromDB {
-					if e.Name == eFromDB.Name && e.Category == eFromDB.Category {
+					if CanonicalTrait(e.Name) == eFromDB.Name && e.Category == eFromDB.Category {
 						match = true
 					}
 				}
@@ -243,7 +497,7 @@ func TestGettingStrainFromDBByIDHasCorrectFlavors(t *testing.T) {
 			for _, f := range tt.flavors {
 				var match bool
 				for _, fFromDB := range out.Flavors {
-					if f.Name == fFromDB.Name {
+					if CanonicalTrait(f.Name) == fFromDB.Name {
 						match = true
 					}
 				}
@@ -298,7 +552,7 @@ func TestGettingStrainFromDBByIDHasCorrectEffects(t *testing.T) {
 			for _, e := range tt.effects {
 				var match bool
 				for _, eFromDB := range out.Effects {
-					if e.Name == eFromDB.Name && e.Category == eFromDB.Category {
+					if CanonicalTrait(e.Name) == eFromDB.Name && e.Category == eFromDB.Category {
 						match = true
 					}
 				}
@@ -339,12 +593,13 @@ func TestReplacingStrainReprInDBDeletesSuperfluousFlavors(t *testing.T) {
 			tt.repr.DB = TestDB
 
 			// add a new flavor
-			newFlav := "new_flavor"
+			newFlav := "New Flavor"
 			tt.repr.Flavors = append(tt.repr.Flavors, newFlav)
-			assert.Nil(tt.repr.ReplaceInDB())
+			_, err := tt.repr.ReplaceInDB(WriteOptions{})
+			assert.Nil(err)
 
 			out := Strain{DB: TestDB}
-			err := out.FromDBByRefID(ref)
+			err = out.FromDBByRefID(ref)
 			assert.Nil(err)
 
 			var match bool
@@ -365,7 +620,8 @@ func TestReplacingStrainReprInDBDeletesSuperfluousFlavors(t *testing.T) {
 			tt.repr.Flavors = flavorsMinusNewFlav
 
 			// perform replacement again which should remove test flavor
-			assert.Nil(tt.repr.ReplaceInDB())
+			_, err = tt.repr.ReplaceInDB(WriteOptions{})
+			assert.Nil(err)
 
 			// get results from DB again
 			out = Strain{DB: TestDB}
@@ -393,6 +649,678 @@ func TestGettingStrainFromDBByIDWithNoRecordReturnsError(t *testing.T) {
 	assert.Equal(ErrNotExists, err)
 }
 
+func TestGormStoreCreatingExistingStrainReturnsError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	repr := StrainRepr{ID: Unique.Next(), Name: "foo", Race: "indica"}
+	assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	assert.Equal(ErrRecordAlreadyExists, store.CreateStrain(repr, WriteOptions{}))
+}
+
+func TestGormStoreDeletingStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	ref := Unique.Next()
+	created, err := store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo", Race: "sativa"}, WriteOptions{})
+	assert.Nil(err)
+	assert.True(created)
+	created, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo", Race: "indica"}, WriteOptions{})
+	assert.Nil(err)
+	assert.False(created)
+	assert.Nil(store.DeleteStrain(ref, WriteOptions{}))
+
+	_, err = store.StrainByRefID(ref)
+	assert.Equal(ErrNotExists, err)
+	assert.Equal(ErrNotExists, store.DeleteStrain(ref, WriteOptions{}))
+
+	// writing a deleted strain creates it again
+	created, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo", Race: "sativa"}, WriteOptions{})
+	assert.Nil(err)
+	assert.True(created)
+}
+
+func TestGormStoreRestoringStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	ref := Unique.Next()
+	race := fmt.Sprintf("restorable_%d", ref)
+	repr := StrainRepr{ID: ref, Name: "foo", Race: race, Flavors: []string{"Lime"}}
+	_, err := store.ReplaceStrain(repr, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal(ErrNotExists, store.RestoreStrain(ref))
+	assert.Nil(store.DeleteStrain(ref, WriteOptions{}))
+
+	// deleted strains are hidden from searches, but listed as deleted
+	found, err := store.StrainsByRace(race, ListOptions{})
+	assert.Nil(err)
+	assert.Empty(found.Strains)
+	deleted, err := store.DeletedStrains()
+	assert.Nil(err)
+	var listed bool
+	for _, s := range deleted {
+		if s.ReferenceID == ref {
+			listed = true
+			assert.NotNil(s.DeletedAt)
+			assert.Equal(Flavors{{Name: "Lime"}}, Flavors(s.Flavors))
+		}
+	}
+	assert.True(listed, "expected deleted strain to be listed")
+
+	assert.Nil(store.RestoreStrain(ref))
+	s, err := store.StrainByRefID(ref)
+	assert.Nil(err)
+	assert.Equal(Flavors{{Name: "Lime"}}, Flavors(s.Flavors))
+	found, err = store.StrainsByRace(race, ListOptions{})
+	assert.Nil(err)
+	assert.Len(found.Strains, 1)
+}
+
+func TestGormStoreCreatingDeletedStrainReplacesIt(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	ref := Unique.Next()
+	_, err := store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo", Flavors: []string{"Lime"}}, WriteOptions{})
+	assert.Nil(err)
+	assert.Nil(store.DeleteStrain(ref, WriteOptions{}))
+	assert.Nil(store.CreateStrain(StrainRepr{ID: ref, Name: "reborn", Flavors: []string{"Mint"}}, WriteOptions{}))
+
+	s, err := store.StrainByRefID(ref)
+	assert.Nil(err)
+	assert.Equal("reborn", s.Name)
+	assert.Equal(Flavors{{Name: "Mint"}}, Flavors(s.Flavors))
+	assert.Equal(ErrNotExists, store.RestoreStrain(ref))
+}
+
+func TestPurgingDeletedStrains(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "purge")
+	defer cleanup()
+	assert.Nil(dbSrv.Migrate())
+	store := NewGormStore(dbSrv.DB)
+
+	for _, ref := range []uint{1, 2, 3} {
+		repr := StrainRepr{ID: ref, Name: "foo", Flavors: []string{"Lime"}}
+		repr.Effects.Positive = []string{"Happy"}
+		_, err := store.ReplaceStrain(repr, WriteOptions{})
+		assert.Nil(err)
+	}
+	first, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Nil(store.DeleteStrain(1, WriteOptions{}))
+	assert.Nil(store.DeleteStrain(2, WriteOptions{}))
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(dbSrv.DB.Unscoped().Model(&Strain{}).Where("reference_id = ?", 1).Update("deleted_at", old).Error)
+
+	purged, err := store.PurgeDeletedStrains(time.Now().Add(-24 * time.Hour))
+	assert.Nil(err)
+	assert.Equal(int64(1), purged)
+
+	// only the strain deleted long ago is gone for good, along with its join rows
+	var count int
+	assert.Nil(dbSrv.DB.Unscoped().Model(&Strain{}).Where("reference_id = ?", 1).Count(&count).Error)
+	assert.Equal(0, count)
+	assert.Nil(dbSrv.DB.Table("strain_flavors").Count(&count).Error)
+	assert.Equal(2, count)
+	assert.Nil(dbSrv.DB.Table("strain_effects").Count(&count).Error)
+	assert.Equal(2, count)
+	assert.Nil(store.RestoreStrain(2))
+	_, err = store.StrainByRefID(3)
+	assert.Nil(err)
+
+	// a strain created again after it was purged starts a new history, in a new record which the versions of the
+	// purged strain do not match
+	purgedVersion := StrainVersion{StrainID: first.StrainID, Revision: first.Revision}
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 1, Name: "bar"}, WriteOptions{}))
+	s, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal(uint(1), s.Revision)
+	assert.NotEqual(purgedVersion.StrainID, s.StrainID)
+	ifPurged := WriteOptions{IfMatch: &Precondition{Versions: []StrainVersion{purgedVersion}}}
+	_, err = store.ReplaceStrain(StrainRepr{ID: 1, Name: "baz"}, ifPurged)
+	assert.Equal(ErrPreconditionFailed, err)
+	assert.Equal(ErrPreconditionFailed, store.DeleteStrain(1, ifPurged))
+}
+
+func TestGormStoreRecordingHistory(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	ref := Unique.Next()
+	_, err := store.StrainHistory(ref)
+	assert.Equal(ErrNotExists, err)
+
+	repr := StrainRepr{ID: ref, Name: "Afpak", Race: "hybrid", Flavors: []string{"Pine"}}
+	assert.Nil(store.CreateStrain(repr, WriteOptions{Author: "alice"}))
+	repr.Race = "indica"
+	_, err = store.ReplaceStrain(repr, WriteOptions{Author: "bob", Message: "it is an indica"})
+	assert.Nil(err)
+	// writing the strain unchanged does not add a revision
+	_, err = store.ReplaceStrain(repr, WriteOptions{Author: "carol"})
+	assert.Nil(err)
+
+	history, err := store.StrainHistory(ref)
+	assert.Nil(err)
+	if assert.Len(history, 2) {
+		assert.Equal(uint(1), history[0].Revision)
+		assert.Equal("alice", history[0].Author)
+		assert.Equal("hybrid", history[0].Strain.Race)
+		assert.Equal([]string{"Pine"}, history[0].Strain.Flavors)
+		assert.Equal(uint(2), history[1].Revision)
+		assert.Equal("it is an indica", history[1].Message)
+		assert.Equal("indica", history[1].Strain.Race)
+	}
+
+	rev, err := store.StrainRevision(ref, 1)
+	assert.Nil(err)
+	assert.Equal("hybrid", rev.Strain.Race)
+	_, err = store.StrainRevision(ref, 3)
+	assert.Equal(ErrNotExists, err)
+}
+
+func TestGormStoreConditionalWrites(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	ref := Unique.Next()
+	var strainID uint
+	onRevision := func(revs ...uint) WriteOptions {
+		p := &Precondition{}
+		for _, rev := range revs {
+			p.Versions = append(p.Versions, StrainVersion{StrainID: strainID, Revision: rev})
+		}
+		return WriteOptions{IfMatch: p}
+	}
+	_, err := store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo"}, onRevision(1))
+	assert.Equal(ErrPreconditionFailed, err)
+	_, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo"}, WriteOptions{})
+	assert.Nil(err)
+	s, err := store.StrainByRefID(ref)
+	assert.Nil(err)
+	assert.Equal(uint(1), s.Revision)
+	// the revision of another strain record does not match
+	_, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "bar"}, onRevision(1))
+	assert.Equal(ErrPreconditionFailed, err)
+	strainID = s.StrainID
+
+	_, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "bar"}, onRevision(1))
+	assert.Nil(err)
+	_, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "baz"}, onRevision(1))
+	assert.Equal(ErrPreconditionFailed, err)
+	s, err = store.StrainByRefID(ref)
+	assert.Nil(err)
+	assert.Equal("bar", s.Name)
+	assert.Equal(uint(2), s.Revision)
+
+	assert.Equal(ErrPreconditionFailed, store.DeleteStrain(ref, onRevision(1)))
+	assert.Nil(store.DeleteStrain(ref, onRevision(2)))
+	assert.Equal(ErrNotExists, store.DeleteStrain(ref, onRevision(2)))
+}
+
+func TestGormStorePatchingStrains(t *testing.T) {
+	t.Parallel()
+	testPatchingStrains(t, NewGormStore(TestDB), Unique.Next())
+}
+
+func TestGormStoreWritingStrainsInBulk(t *testing.T) {
+	t.Parallel()
+	testWritingStrainsInBulk(t, NewGormStore(TestDB), Unique.Next(), Unique.Next(), Unique.Next())
+}
+
+func TestGormStoreSearchesReturnRevisionAndModificationTime(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	ref := Unique.Next()
+	race := fmt.Sprintf("race_%d", ref)
+	_, err := store.ReplaceStrain(StrainRepr{ID: ref, Name: "foo", Race: race}, WriteOptions{})
+	assert.Nil(err)
+	_, err = store.ReplaceStrain(StrainRepr{ID: ref, Name: "bar", Race: race}, WriteOptions{})
+	assert.Nil(err)
+
+	found, err := store.StrainsByRace(race, ListOptions{})
+	assert.Nil(err)
+	if assert.Len(found.Strains, 1) {
+		assert.Equal(uint(2), found.Strains[0].Revision)
+		assert.False(found.Strains[0].UpdatedAt.IsZero())
+	}
+}
+
+func TestGormStorePagingStrains(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	// the same strains in memory, with the modification times read back from the database, give the expected order
+	mem := NewMemoryStore()
+	race := fmt.Sprintf("paging_%d", Unique.Next())
+	for _, repr := range listableStrains() {
+		repr.ID = Unique.Next()
+		repr.Race = race
+		_, err := store.ReplaceStrain(repr, WriteOptions{})
+		assert.Nil(err)
+		s, err := store.StrainByRefID(repr.ID)
+		assert.Nil(err)
+		_, err = mem.ReplaceStrain(repr, WriteOptions{})
+		assert.Nil(err)
+		mem.strains[repr.ID] = s
+	}
+
+	for _, sort := range []string{"", "-id", "name", "-name", "updated", "-updated"} {
+		t.Run(sort, func(t *testing.T) {
+			expIDs, _ := walkPages(t, func(opts ListOptions) (StrainPage, error) {
+				return mem.StrainsByRace(race, opts)
+			}, sort, 0)
+			list := func(opts ListOptions) (StrainPage, error) {
+				return store.StrainsByRace(race, opts)
+			}
+			for _, limit := range []int{0, 1, 2, 3} {
+				forward, backward := walkPages(t, list, sort, limit)
+				assert.Equal(expIDs, forward, "paging forward %d at a time", limit)
+				assert.Equal(expIDs, backward, "paging backward %d at a time", limit)
+			}
+
+			page, err := list(ListOptions{Sort: sort, Limit: 2, Offset: 3})
+			assert.Nil(err)
+			assert.Equal(len(expIDs), page.Total)
+			if assert.Len(page.Strains, 2) {
+				assert.Equal(expIDs[3], page.Strains[0].ReferenceID)
+			}
+		})
+	}
+}
+
+// TestGormStorePagingStrainsAcrossTimeZones changes the local time zone, so it must not run in parallel.
+func TestGormStorePagingStrainsAcrossTimeZones(t *testing.T) {
+	assert := assert.New(t)
+	local := time.Local
+	defer func() { time.Local = local }()
+
+	dbSrv, cleanup := newScratchDBServer(t, "time_zones")
+	defer cleanup()
+	if err := dbSrv.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	store := NewGormStore(dbSrv.DB)
+
+	// the strains are written by a server seven hours west of UTC and paged by one ten hours east of it
+	time.Local = time.FixedZone("UTC-7", -7*60*60)
+	for _, repr := range listableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	assert.Nil(store.PatchStrain(3, mustParsePatch(t, MergePatchContentType, `{"name":"lime #1"}`), WriteOptions{}))
+	time.Local = time.FixedZone("UTC+10", 10*60*60)
+
+	list := func(opts ListOptions) (StrainPage, error) {
+		return store.StrainsByRace("hybrid", opts)
+	}
+	for _, sort := range []string{"updated", "-updated"} {
+		expIDs, _ := walkPages(t, list, sort, 0)
+		assert.Len(expIDs, len(listableStrains()))
+		forward, backward := walkPages(t, list, sort, 2)
+		assert.Equal(expIDs, forward, "paging forward by %s", sort)
+		assert.Equal(expIDs, backward, "paging backward by %s", sort)
+	}
+}
+
+func TestGormStoreSearchingStrainsByQuery(t *testing.T) {
+	t.Parallel()
+
+	dbSrv, cleanup := newScratchDBServer(t, "search")
+	defer cleanup()
+	if err := dbSrv.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	testSearchingStrains(t, NewGormStore(dbSrv.DB))
+}
+
+func TestGormStoreSearchingRacelessStrains(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "raceless_search")
+	defer cleanup()
+	if err := dbSrv.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	store := NewGormStore(dbSrv.DB)
+	for _, repr := range racelessStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	// strains written by other clients may store no race as NULL rather than empty
+	assert.Nil(dbSrv.DB.Exec("UPDATE strain SET race = NULL WHERE reference_id = ?", 2).Error)
+	testSearchingRacelessStrains(t, store)
+}
+
+func TestGormStoreSearchingNames(t *testing.T) {
+	t.Parallel()
+
+	dbSrv, cleanup := newScratchDBServer(t, "name_search")
+	defer cleanup()
+	if err := dbSrv.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	testSearchingNames(t, NewGormStore(dbSrv.DB))
+}
+
+func TestLoadingSuggestionsFromDB(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "suggest")
+	defer cleanup()
+	if err := dbSrv.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	store := NewGormStore(dbSrv.DB)
+	for _, repr := range searchableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 5, Name: "Early Girl", Flavors: []string{"Earl Grey"}}, WriteOptions{}))
+	assert.Nil(store.DeleteStrain(5, WriteOptions{}))
+
+	idx := NewSuggestIndex()
+	assert.Nil(idx.LoadFromDB(dbSrv.DB))
+	assert.Equal([]Suggestion{{SuggestFlavor, "Earthy"}}, idx.Suggest("ea", nil, 10))
+	assert.Equal([]Suggestion{{SuggestEffect, "Insomnia"}}, idx.Suggest("in", nil, 10))
+	assert.Equal([]Suggestion{{SuggestName, "a"}}, idx.Suggest("a", []SuggestKind{SuggestName}, 10))
+
+	// loaded vocabulary is removed with the last strain which uses it
+	idx.Remove(3)
+	assert.Empty(idx.Suggest("happy", nil, 10))
+	assert.Equal([]Suggestion{{SuggestFlavor, "Citrus"}}, idx.Suggest("cit", nil, 10))
+	idx.Remove(4)
+	assert.Empty(idx.Suggest("cit", nil, 10))
+}
+
+func TestConcurrentReplacesOfSameStrainAreAtomic(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewGormStore(TestDB)
+
+	// every writer shares one new flavor with the others and has one of its own
+	ref := Unique.Next()
+	shared := fmt.Sprintf("Shared %d", ref)
+	writers := 20
+	flavorSets := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		own := fmt.Sprintf("Own %d %d", ref, i)
+		flavorSets[shared+","+own] = true
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repr := StrainRepr{ID: ref, Name: fmt.Sprintf("writer %d", i), Race: "hybrid", Flavors: []string{shared, own}}
+			repr.Effects.Positive = []string{fmt.Sprintf("Effect %d", ref)}
+			_, err := store.ReplaceStrain(repr, WriteOptions{})
+			assert.Nil(err)
+		}(i)
+	}
+	wg.Wait()
+
+	s, err := store.StrainByRefID(ref)
+	assert.Nil(err)
+	repr := s.ToStrainRepr()
+	if assert.Len(repr.Flavors, 2) {
+		// the flavors come from a single writer rather than a mix of them
+		assert.True(flavorSets[repr.Flavors[0]+","+repr.Flavors[1]] || flavorSets[repr.Flavors[1]+","+repr.Flavors[0]],
+			"unexpected flavors %v", repr.Flavors)
+	}
+	assert.Equal([]string{fmt.Sprintf("Effect %d", ref)}, repr.Effects.Positive)
+
+	var count int
+	assert.Nil(TestDB.Model(&Flavor{}).Where("name = ?", shared).Count(&count).Error)
+	assert.Equal(1, count)
+	assert.Nil(TestDB.Model(&Effect{}).Where("name = ?", fmt.Sprintf("Effect %d", ref)).Count(&count).Error)
+	assert.Equal(1, count)
+}
+
+func TestMigratingMergesCaseVariantsOfTraits(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "case_variant_traits")
+	defer cleanup()
+	dbSrv.DBIteration = 4
+	assert.Nil(dbSrv.Migrate())
+
+	// three strains with their own spelling of the same race, flavor and effect, where the first two strains also
+	// share one spelling of the flavor
+	spellings := []string{"earthy", " Earthy", "EARTHY"}
+	for i, spelling := range spellings {
+		id := uint(i + 1)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO strain (strain_id, reference_id, name, race, updated_at) VALUES (?, ?, ?, ?, ?)",
+			id, id, "variant", []string{"sativa", "Sativa", " SATIVA"}[i], time.Now()).Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO flavor (flavor_id, name) VALUES (?, ?)", id, spelling).Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO strain_flavors (strain_strain_id, flavor_flavor_id) VALUES (?, ?)", id, id).Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO effect (effect_id, name, category) VALUES (?, ?, ?)",
+			id, []string{"dry mouth", "Dry Mouth", "dry  MOUTH"}[i], "negative").Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO strain_effects (strain_strain_id, effect_effect_id) VALUES (?, ?)", id, id).Error)
+	}
+	assert.Nil(dbSrv.DB.Exec("INSERT INTO strain_flavors (strain_strain_id, flavor_flavor_id) VALUES (?, ?)", 1, 2).Error)
+	// the same effect in another category is kept apart
+	assert.Nil(dbSrv.DB.Exec("INSERT INTO effect (effect_id, name, category) VALUES (?, ?, ?)", 4, "dry mouth", "medical").Error)
+	assert.Nil(dbSrv.DB.Exec("INSERT INTO strain_effects (strain_strain_id, effect_effect_id) VALUES (?, ?)", 3, 4).Error)
+
+	dbSrv.DBIteration = 5
+	assert.Nil(dbSrv.Migrate())
+
+	var count int
+	assert.Nil(dbSrv.DB.Model(&Flavor{}).Count(&count).Error)
+	assert.Equal(1, count)
+	assert.Nil(dbSrv.DB.Model(&Effect{}).Count(&count).Error)
+	assert.Equal(2, count)
+	for id := uint(1); id <= 3; id++ {
+		s := Strain{DB: dbSrv.DB}
+		assert.Nil(s.FromDBByRefID(id))
+		assert.Equal("sativa", s.Race)
+		assert.Equal(Flavors{{Name: "Earthy"}}, Flavors(s.Flavors))
+	}
+
+	// strains are found by the canonical vocabulary in any case, and new spellings are written to the same rows
+	store := NewGormStore(dbSrv.DB)
+	page, err := store.StrainsByRace("SATIVA", ListOptions{})
+	assert.Nil(err)
+	assert.Equal(3, page.Total)
+	page, err = store.StrainsByFlavor("eaRTHy", ListOptions{})
+	assert.Nil(err)
+	assert.Equal(3, page.Total)
+	page, err = store.StrainsByEffect("dry mouth", ListOptions{})
+	assert.Nil(err)
+	assert.Equal(3, page.Total)
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 4, Name: "new", Race: "Sativa ", Flavors: []string{"earthy "}}, WriteOptions{}))
+	assert.Nil(dbSrv.DB.Model(&Flavor{}).Count(&count).Error)
+	assert.Equal(1, count)
+	page, err = store.SearchStrains(StrainQuery{Races: []string{"sativa"}, Flavors: []string{"earthY"}}, ListOptions{})
+	assert.Nil(err)
+	assert.Equal(4, page.Total)
+}
+
+func TestMigratingMergesDuplicateTraits(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "duplicate_traits")
+	defer cleanup()
+	dbSrv.DBIteration = 1
+	assert.Nil(dbSrv.Migrate())
+
+	// two strains which each point at their own copy of the same flavor and effect
+	for i := uint(1); i <= 2; i++ {
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO strain (strain_id, reference_id, name) VALUES (?, ?, ?)", i, i, "dupe").Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO flavor (flavor_id, name) VALUES (?, ?)", i, "Pine").Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO strain_flavors (strain_strain_id, flavor_flavor_id) VALUES (?, ?)", i, i).Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO effect (effect_id, name, category) VALUES (?, ?, ?)", i, "Happy", "positive").Error)
+		assert.Nil(dbSrv.DB.Exec("INSERT INTO strain_effects (strain_strain_id, effect_effect_id) VALUES (?, ?)", i, i).Error)
+	}
+
+	dbSrv.DBIteration = 2
+	assert.Nil(dbSrv.Migrate())
+
+	var count int
+	assert.Nil(dbSrv.DB.Model(&Flavor{}).Count(&count).Error)
+	assert.Equal(1, count)
+	assert.Nil(dbSrv.DB.Model(&Effect{}).Count(&count).Error)
+	assert.Equal(1, count)
+	for i := uint(1); i <= 2; i++ {
+		s := Strain{DB: dbSrv.DB}
+		assert.Nil(s.FromDBByRefID(i))
+		assert.Equal(Flavors{{Name: "Pine"}}, Flavors(s.Flavors))
+		assert.Equal(Effects{{Name: "Happy", Category: "positive"}}, Effects(s.Effects))
+	}
+
+	// duplicates can no longer be created
+	assert.NotNil(dbSrv.DB.Exec("INSERT INTO flavor (name) VALUES (?)", "Pine").Error)
+}
+
+func TestSearchingStrainsUsesConstantQueries(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dbSrv, cleanup := newScratchDBServer(t, "constant_queries")
+	defer cleanup()
+	assert.Nil(dbSrv.Migrate())
+	queries := countQueries(dbSrv.DB)
+
+	tests := []struct {
+		name   string
+		search func(s *Strains, n int) error
+	}{
+		{"race", func(s *Strains, n int) error { return s.FromDBByRace(fmt.Sprintf("race_%d", n)) }},
+		{"flavor", func(s *Strains, n int) error { return s.FromDBByFlavor(fmt.Sprintf("flavor_%d", n)) }},
+		{"effect", func(s *Strains, n int) error { return s.FromDBByEffect(fmt.Sprintf("effect_%d", n)) }},
+	}
+
+	seedStrainsForSearch(t, dbSrv.DB, 1)
+	seedStrainsForSearch(t, dbSrv.DB, 20)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var counts []int64
+			for _, n := range []int{1, 20} {
+				atomic.StoreInt64(queries, 0)
+				s := Strains{DB: dbSrv.DB}
+				assert.Nil(tt.search(&s, n))
+				assert.Len(s.strains, n)
+				for _, strain := range s.strains {
+					assert.Len(strain.Flavors, 2)
+					assert.Len(strain.Effects, 2)
+				}
+				counts = append(counts, atomic.LoadInt64(queries))
+			}
+			assert.Equal(counts[0], counts[1], "query count grew with the number of strains found")
+		})
+	}
+}
+
+func BenchmarkSearchingStrainsByRace(b *testing.B) {
+	dbSrv, cleanup := newScratchDBServer(b, "benchmark_search")
+	defer cleanup()
+	if err := dbSrv.Migrate(); err != nil {
+		b.Fatal(err)
+	}
+	queries := countQueries(dbSrv.DB)
+
+	for _, n := range []int{1, 10, 100, 500} {
+		seedStrainsForSearch(b, dbSrv.DB, n)
+		b.Run(fmt.Sprintf("strains_%d", n), func(b *testing.B) {
+			atomic.StoreInt64(queries, 0)
+			for i := 0; i < b.N; i++ {
+				s := Strains{DB: dbSrv.DB}
+				if err := s.FromDBByRace(fmt.Sprintf("race_%d", n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(queries))/float64(b.N), "queries/op")
+		})
+	}
+}
+
+// countQueries counts every query made through db, returning the counter.
+func countQueries(db *gorm.DB) *int64 {
+	var queries int64
+	count := func(*gorm.Scope) {
+		atomic.AddInt64(&queries, 1)
+	}
+	db.Callback().Query().After("gorm:query").Register("tms:count_queries", count)
+	db.Callback().RowQuery().After("gorm:row_query").Register("tms:count_row_queries", count)
+	return &queries
+}
+
+// seedStrainsForSearch creates n strains of race race_<n>, which each have flavor_<n> and effect_<n> along
+// with a flavor and an effect of their own.
+func seedStrainsForSearch(t testing.TB, db *gorm.DB, n int) {
+	for i := 0; i < n; i++ {
+		repr := StrainRepr{
+			ID:      Unique.Next(),
+			Name:    fmt.Sprintf("strain %d of %d", i, n),
+			Race:    fmt.Sprintf("race_%d", n),
+			Flavors: []string{fmt.Sprintf("flavor_%d", n), fmt.Sprintf("flavor_%d_%d", n, i)},
+			DB:      db,
+		}
+		repr.Effects.Positive = []string{fmt.Sprintf("effect_%d", n)}
+		repr.Effects.Negative = []string{fmt.Sprintf("effect_%d_%d", n, i)}
+		if _, err := repr.ReplaceInDB(WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newScratchDBServer creates an open DBServer for an empty database of its own.  The returned cleanup function
+// removes the database.
+func newScratchDBServer(t testing.TB, name string) (*DBServer, func()) {
+	dbSrv := newTestDBServer()
+	dbSrv.Name = fmt.Sprintf("%s_%s", TestDatabaseName, name)
+	dbSrv.Path = filepath.Join(os.TempDir(), dbSrv.Name+".sqlite")
+	_ = os.Remove(dbSrv.Path)
+	if err := dbSrv.ensureDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbSrv.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	return dbSrv, func() {
+		if dbSrv.driver() == DriverMySQL {
+			dbSrv.DB.Exec(fmt.Sprintf("DROP DATABASE %s", dbSrv.Name))
+		}
+		_ = dbSrv.Close()
+		_ = os.Remove(dbSrv.Path)
+	}
+}
+
+// widgetMigrations are a small set of migrations for testing the migration process.
+func widgetMigrations() []Migration {
+	both := func(stmts ...string) Statements {
+		return Statements{DriverMySQL: stmts, DriverSQLite: stmts}
+	}
+	return []Migration{
+		{
+			Iteration:   1,
+			Description: "create widget",
+			Up:          both("CREATE TABLE widget (id integer)"),
+			Down:        both("DROP TABLE widget"),
+		},
+		{
+			Iteration:   2,
+			Description: "create gadget",
+			Up:          both("CREATE TABLE gadget (id integer, color varchar(32))"),
+			Down:        both("DROP TABLE gadget"),
+		},
+	}
+}
+
 type uniqueNum struct {
 	number uint
 	lock   sync.Mutex
@@ -0,0 +1,241 @@
+package tms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSort   = errors.New("sort must be one of name, id or updated, optionally prefixed with -")
+	ErrInvalidCursor = errors.New("cursor is not valid for this list")
+)
+
+// ListOptions select which strains of a list are returned, and in what order.
+type ListOptions struct {
+	// Sort is the attribute strains are sorted by, one of name, id or updated, prefixed with - to sort descending.
+	// Strains are sorted by ID when empty.  Ties are broken by ID, so the order is always the same.
+	Sort string
+	// Limit is the most strains returned, or every strain if zero.
+	Limit int
+	// Offset skips that many strains from the start of the list.  It is ignored when paging with a cursor.
+	Offset int
+	// Cursor returns the strains after, or before, the strain the cursor was taken from.  Unlike an offset, a
+	// cursor keeps its place in the list while strains are added and removed.
+	Cursor *Cursor
+}
+
+// StrainPage is a page of a list of strains.
+type StrainPage struct {
+	Strains []Strain
+	// Total is the number of strains in the whole list.
+	Total int
+	// Next and Prev are cursors to the pages after and before this one, nil if there is no such page.
+	Next *Cursor
+	Prev *Cursor
+}
+
+// Cursor marks a place in a sorted list of strains.  It holds the sort keys of the strain it was taken from, so
+// that the place is found again however the list has changed.
+type Cursor struct {
+	// Sort is the sort order of the list the cursor belongs to.
+	Sort string `json:"s"`
+	// Before selects the strains before the cursor rather than after it.
+	Before bool `json:"b,omitempty"`
+	// ID is the reference ID of the strain.
+	ID uint `json:"i"`
+	// Name is the name of the strain, if sorted by name.
+	Name string `json:"n,omitempty"`
+	// Updated is when the strain was last modified in Unix nanoseconds, if sorted by updated.
+	Updated int64 `json:"u,omitempty"`
+}
+
+// String encodes the cursor as an opaque token.
+func (c Cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor decodes a cursor from the token made by Cursor.String.
+func ParseCursor(token string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := parseSort(c.Sort); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// sortKey is a parsed sort order.
+type sortKey struct {
+	// field is one of name, id or updated.
+	field string
+	desc  bool
+}
+
+// parseSort parses the sort order of ListOptions.
+func parseSort(s string) (sortKey, error) {
+	var k sortKey
+	if strings.HasPrefix(s, "-") {
+		k.desc = true
+		s = s[1:]
+	}
+	switch s {
+	case "":
+		if k.desc {
+			return k, ErrInvalidSort
+		}
+		k.field = "id"
+	case "name", "id", "updated":
+		k.field = s
+	default:
+		return k, ErrInvalidSort
+	}
+	return k, nil
+}
+
+// String is the canonical form of the sort order, as held in cursors.
+func (k sortKey) String() string {
+	if k.desc {
+		return "-" + k.field
+	}
+	return k.field
+}
+
+// cursor is a cursor at the strain s, selecting the strains after it or before it.
+func (k sortKey) cursor(s Strain, before bool) *Cursor {
+	c := &Cursor{Sort: k.String(), Before: before, ID: s.ReferenceID}
+	switch k.field {
+	case "name":
+		c.Name = s.Name
+	case "updated":
+		c.Updated = s.UpdatedAt.UnixNano()
+	}
+	return c
+}
+
+// compare returns a negative number if strain s sorts before the cursor, a positive number if it sorts after, and
+// zero if the cursor was taken from s.
+func (k sortKey) compare(s Strain, c *Cursor) int {
+	var cmp int
+	switch k.field {
+	case "name":
+		cmp = strings.Compare(s.Name, c.Name)
+	case "updated":
+		cmp = compareInt64(s.UpdatedAt.UnixNano(), c.Updated)
+	}
+	if cmp == 0 {
+		cmp = compareInt64(int64(s.ReferenceID), int64(c.ID))
+	}
+	if k.desc {
+		return -cmp
+	}
+	return cmp
+}
+
+// column is the database column of the sort field.
+func (k sortKey) column() string {
+	switch k.field {
+	case "name":
+		return "strain.name"
+	case "updated":
+		return "strain.updated_at"
+	}
+	return "strain.reference_id"
+}
+
+// orderBy is the ORDER BY clause of the sort order, reversed if reverse is set.
+func (k sortKey) orderBy(reverse bool) string {
+	dir := "ASC"
+	if k.desc != reverse {
+		dir = "DESC"
+	}
+	if k.field == "id" {
+		return fmt.Sprintf("strain.reference_id %s", dir)
+	}
+	return fmt.Sprintf("%s %s, strain.reference_id %s", k.column(), dir, dir)
+}
+
+// keyset is the WHERE clause and its arguments selecting the strains on the side of the cursor it points to.
+func (k sortKey) keyset(c *Cursor) (string, []interface{}) {
+	op := ">"
+	if k.desc != c.Before {
+		op = "<"
+	}
+	switch k.field {
+	case "name":
+		return fmt.Sprintf("(strain.name %[1]s ? OR (strain.name = ? AND strain.reference_id %[1]s ?))", op),
+			[]interface{}{c.Name, c.Name, c.ID}
+	case "updated":
+		// in UTC, as times are written to the database, since SQLite compares them as text
+		updated := time.Unix(0, c.Updated).UTC()
+		return fmt.Sprintf("(strain.updated_at %[1]s ? OR (strain.updated_at = ? AND strain.reference_id %[1]s ?))", op),
+			[]interface{}{updated, updated, c.ID}
+	}
+	return fmt.Sprintf("strain.reference_id %s ?", op), []interface{}{c.ID}
+}
+
+// listStrains sorts every strain of a list held in memory and selects the page of it described by opts.
+func listStrains(all []Strain, opts ListOptions) (StrainPage, error) {
+	key, err := parseSort(opts.Sort)
+	if err != nil {
+		return StrainPage{}, err
+	}
+	if opts.Cursor != nil && opts.Cursor.Sort != key.String() {
+		return StrainPage{}, ErrInvalidCursor
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return key.compare(all[i], key.cursor(all[j], false)) < 0
+	})
+
+	page := StrainPage{Total: len(all)}
+	start, end := 0, len(all)
+	switch c := opts.Cursor; {
+	case c != nil && c.Before:
+		end = sort.Search(len(all), func(i int) bool { return key.compare(all[i], c) >= 0 })
+		if opts.Limit > 0 && end-opts.Limit > 0 {
+			start = end - opts.Limit
+		}
+	case c != nil:
+		start = sort.Search(len(all), func(i int) bool { return key.compare(all[i], c) > 0 })
+	default:
+		start = opts.Offset
+		if start > len(all) {
+			start = len(all)
+		}
+	}
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+	page.Strains = all[start:end]
+
+	if len(page.Strains) > 0 {
+		if start > 0 {
+			page.Prev = key.cursor(page.Strains[0], true)
+		}
+		if end < len(all) {
+			page.Next = key.cursor(page.Strains[len(page.Strains)-1], false)
+		}
+	}
+	return page, nil
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package tms
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// listableStrains are strains with names and modification times which tie, so that sorting depends on the ID.
+func listableStrains() []StrainRepr {
+	names := []string{"pine", "afpak", "lime", "afpak", "zkittlez", "lime", "blue dream"}
+	var reprs []StrainRepr
+	for i, name := range names {
+		reprs = append(reprs, StrainRepr{ID: uint(i + 1), Name: name, Race: "hybrid"})
+	}
+	return reprs
+}
+
+// walkPages follows the next cursors from the first page of a list to the last, then the prev cursors back to the
+// first, returning the reference IDs of the strains in the order they were seen going each way.
+func walkPages(t *testing.T, list func(ListOptions) (StrainPage, error), sort string, limit int) ([]uint, []uint) {
+	var forward, backward []uint
+	opts := ListOptions{Sort: sort, Limit: limit}
+	var last StrainPage
+	for i := 0; ; i++ {
+		page, err := list(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 20 {
+			t.Fatal("too many pages")
+		}
+		for _, s := range page.Strains {
+			forward = append(forward, s.ReferenceID)
+		}
+		last = page
+		if page.Next == nil {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+
+	page := last
+	for i := 0; ; i++ {
+		if i > 20 {
+			t.Fatal("too many pages")
+		}
+		ids := make([]uint, 0, len(page.Strains))
+		for _, s := range page.Strains {
+			ids = append(ids, s.ReferenceID)
+		}
+		backward = append(ids, backward...)
+		if page.Prev == nil {
+			break
+		}
+		opts.Cursor = page.Prev
+		var err error
+		if page, err = list(opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return forward, backward
+}
+
+func TestListingStrains(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+	for _, repr := range listableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	list := func(opts ListOptions) (StrainPage, error) {
+		return store.StrainsByRace("hybrid", opts)
+	}
+
+	tests := []struct {
+		sort   string
+		expIDs []uint
+	}{
+		{"", []uint{1, 2, 3, 4, 5, 6, 7}},
+		{"-id", []uint{7, 6, 5, 4, 3, 2, 1}},
+		{"name", []uint{2, 4, 7, 3, 6, 1, 5}},
+		{"-name", []uint{5, 1, 6, 3, 7, 4, 2}},
+		{"updated", []uint{1, 2, 3, 4, 5, 6, 7}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			page, err := list(ListOptions{Sort: tt.sort})
+			assert.Nil(err)
+			assert.Equal(7, page.Total)
+			var ids []uint
+			for _, s := range page.Strains {
+				ids = append(ids, s.ReferenceID)
+			}
+			assert.Equal(tt.expIDs, ids)
+
+			for _, limit := range []int{1, 2, 3, 7} {
+				forward, backward := walkPages(t, list, tt.sort, limit)
+				assert.Equal(tt.expIDs, forward, "paging forward %d at a time", limit)
+				assert.Equal(tt.expIDs, backward, "paging backward %d at a time", limit)
+			}
+
+			page, err = list(ListOptions{Sort: tt.sort, Limit: 2, Offset: 3})
+			assert.Nil(err)
+			if assert.Len(page.Strains, 2) {
+				assert.Equal(tt.expIDs[3], page.Strains[0].ReferenceID)
+			}
+			assert.NotNil(page.Prev)
+			assert.NotNil(page.Next)
+		})
+	}
+}
+
+func TestListingStrainsWithCursorKeepsPlaceWhileListChanges(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+	for _, repr := range listableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+
+	page, err := store.StrainsByRace("hybrid", ListOptions{Sort: "name", Limit: 3})
+	assert.Nil(err)
+
+	// strains added to and removed from the pages already seen do not move the next page
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 8, Name: "acapulco gold", Race: "hybrid"}, WriteOptions{}))
+	assert.Nil(store.DeleteStrain(2, WriteOptions{}))
+	page, err = store.StrainsByRace("hybrid", ListOptions{Sort: "name", Limit: 3, Cursor: page.Next})
+	assert.Nil(err)
+	var ids []uint
+	for _, s := range page.Strains {
+		ids = append(ids, s.ReferenceID)
+	}
+	assert.Equal([]uint{3, 6, 1}, ids)
+}
+
+func TestListingStrainsWithInvalidOptionsReturnsError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+
+	_, err := store.StrainsByRace("hybrid", ListOptions{Sort: "race"})
+	assert.Equal(ErrInvalidSort, err)
+	_, err = store.StrainsByRace("hybrid", ListOptions{Sort: "name", Cursor: &Cursor{Sort: "-id", ID: 1}})
+	assert.Equal(ErrInvalidCursor, err)
+}
+
+func TestParsingCursor(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	c := Cursor{Sort: "-updated", Before: true, ID: 7, Updated: time.Now().UnixNano()}
+	parsed, err := ParseCursor(c.String())
+	assert.Nil(err)
+	assert.Equal(&c, parsed)
+
+	for _, token := range []string{"", "not a cursor", Cursor{Sort: "race"}.String()} {
+		_, err := ParseCursor(token)
+		assert.Equal(ErrInvalidCursor, err, token)
+	}
+}
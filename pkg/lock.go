@@ -0,0 +1,112 @@
+package tms
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultMigrationLockTimeout is how long to wait for another instance to finish migrating when
+	// DBServer.LockTimeout is not set.
+	DefaultMigrationLockTimeout = time.Minute
+	// migrationLockPollInterval is how often the lock row is retried by backends without advisory locks.
+	migrationLockPollInterval = 250 * time.Millisecond
+	// migrationLockID is the key of the single row in the migration lock table.
+	migrationLockID = 1
+)
+
+var ErrMigrationLockTimeout = errors.New("timed out waiting for another instance to finish migrating the database")
+
+// lockMigrations takes a database wide lock so that only one instance migrates the database at a time.  The lock
+// is held until the returned unlock function is called.
+func (srv *DBServer) lockMigrations() (unlock func(), err error) {
+	timeout := srv.LockTimeout
+	if timeout == 0 {
+		timeout = DefaultMigrationLockTimeout
+	}
+
+	log.Debugf("waiting up to %s for the migration lock", timeout)
+	switch srv.driver() {
+	case DriverMySQL:
+		return srv.lockMySQL(timeout)
+	default:
+		return srv.lockRow(timeout)
+	}
+}
+
+// lockMySQL takes a MySQL advisory lock.  Advisory locks belong to a connection, so the lock is taken on a
+// connection of its own, outside the pool, which is held until the lock is released.  Reserving a connection from
+// the pool instead would leave the migration waiting forever for a connection when the pool has only one.
+func (srv *DBServer) lockMySQL(timeout time.Duration) (func(), error) {
+	ctx := context.Background()
+	lockDB, err := srv.connect(srv.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open connection for migration lock")
+	}
+	lockDB.DB().SetMaxOpenConns(1)
+	conn, err := lockDB.DB().Conn(ctx)
+	if err != nil {
+		_ = lockDB.Close()
+		return nil, errors.Wrap(err, "unable to reserve connection for migration lock")
+	}
+	closeConn := func() {
+		_ = conn.Close()
+		_ = lockDB.Close()
+	}
+
+	name := fmt.Sprintf("tms_migrate_%s", srv.Name)
+	var acquired sql.NullInt64
+	seconds := int(math.Ceil(timeout.Seconds()))
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, seconds).Scan(&acquired); err != nil {
+		closeConn()
+		return nil, errors.Wrap(err, "unable to get migration lock")
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		closeConn()
+		return nil, errors.Wrapf(ErrMigrationLockTimeout, "lock %s still held after %s", name, timeout)
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name); err != nil {
+			log.WithError(err).Errorf("unable to release migration lock %s", name)
+		}
+		closeConn()
+	}, nil
+}
+
+// lockRow takes the lock by inserting the single row of the migration lock table, for backends which have no
+// advisory locks.  If an instance dies while holding the lock, the row must be deleted by hand.
+func (srv *DBServer) lockRow(timeout time.Duration) (func(), error) {
+	err := srv.DB.Exec("CREATE TABLE IF NOT EXISTS migration_lock (lock_id integer PRIMARY KEY, locked_by varchar(255) NOT NULL, locked_at timestamp NOT NULL)").Error
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create migration lock table")
+	}
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	deadline := time.Now().Add(timeout)
+	for {
+		err := srv.DB.Exec("INSERT INTO migration_lock (lock_id, locked_by, locked_at) VALUES (?, ?, ?)", migrationLockID, owner, time.Now()).Error
+		if err == nil {
+			break
+		}
+		log.WithError(err).Tracef("migration lock is held by another instance")
+		if time.Now().After(deadline) {
+			return nil, errors.Wrapf(ErrMigrationLockTimeout, "lock row still held after %s, delete it from the migration_lock table if its owner is gone", timeout)
+		}
+		time.Sleep(migrationLockPollInterval)
+	}
+
+	return func() {
+		err := srv.DB.Exec("DELETE FROM migration_lock WHERE lock_id = ? AND locked_by = ?", migrationLockID, owner).Error
+		if err != nil {
+			log.WithError(err).Error("unable to release migration lock")
+		}
+	}, nil
+}
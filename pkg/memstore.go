@@ -0,0 +1,365 @@
+package tms
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a StrainStore which holds all strains in memory.  Nothing is persisted, which makes it useful for
+// development and testing where no database is available.  MemoryStore is safe for concurrent use.
+type MemoryStore struct {
+	mu sync.RWMutex
+	// strains are keyed on the strain reference ID.
+	strains map[uint]Strain
+	// deleted holds deleted strains which can still be restored, keyed on the strain reference ID.
+	deleted map[uint]Strain
+	// revisions holds the history of each strain, oldest first, keyed on the strain reference ID.
+	revisions map[uint][]StrainRevision
+	// lastID is the last StrainID handed out, mimicking the database auto increment.
+	lastID uint
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		strains:   make(map[uint]Strain),
+		deleted:   make(map[uint]Strain),
+		revisions: make(map[uint][]StrainRevision),
+	}
+}
+
+// StrainByRefID gets the strain with the given reference ID.
+func (ms *MemoryStore) StrainByRefID(id uint) (Strain, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	s, ok := ms.strains[id]
+	if !ok {
+		return Strain{}, ErrNotExists
+	}
+	return copyStrain(s), nil
+}
+
+// StrainByName gets the strain with the given name.  If several strains share the name the one with the lowest
+// reference ID is returned.
+func (ms *MemoryStore) StrainByName(name string) (Strain, error) {
+	matches := ms.filter(func(s Strain) bool {
+		return s.Name == name
+	})
+	if len(matches) == 0 {
+		return Strain{}, ErrNotExists
+	}
+	return matches[0], nil
+}
+
+// StrainsByNameMatch gets the strains whose names match name, best matches first.
+func (ms *MemoryStore) StrainsByNameMatch(name string, mode NameMode, limit int) ([]NameResult, error) {
+	return rankNameMatches(name, mode, ms.filter(func(Strain) bool { return true }), limit)
+}
+
+// StrainsByRace gets the page of strains of the given race, in any case.
+func (ms *MemoryStore) StrainsByRace(race string, opts ListOptions) (StrainPage, error) {
+	race = CanonicalRace(race)
+	return listStrains(ms.filter(func(s Strain) bool {
+		return s.Race == race
+	}), opts)
+}
+
+// StrainsByFlavor gets the page of strains with the given flavor, in any case.
+func (ms *MemoryStore) StrainsByFlavor(flavor string, opts ListOptions) (StrainPage, error) {
+	flavor = CanonicalTrait(flavor)
+	return listStrains(ms.filter(func(s Strain) bool {
+		for _, f := range s.Flavors {
+			if f.Name == flavor {
+				return true
+			}
+		}
+		return false
+	}), opts)
+}
+
+// StrainsByEffect gets the page of strains with the given effect, in any case and category.
+func (ms *MemoryStore) StrainsByEffect(effect string, opts ListOptions) (StrainPage, error) {
+	effect = CanonicalTrait(effect)
+	return listStrains(ms.filter(func(s Strain) bool {
+		for _, e := range s.Effects {
+			if e.Name == effect {
+				return true
+			}
+		}
+		return false
+	}), opts)
+}
+
+// SearchStrains gets the page of strains which meet every criterion of the query.
+func (ms *MemoryStore) SearchStrains(q StrainQuery, opts ListOptions) (StrainPage, error) {
+	q, err := q.normalize()
+	if err != nil {
+		return StrainPage{}, err
+	}
+	return listStrains(ms.filter(q.matches), opts)
+}
+
+// CreateStrain stores a new strain.
+func (ms *MemoryStore) CreateStrain(repr StrainRepr, opts WriteOptions) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.create(repr, opts)
+}
+
+// create stores a new strain.  The caller must hold the write lock.
+func (ms *MemoryStore) create(repr StrainRepr, opts WriteOptions) error {
+	if repr.ID == 0 {
+		return ErrReferenceIDNotSet
+	}
+	if _, ok := ms.strains[repr.ID]; ok {
+		return ErrRecordAlreadyExists
+	}
+	if err := opts.check(false, Strain{}); err != nil {
+		return err
+	}
+	return ms.put(repr, opts)
+}
+
+// ReplaceStrain creates or replaces the strain, reporting whether it was created.
+func (ms *MemoryStore) ReplaceStrain(repr StrainRepr, opts WriteOptions) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.replace(repr, opts)
+}
+
+// replace creates or replaces the strain, reporting whether it was created.  The caller must hold the write lock.
+func (ms *MemoryStore) replace(repr StrainRepr, opts WriteOptions) (bool, error) {
+	if repr.ID == 0 {
+		return false, ErrReferenceIDNotSet
+	}
+	existing, ok := ms.strains[repr.ID]
+	if err := opts.check(ok, existing); err != nil {
+		return false, err
+	}
+	if err := ms.put(repr, opts); err != nil {
+		return false, err
+	}
+	return !ok, nil
+}
+
+// PatchStrain applies the patch to the strain with the given reference ID.
+func (ms *MemoryStore) PatchStrain(id uint, patch Patch, opts WriteOptions) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, ok := ms.strains[id]
+	if !ok {
+		return ErrNotExists
+	}
+	if err := opts.check(true, s); err != nil {
+		return err
+	}
+	from := s.ToStrainRepr()
+	patched, err := applyPatch(from, patch)
+	if err != nil {
+		return err
+	}
+	if changed, err := patchChanged(from, patched); err != nil || !changed {
+		// a patch which changes nothing leaves the strain with its revision and update time
+		return err
+	}
+	return ms.put(patched, opts)
+}
+
+// DeleteStrain removes the strain with the given reference ID, keeping it aside so that it can be restored.
+func (ms *MemoryStore) DeleteStrain(id uint, opts WriteOptions) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.delete(id, opts)
+}
+
+// delete removes the strain with the given reference ID, keeping it aside.  The caller must hold the write lock.
+func (ms *MemoryStore) delete(id uint, opts WriteOptions) error {
+	s, ok := ms.strains[id]
+	if !ok {
+		return ErrNotExists
+	}
+	if err := opts.check(true, s); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.DeletedAt = &now
+	ms.deleted[id] = s
+	delete(ms.strains, id)
+	return nil
+}
+
+// WriteStrains makes the writes while holding the write lock, so that no other write is made between them.  An
+// atomic bulk write which fails puts the strains back as they were before it.
+func (ms *MemoryStore) WriteStrains(writes []BulkWrite, mode BulkMode, opts WriteOptions) ([]BulkOutcome, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	strains, deleted, revisions, lastID := ms.strains, ms.deleted, ms.revisions, ms.lastID
+	if mode == BulkAtomic {
+		// strains are stored by value and revisions are only appended, so copying the maps keeps the old state
+		ms.strains, ms.deleted = copyStrainMap(strains), copyStrainMap(deleted)
+		ms.revisions = make(map[uint][]StrainRevision, len(revisions))
+		for id, revs := range revisions {
+			ms.revisions[id] = revs
+		}
+	}
+
+	outcomes := make([]BulkOutcome, len(writes))
+	for i, w := range writes {
+		o := &outcomes[i]
+		switch w.Action {
+		case BulkCreate:
+			o.Err = ms.create(w.Strain, opts)
+			o.Created = o.Err == nil
+		case BulkReplace:
+			o.Created, o.Err = ms.replace(w.Strain, opts)
+		case BulkDelete:
+			o.Err = ms.delete(w.Strain.ID, opts)
+		default:
+			o.Err = errors.Errorf("unknown bulk action %s", w.Action)
+		}
+	}
+	if mode == BulkAtomic && abortBulk(outcomes) {
+		ms.strains, ms.deleted, ms.revisions, ms.lastID = strains, deleted, revisions, lastID
+	}
+	return outcomes, nil
+}
+
+// copyStrainMap makes a copy of a map of strains keyed on the strain reference ID.
+func copyStrainMap(strains map[uint]Strain) map[uint]Strain {
+	c := make(map[uint]Strain, len(strains))
+	for id, s := range strains {
+		c[id] = s
+	}
+	return c
+}
+
+// RestoreStrain brings back the deleted strain with the given reference ID.
+func (ms *MemoryStore) RestoreStrain(id uint) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, ok := ms.deleted[id]
+	if !ok {
+		return ErrNotExists
+	}
+	s.DeletedAt = nil
+	s.UpdatedAt = time.Now()
+	ms.strains[id] = s
+	delete(ms.deleted, id)
+	return nil
+}
+
+// DeletedStrains gets all deleted strains, ordered by reference ID.
+func (ms *MemoryStore) DeletedStrains() ([]Strain, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var deleted []Strain
+	for _, s := range ms.deleted {
+		deleted = append(deleted, copyStrain(s))
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].ReferenceID < deleted[j].ReferenceID
+	})
+	return deleted, nil
+}
+
+// put stores the strain and records a new revision of it if it changed, keeping the original creation time when
+// replacing.
+// Storing a strain which was deleted replaces the deleted strain.  The race and traits are stored in canonical form.
+// The caller must hold the write lock.
+func (ms *MemoryStore) put(repr StrainRepr, opts WriteOptions) error {
+	repr = repr.normalized()
+	rev, err := newStrainRevision(repr, opts)
+	if err != nil {
+		return err
+	}
+	revs := ms.revisions[repr.ID]
+	if len(revs) == 0 || revs[len(revs)-1].Snapshot != rev.Snapshot {
+		revs = append(revs, rev)
+		revs[len(revs)-1].Revision = uint(len(revs))
+		ms.revisions[repr.ID] = revs
+	}
+
+	now := time.Now()
+	s := repr.ToStrain()
+	s.DB = nil
+	s.Revision = uint(len(revs))
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	if existing, ok := ms.strains[repr.ID]; ok {
+		s.StrainID = existing.StrainID
+		s.CreatedAt = existing.CreatedAt
+	} else if deleted, ok := ms.deleted[repr.ID]; ok {
+		s.StrainID = deleted.StrainID
+		delete(ms.deleted, repr.ID)
+	} else {
+		ms.lastID++
+		s.StrainID = ms.lastID
+	}
+	ms.strains[repr.ID] = s
+	return nil
+}
+
+// StrainHistory gets every revision of the strain with the given reference ID, oldest first.
+func (ms *MemoryStore) StrainHistory(id uint) ([]StrainRevision, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	revs, ok := ms.revisions[id]
+	if !ok {
+		return nil, ErrNotExists
+	}
+	history := make([]StrainRevision, len(revs))
+	for i, rev := range revs {
+		// decode the snapshot again so that callers cannot modify the stored revision
+		if err := rev.decode(); err != nil {
+			return nil, err
+		}
+		history[i] = rev
+	}
+	return history, nil
+}
+
+// StrainRevision gets a single revision of the strain with the given reference ID.
+func (ms *MemoryStore) StrainRevision(id, revision uint) (StrainRevision, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	revs := ms.revisions[id]
+	if revision == 0 || revision > uint(len(revs)) {
+		return StrainRevision{}, ErrNotExists
+	}
+	rev := revs[revision-1]
+	return rev, rev.decode()
+}
+
+// filter returns a copy of every strain matching fn, ordered by reference ID.
+func (ms *MemoryStore) filter(fn func(Strain) bool) []Strain {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var matches []Strain
+	for _, s := range ms.strains {
+		if fn(s) {
+			matches = append(matches, copyStrain(s))
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ReferenceID < matches[j].ReferenceID
+	})
+	return matches
+}
+
+// copyStrain copies s so that callers cannot modify the stored flavors and effects.
+func copyStrain(s Strain) Strain {
+	c := s
+	c.Flavors = append([]Flavor(nil), s.Flavors...)
+	c.Effects = append([]Effect(nil), s.Effects...)
+	return c
+}
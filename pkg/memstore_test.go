@@ -0,0 +1,258 @@
+package tms
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// seededMemoryStore returns a MemoryStore populated with the strains from strainsJSON.
+func seededMemoryStore(t *testing.T) *MemoryStore {
+	reprs, err := ParseStrains(bytes.NewBufferString(strainsJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	for _, repr := range reprs {
+		if err := store.CreateStrain(repr, WriteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestMemoryStoreGettingStrainByRefID(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	tests := []struct {
+		name    string
+		id      uint
+		expName string
+		expErr  error
+	}{
+		{"first", 1, "foo", nil},
+		{"second", 2, "bar", nil},
+		{"missing", 3, "", ErrNotExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := store.StrainByRefID(tt.id)
+			assert.Equal(tt.expErr, err)
+			assert.Equal(tt.expName, s.Name)
+		})
+	}
+}
+
+func TestMemoryStoreGettingStrainByName(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	s, err := store.StrainByName("bar")
+	assert.Nil(err)
+	assert.Equal(uint(2), s.ReferenceID)
+	assert.Equal([]string{"F1", "F3"}, s.ToStrainRepr().Flavors)
+
+	_, err = store.StrainByName("baz")
+	assert.Equal(ErrNotExists, err)
+}
+
+func TestMemoryStoreSearchingStrains(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	tests := []struct {
+		name   string
+		search func(string, ListOptions) (StrainPage, error)
+		term   string
+		expIDs []uint
+	}{
+		{"race", store.StrainsByRace, "r1", []uint{1}},
+		{"race_no_match", store.StrainsByRace, "r3", nil},
+		{"flavor_shared", store.StrainsByFlavor, "f1", []uint{1, 2}},
+		{"flavor_single", store.StrainsByFlavor, "f3", []uint{2}},
+		{"effect_positive", store.StrainsByEffect, "pos1", []uint{1}},
+		{"effect_medical", store.StrainsByEffect, "med2", []uint{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := tt.search(tt.term, ListOptions{})
+			assert.Nil(err)
+			var ids []uint
+			for _, s := range page.Strains {
+				ids = append(ids, s.ReferenceID)
+			}
+			assert.Equal(tt.expIDs, ids)
+		})
+	}
+}
+
+func TestMemoryStoreCreatingExistingStrainReturnsError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	assert.Equal(ErrRecordAlreadyExists, store.CreateStrain(StrainRepr{ID: 1, Name: "dupe"}, WriteOptions{}))
+	assert.Equal(ErrReferenceIDNotSet, store.CreateStrain(StrainRepr{Name: "no_id"}, WriteOptions{}))
+}
+
+func TestMemoryStoreReplacingStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	before, err := store.StrainByRefID(1)
+	assert.Nil(err)
+
+	repr := StrainRepr{ID: 1, Name: "foo", Race: "r9", Flavors: []string{"f9"}}
+	created, err := store.ReplaceStrain(repr, WriteOptions{})
+	assert.Nil(err)
+	assert.False(created)
+
+	after, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal("r9", after.Race)
+	assert.Equal([]string{"F9"}, after.ToStrainRepr().Flavors)
+	assert.Equal(before.StrainID, after.StrainID)
+	assert.Equal(before.CreatedAt, after.CreatedAt)
+
+	page, err := store.StrainsByFlavor("f1", ListOptions{})
+	assert.Nil(err)
+	assert.Len(page.Strains, 1, "replaced strain should no longer match its old flavor")
+
+	created, err = store.ReplaceStrain(StrainRepr{ID: 99, Name: "new"}, WriteOptions{})
+	assert.Nil(err)
+	assert.True(created)
+}
+
+func TestMemoryStoreDeletingStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	assert.Nil(store.DeleteStrain(1, WriteOptions{}))
+	_, err := store.StrainByRefID(1)
+	assert.Equal(ErrNotExists, err)
+	assert.Equal(ErrNotExists, store.DeleteStrain(1, WriteOptions{}))
+
+	// writing a deleted strain creates it again
+	created, err := store.ReplaceStrain(StrainRepr{ID: 1, Name: "reborn"}, WriteOptions{})
+	assert.Nil(err)
+	assert.True(created)
+}
+
+func TestMemoryStoreRestoringStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	assert.Equal(ErrNotExists, store.RestoreStrain(1))
+	assert.Nil(store.DeleteStrain(1, WriteOptions{}))
+	deleted, err := store.DeletedStrains()
+	assert.Nil(err)
+	if assert.Len(deleted, 1) {
+		assert.Equal(uint(1), deleted[0].ReferenceID)
+		assert.NotNil(deleted[0].DeletedAt)
+	}
+
+	assert.Nil(store.RestoreStrain(1))
+	s, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal("foo", s.Name)
+	assert.Nil(s.DeletedAt)
+	assert.Equal(ErrNotExists, store.RestoreStrain(1))
+	deleted, err = store.DeletedStrains()
+	assert.Nil(err)
+	assert.Empty(deleted)
+}
+
+func TestMemoryStoreCreatingDeletedStrainReplacesIt(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	assert.Nil(store.DeleteStrain(1, WriteOptions{}))
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 1, Name: "reborn"}, WriteOptions{}))
+	s, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal("reborn", s.Name)
+	assert.Equal(ErrNotExists, store.RestoreStrain(1))
+}
+
+func TestMemoryStoreRecordingHistory(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+
+	_, err := store.StrainHistory(1)
+	assert.Equal(ErrNotExists, err)
+
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 1, Name: "Afpak", Race: "hybrid"}, WriteOptions{Author: "alice"}))
+	_, err = store.ReplaceStrain(StrainRepr{ID: 1, Name: "Afpak", Race: "indica"}, WriteOptions{Author: "bob"})
+	assert.Nil(err)
+	// writing the strain unchanged does not add a revision
+	_, err = store.ReplaceStrain(StrainRepr{ID: 1, Name: "Afpak", Race: "indica"}, WriteOptions{Author: "carol"})
+	assert.Nil(err)
+
+	history, err := store.StrainHistory(1)
+	assert.Nil(err)
+	if assert.Len(history, 2) {
+		assert.Equal(uint(1), history[0].Revision)
+		assert.Equal("alice", history[0].Author)
+		assert.Equal("hybrid", history[0].Strain.Race)
+		assert.Equal(uint(2), history[1].Revision)
+		assert.Equal("bob", history[1].Author)
+		assert.Equal("indica", history[1].Strain.Race)
+	}
+
+	rev, err := store.StrainRevision(1, 1)
+	assert.Nil(err)
+	assert.Equal("hybrid", rev.Strain.Race)
+	_, err = store.StrainRevision(1, 3)
+	assert.Equal(ErrNotExists, err)
+	_, err = store.StrainRevision(1, 0)
+	assert.Equal(ErrNotExists, err)
+}
+
+func TestMemoryStoreResultsCannotModifyStore(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := seededMemoryStore(t)
+
+	s, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	s.Flavors[0].Name = "changed"
+
+	s, err = store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal("F1", s.Flavors[0].Name)
+}
+
+func TestMemoryStoreConcurrentWrites(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			_, err := store.ReplaceStrain(StrainRepr{ID: id, Name: "concurrent", Race: "hybrid"}, WriteOptions{})
+			assert.Nil(err)
+			_, err = store.StrainsByRace("hybrid", ListOptions{})
+			assert.Nil(err)
+		}(uint(i%10 + 1))
+	}
+	wg.Wait()
+
+	page, err := store.StrainsByRace("hybrid", ListOptions{})
+	assert.Nil(err)
+	assert.Len(page.Strains, 10)
+}
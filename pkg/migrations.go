@@ -0,0 +1,245 @@
+package tms
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// MinSchemaIteration is the oldest schema iteration this version of the server can run against.  Raise it whenever
+// a migration makes a change which the server depends on.
+const MinSchemaIteration = 5
+
+var (
+	ErrMigrationsOutOfOrder   = errors.New("migrations must be numbered consecutively from iteration 1")
+	ErrMigrationMissingDriver = errors.New("migration has no statements for the database driver")
+	ErrSchemaTooOld           = errors.New("the database schema is older than this server supports, migrate the database")
+	ErrSchemaTooNew           = errors.New("the database schema is newer than this server supports, upgrade the server")
+)
+
+// Migration is a single, numbered change to the database schema.  Once a migration has been released it must never
+// be changed, instead add a new migration which makes the correction.
+type Migration struct {
+	// Iteration is the schema iteration the database is on once the migration has been applied.
+	Iteration uint
+	// Description briefly states what the migration does.
+	Description string
+	// Up holds the statements which apply the migration.
+	Up Statements
+	// Down holds the statements which reverse the migration.
+	Down Statements
+	// UpRewrite, if set, rewrites data after the Up statements have run, in the same transaction, for changes which
+	// cannot be made in SQL alone.  Rewrites are not reversed.
+	UpRewrite func(tx *gorm.DB) error
+}
+
+// Statements are the SQL statements which make up one step of a migration, keyed on the database driver.  The
+// statements for a step are run in order, in a single transaction.  MySQL implicitly commits after DDL statements,
+// so a step which fails there may have made some of its changes.  Its statements must be safe to run again: tables
+// are created and dropped with IF NOT EXISTS and IF EXISTS, and indexes and columns are created and dropped through
+// mysqlIfIndex and mysqlIfColumn, as MySQL has no such clauses for them.
+type Statements map[string][]string
+
+// mysqlIfIndex gives the statements which run stmt only if the index of table exists, or only if it does not.
+func mysqlIfIndex(table, index string, exists bool, stmt string) []string {
+	return mysqlIf(fmt.Sprintf("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = '%s' AND index_name = '%s'", table, index), exists, stmt)
+}
+
+// mysqlIfColumn gives the statements which run stmt only if the column of table exists, or only if it does not.
+func mysqlIfColumn(table, column string, exists bool, stmt string) []string {
+	return mysqlIf(fmt.Sprintf("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = '%s' AND column_name = '%s'", table, column), exists, stmt)
+}
+
+// mysqlIf gives the statements which run stmt only if the count query finds something, or only if it finds nothing.
+// MySQL chooses whether to run the statement when the step runs, so the step plans the same whatever state it left
+// the database in.
+func mysqlIf(count string, exists bool, stmt string) []string {
+	cmp := "= 0"
+	if exists {
+		cmp = "> 0"
+	}
+	return []string{
+		fmt.Sprintf("SET @tms_migration_stmt = IF((%s) %s, '%s', 'DO 0')", count, cmp, strings.Replace(stmt, "'", "''", -1)),
+		"PREPARE tms_migration_stmt FROM @tms_migration_stmt",
+		"EXECUTE tms_migration_stmt",
+		"DEALLOCATE PREPARE tms_migration_stmt",
+	}
+}
+
+// joinStatements joins lists of statements in order.
+func joinStatements(lists ...[]string) []string {
+	var stmts []string
+	for _, l := range lists {
+		stmts = append(stmts, l...)
+	}
+	return stmts
+}
+
+// Migrations is every migration of the database schema, ordered by iteration.
+var Migrations = []Migration{
+	{
+		Iteration:   1,
+		Description: "create strain, flavor and effect tables",
+		Up: Statements{
+			DriverMySQL: {
+				"CREATE TABLE IF NOT EXISTS `strain` (`created_at` timestamp NULL,`updated_at` timestamp NULL,`deleted_at` timestamp NULL,`strain_id` int unsigned AUTO_INCREMENT,`reference_id` int unsigned NOT NULL UNIQUE,`name` varchar(255) NOT NULL,`race` varchar(255) , PRIMARY KEY (`strain_id`))",
+				"CREATE TABLE IF NOT EXISTS `flavor` (`created_at` timestamp NULL,`updated_at` timestamp NULL,`deleted_at` timestamp NULL,`flavor_id` int unsigned AUTO_INCREMENT,`name` varchar(255) NOT NULL , PRIMARY KEY (`flavor_id`))",
+				"CREATE TABLE IF NOT EXISTS `effect` (`created_at` timestamp NULL,`updated_at` timestamp NULL,`deleted_at` timestamp NULL,`effect_id` int unsigned AUTO_INCREMENT,`name` varchar(255) NOT NULL,`category` varchar(255) NOT NULL , PRIMARY KEY (`effect_id`))",
+				"CREATE TABLE IF NOT EXISTS `strain_flavors` (`strain_strain_id` int unsigned,`flavor_flavor_id` int unsigned, PRIMARY KEY (`strain_strain_id`,`flavor_flavor_id`))",
+				"CREATE TABLE IF NOT EXISTS `strain_effects` (`strain_strain_id` int unsigned,`effect_effect_id` int unsigned, PRIMARY KEY (`strain_strain_id`,`effect_effect_id`))",
+			},
+			DriverSQLite: {
+				`CREATE TABLE IF NOT EXISTS "strain" ("created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"strain_id" integer primary key autoincrement,"reference_id" integer NOT NULL UNIQUE,"name" varchar(255) NOT NULL,"race" varchar(255) )`,
+				`CREATE TABLE IF NOT EXISTS "flavor" ("created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"flavor_id" integer primary key autoincrement,"name" varchar(255) NOT NULL )`,
+				`CREATE TABLE IF NOT EXISTS "effect" ("created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"effect_id" integer primary key autoincrement,"name" varchar(255) NOT NULL,"category" varchar(255) NOT NULL )`,
+				`CREATE TABLE IF NOT EXISTS "strain_flavors" ("strain_strain_id" integer,"flavor_flavor_id" integer, PRIMARY KEY ("strain_strain_id","flavor_flavor_id"))`,
+				`CREATE TABLE IF NOT EXISTS "strain_effects" ("strain_strain_id" integer,"effect_effect_id" integer, PRIMARY KEY ("strain_strain_id","effect_effect_id"))`,
+			},
+		},
+		Down: Statements{
+			DriverMySQL: {
+				"DROP TABLE IF EXISTS `strain_effects`",
+				"DROP TABLE IF EXISTS `strain_flavors`",
+				"DROP TABLE IF EXISTS `effect`",
+				"DROP TABLE IF EXISTS `flavor`",
+				"DROP TABLE IF EXISTS `strain`",
+			},
+			DriverSQLite: {
+				`DROP TABLE IF EXISTS "strain_effects"`,
+				`DROP TABLE IF EXISTS "strain_flavors"`,
+				`DROP TABLE IF EXISTS "effect"`,
+				`DROP TABLE IF EXISTS "flavor"`,
+				`DROP TABLE IF EXISTS "strain"`,
+			},
+		},
+	},
+	{
+		Iteration:   2,
+		Description: "merge duplicate flavors and effects, and make them unique",
+		Up: Statements{
+			DriverMySQL: joinStatements([]string{
+				"INSERT IGNORE INTO `strain_flavors` (`strain_strain_id`, `flavor_flavor_id`) SELECT sf.`strain_strain_id`, (SELECT MIN(keep.`flavor_id`) FROM `flavor` keep WHERE keep.`name` = f.`name`) FROM `strain_flavors` sf JOIN `flavor` f ON f.`flavor_id` = sf.`flavor_flavor_id`",
+				"DELETE FROM `strain_flavors` WHERE `flavor_flavor_id` NOT IN (SELECT `keep_id` FROM (SELECT MIN(`flavor_id`) AS `keep_id` FROM `flavor` GROUP BY `name`) AS `keep`)",
+				"DELETE FROM `flavor` WHERE `flavor_id` NOT IN (SELECT `keep_id` FROM (SELECT MIN(`flavor_id`) AS `keep_id` FROM `flavor` GROUP BY `name`) AS `keep`)",
+				"INSERT IGNORE INTO `strain_effects` (`strain_strain_id`, `effect_effect_id`) SELECT se.`strain_strain_id`, (SELECT MIN(keep.`effect_id`) FROM `effect` keep WHERE keep.`name` = e.`name` AND keep.`category` = e.`category`) FROM `strain_effects` se JOIN `effect` e ON e.`effect_id` = se.`effect_effect_id`",
+				"DELETE FROM `strain_effects` WHERE `effect_effect_id` NOT IN (SELECT `keep_id` FROM (SELECT MIN(`effect_id`) AS `keep_id` FROM `effect` GROUP BY `name`, `category`) AS `keep`)",
+				"DELETE FROM `effect` WHERE `effect_id` NOT IN (SELECT `keep_id` FROM (SELECT MIN(`effect_id`) AS `keep_id` FROM `effect` GROUP BY `name`, `category`) AS `keep`)",
+			},
+				mysqlIfIndex("flavor", "idx_flavor_name", false, "CREATE UNIQUE INDEX `idx_flavor_name` ON `flavor` (`name`)"),
+				mysqlIfIndex("effect", "idx_effect_name_category", false, "CREATE UNIQUE INDEX `idx_effect_name_category` ON `effect` (`name`, `category`)"),
+			),
+			DriverSQLite: {
+				`INSERT OR IGNORE INTO "strain_flavors" ("strain_strain_id", "flavor_flavor_id") SELECT sf."strain_strain_id", (SELECT MIN(keep."flavor_id") FROM "flavor" keep WHERE keep."name" = f."name") FROM "strain_flavors" sf JOIN "flavor" f ON f."flavor_id" = sf."flavor_flavor_id"`,
+				`DELETE FROM "strain_flavors" WHERE "flavor_flavor_id" NOT IN (SELECT MIN("flavor_id") FROM "flavor" GROUP BY "name")`,
+				`DELETE FROM "flavor" WHERE "flavor_id" NOT IN (SELECT MIN("flavor_id") FROM "flavor" GROUP BY "name")`,
+				`INSERT OR IGNORE INTO "strain_effects" ("strain_strain_id", "effect_effect_id") SELECT se."strain_strain_id", (SELECT MIN(keep."effect_id") FROM "effect" keep WHERE keep."name" = e."name" AND keep."category" = e."category") FROM "strain_effects" se JOIN "effect" e ON e."effect_id" = se."effect_effect_id"`,
+				`DELETE FROM "strain_effects" WHERE "effect_effect_id" NOT IN (SELECT MIN("effect_id") FROM "effect" GROUP BY "name", "category")`,
+				`DELETE FROM "effect" WHERE "effect_id" NOT IN (SELECT MIN("effect_id") FROM "effect" GROUP BY "name", "category")`,
+				`CREATE UNIQUE INDEX "idx_flavor_name" ON "flavor" ("name")`,
+				`CREATE UNIQUE INDEX "idx_effect_name_category" ON "effect" ("name", "category")`,
+			},
+		},
+		// merged duplicates are not split apart again
+		Down: Statements{
+			DriverMySQL: joinStatements(
+				mysqlIfIndex("effect", "idx_effect_name_category", true, "DROP INDEX `idx_effect_name_category` ON `effect`"),
+				mysqlIfIndex("flavor", "idx_flavor_name", true, "DROP INDEX `idx_flavor_name` ON `flavor`"),
+			),
+			DriverSQLite: {
+				`DROP INDEX IF EXISTS "idx_effect_name_category"`,
+				`DROP INDEX IF EXISTS "idx_flavor_name"`,
+			},
+		},
+	},
+	{
+		Iteration:   3,
+		Description: "create strain revision history table",
+		Up: Statements{
+			DriverMySQL: joinStatements([]string{
+				"CREATE TABLE IF NOT EXISTS `strain_revision` (`revision_id` int unsigned AUTO_INCREMENT,`reference_id` int unsigned NOT NULL,`revision` int unsigned NOT NULL,`author` varchar(255),`message` varchar(255),`created_at` timestamp NULL,`snapshot` text NOT NULL, PRIMARY KEY (`revision_id`))",
+			},
+				mysqlIfIndex("strain_revision", "idx_strain_revision", false, "CREATE UNIQUE INDEX `idx_strain_revision` ON `strain_revision` (`reference_id`, `revision`)"),
+			),
+			DriverSQLite: {
+				`CREATE TABLE "strain_revision" ("revision_id" integer primary key autoincrement,"reference_id" integer NOT NULL,"revision" integer NOT NULL,"author" varchar(255),"message" varchar(255),"created_at" datetime,"snapshot" text NOT NULL)`,
+				`CREATE UNIQUE INDEX "idx_strain_revision" ON "strain_revision" ("reference_id", "revision")`,
+			},
+		},
+		Down: Statements{
+			DriverMySQL: {
+				"DROP TABLE IF EXISTS `strain_revision`",
+			},
+			DriverSQLite: {
+				`DROP TABLE "strain_revision"`,
+			},
+		},
+	},
+	{
+		Iteration:   4,
+		Description: "track the latest revision of each strain",
+		Up: Statements{
+			DriverMySQL: joinStatements(
+				mysqlIfColumn("strain", "revision", false, "ALTER TABLE `strain` ADD COLUMN `revision` int unsigned NOT NULL DEFAULT 0"),
+				[]string{"UPDATE `strain` SET `revision` = COALESCE((SELECT MAX(r.`revision`) FROM `strain_revision` r WHERE r.`reference_id` = `strain`.`reference_id`), 0)"},
+			),
+			DriverSQLite: {
+				`ALTER TABLE "strain" ADD COLUMN "revision" integer NOT NULL DEFAULT 0`,
+				`UPDATE "strain" SET "revision" = COALESCE((SELECT MAX(r."revision") FROM "strain_revision" r WHERE r."reference_id" = "strain"."reference_id"), 0)`,
+			},
+		},
+		Down: Statements{
+			DriverMySQL: mysqlIfColumn("strain", "revision", true, "ALTER TABLE `strain` DROP COLUMN `revision`"),
+			// this version of SQLite cannot drop columns, so the table is copied without it
+			DriverSQLite: {
+				`CREATE TABLE "strain_downgrade" ("created_at" datetime,"updated_at" datetime,"deleted_at" datetime,"strain_id" integer primary key autoincrement,"reference_id" integer NOT NULL UNIQUE,"name" varchar(255) NOT NULL,"race" varchar(255) )`,
+				`INSERT INTO "strain_downgrade" ("created_at", "updated_at", "deleted_at", "strain_id", "reference_id", "name", "race") SELECT "created_at", "updated_at", "deleted_at", "strain_id", "reference_id", "name", "race" FROM "strain"`,
+				`DROP TABLE "strain"`,
+				`ALTER TABLE "strain_downgrade" RENAME TO "strain"`,
+			},
+		},
+	},
+	{
+		Iteration:   5,
+		Description: "rewrite races, flavors and effects in canonical form, merging case variants",
+		Up: Statements{
+			DriverMySQL:  {},
+			DriverSQLite: {},
+		},
+		UpRewrite: canonicalizeVocabulary,
+		// merged traits are not split apart again, and rewritten vocabulary keeps its canonical form
+		Down: Statements{
+			DriverMySQL:  {},
+			DriverSQLite: {},
+		},
+	},
+}
+
+// LatestIteration is the schema iteration the database is on once every migration has been applied.
+func LatestIteration() uint {
+	return latestIteration(Migrations)
+}
+
+func latestIteration(migrations []Migration) uint {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Iteration
+}
+
+// validateMigrations ensures migrations are numbered consecutively from 1 and that each step has statements
+// for the driver, so that a bad registry is caught before anything is run against the database.
+func validateMigrations(migrations []Migration, driver string) error {
+	for i, m := range migrations {
+		if m.Iteration != uint(i+1) {
+			return errors.Wrapf(ErrMigrationsOutOfOrder, "found iteration %d at position %d", m.Iteration, i+1)
+		}
+		if _, ok := m.Up[driver]; !ok {
+			return errors.Wrapf(ErrMigrationMissingDriver, "iteration %d up, driver %s", m.Iteration, driver)
+		}
+		if _, ok := m.Down[driver]; !ok {
+			return errors.Wrapf(ErrMigrationMissingDriver, "iteration %d down, driver %s", m.Iteration, driver)
+		}
+	}
+	return nil
+}
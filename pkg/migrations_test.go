@@ -0,0 +1,92 @@
+package tms
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRegisteredMigrationsAreValid(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	for _, driver := range []string{DriverMySQL, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			assert.Nil(validateMigrations(Migrations, driver))
+		})
+	}
+}
+
+func TestRegisteredMySQLMigrationsCanRunAgain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	for _, m := range Migrations {
+		for _, stmts := range []Statements{m.Up, m.Down} {
+			for _, stmt := range stmts[DriverMySQL] {
+				switch {
+				case strings.HasPrefix(stmt, "CREATE TABLE"):
+					assert.True(strings.HasPrefix(stmt, "CREATE TABLE IF NOT EXISTS"), stmt)
+				case strings.HasPrefix(stmt, "DROP TABLE"):
+					assert.True(strings.HasPrefix(stmt, "DROP TABLE IF EXISTS"), stmt)
+				default:
+					for _, ddl := range []string{"CREATE INDEX", "CREATE UNIQUE INDEX", "DROP INDEX", "ALTER TABLE"} {
+						assert.False(strings.HasPrefix(stmt, ddl), "%s must be run through mysqlIfIndex or mysqlIfColumn", stmt)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGuardingMySQLStatements(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal([]string{
+		"SET @tms_migration_stmt = IF((SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'strain' AND column_name = 'note') = 0, 'ALTER TABLE `strain` ADD COLUMN `note` varchar(255) DEFAULT ''none''', 'DO 0')",
+		"PREPARE tms_migration_stmt FROM @tms_migration_stmt",
+		"EXECUTE tms_migration_stmt",
+		"DEALLOCATE PREPARE tms_migration_stmt",
+	}, mysqlIfColumn("strain", "note", false, "ALTER TABLE `strain` ADD COLUMN `note` varchar(255) DEFAULT 'none'"))
+	assert.Contains(mysqlIfIndex("flavor", "idx_flavor_name", true, "DROP INDEX `idx_flavor_name` ON `flavor`")[0],
+		"AND table_name = 'flavor' AND index_name = 'idx_flavor_name') > 0, 'DROP INDEX")
+}
+
+func TestValidatingMigrations(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	stmts := Statements{DriverSQLite: {"SELECT 1"}}
+	m := func(iteration uint, description string, up, down Statements) Migration {
+		return Migration{Iteration: iteration, Description: description, Up: up, Down: down}
+	}
+	tests := []struct {
+		name       string
+		migrations []Migration
+		expErr     error
+	}{
+		{"empty", nil, nil},
+		{"consecutive", []Migration{m(1, "a", stmts, stmts), m(2, "b", stmts, stmts)}, nil},
+		{"not_from_one", []Migration{m(2, "a", stmts, stmts)}, ErrMigrationsOutOfOrder},
+		{"gap", []Migration{m(1, "a", stmts, stmts), m(3, "b", stmts, stmts)}, ErrMigrationsOutOfOrder},
+		{"out_of_order", []Migration{m(2, "a", stmts, stmts), m(1, "b", stmts, stmts)}, ErrMigrationsOutOfOrder},
+		{"missing_up", []Migration{m(1, "a", Statements{}, stmts)}, ErrMigrationMissingDriver},
+		{"missing_down", []Migration{m(1, "a", stmts, Statements{DriverMySQL: {}})}, ErrMigrationMissingDriver},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(tt.expErr, errors.Cause(validateMigrations(tt.migrations, DriverSQLite)))
+		})
+	}
+}
+
+func TestLatestIteration(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.Equal(uint(0), latestIteration(nil))
+	assert.Equal(Migrations[len(Migrations)-1].Iteration, LatestIteration())
+}
@@ -0,0 +1,176 @@
+package tms
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidNameMode = errors.New("name match must be one of exact, ignore_case, prefix, substring or fuzzy")
+	// ErrNameMatchNotPaged is returned for a name search asked for a page other than the best matches.
+	ErrNameMatchNotPaged = errors.New("a name search returns the best matches up to limit, without offset, sort or cursor")
+)
+
+// NameMode is how loosely a name search matches strain names.  Each mode also finds the matches of the modes
+// stricter than it.
+type NameMode string
+
+const (
+	// NameExact matches strains with exactly the name.
+	NameExact NameMode = "exact"
+	// NameIgnoreCase matches strains with the name in any case.
+	NameIgnoreCase NameMode = "ignore_case"
+	// NamePrefix matches strains whose names start with the name, in any case.
+	NamePrefix NameMode = "prefix"
+	// NameSubstring matches strains whose names contain the name, in any case.
+	NameSubstring NameMode = "substring"
+	// NameFuzzy also matches strains whose names are a few typos away from the name.
+	NameFuzzy NameMode = "fuzzy"
+)
+
+// NameMatch is how a strain found by a name search matched the name searched for.
+type NameMatch string
+
+const (
+	MatchedExactly      NameMatch = "exact"
+	MatchedIgnoringCase NameMatch = "ignore_case"
+	MatchedPrefix       NameMatch = "prefix"
+	MatchedSubstring    NameMatch = "substring"
+	MatchedWithTypos    NameMatch = "typo"
+)
+
+// nameMatchRank orders name matches from best to worst.  A mode finds the matches ranked up to its own rank.
+var nameMatchRank = map[NameMatch]int{
+	MatchedExactly:      0,
+	MatchedIgnoringCase: 1,
+	MatchedPrefix:       2,
+	MatchedSubstring:    3,
+	MatchedWithTypos:    4,
+}
+
+// nameModeRank is the rank of the worst match each mode finds.
+var nameModeRank = map[NameMode]int{
+	NameExact:      0,
+	NameIgnoreCase: 1,
+	NamePrefix:     2,
+	NameSubstring:  3,
+	NameFuzzy:      4,
+}
+
+// NameResult is a strain found by a name search.
+type NameResult struct {
+	// Match is how the strain name matched.
+	Match NameMatch
+	// Distance is the number of typos between the name searched for and the strain name, for typo matches.
+	Distance int
+	Strain   Strain
+}
+
+// maxTypos is how many typos a name can have and still match, which grows with the length of the name so that
+// short names do not match everything.
+func maxTypos(name string) int {
+	return utf8.RuneCountInString(name) / 4
+}
+
+// matchName returns the best way the strain name matches the name searched for, and reports whether it matches.
+func matchName(search, name string) (NameMatch, int, bool) {
+	if name == search {
+		return MatchedExactly, 0, true
+	}
+	s, n := strings.ToLower(search), strings.ToLower(name)
+	switch {
+	case n == s:
+		return MatchedIgnoringCase, 0, true
+	case strings.HasPrefix(n, s):
+		return MatchedPrefix, 0, true
+	case strings.Contains(n, s):
+		return MatchedSubstring, 0, true
+	}
+
+	// a typo can be anywhere in the name, or in the part of it which was typed so far
+	row := editDistances([]rune(s), []rune(n))
+	d := row[len(row)-1]
+	for _, p := range row {
+		if p < d {
+			d = p
+		}
+	}
+	if d > maxTypos(search) {
+		return "", 0, false
+	}
+	return MatchedWithTypos, d, true
+}
+
+// rankNameMatches finds the strains whose names match the name searched for as set by mode, best matches first.
+// Matches which are as good as each other are ordered by name and then reference ID.  At most limit results are
+// returned, or every result if limit is zero.
+func rankNameMatches(search string, mode NameMode, strains []Strain, limit int) ([]NameResult, error) {
+	worst, ok := nameModeRank[mode]
+	if !ok {
+		return nil, ErrInvalidNameMode
+	}
+	var results []NameResult
+	for _, s := range strains {
+		m, d, ok := matchName(search, s.Name)
+		if ok && nameMatchRank[m] <= worst {
+			results = append(results, NameResult{Match: m, Distance: d, Strain: s})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if nameMatchRank[a.Match] != nameMatchRank[b.Match] {
+			return nameMatchRank[a.Match] < nameMatchRank[b.Match]
+		}
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if a.Strain.Name != b.Strain.Name {
+			return a.Strain.Name < b.Strain.Name
+		}
+		return a.Strain.ReferenceID < b.Strain.ReferenceID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// editDistance is the Levenshtein distance between a and b, the fewest single rune insertions, deletions and
+// substitutions which turn a into b.
+func editDistance(a, b []rune) int {
+	return editDistances(a, b)[len(b)]
+}
+
+// editDistances returns the edit distance from a to every prefix of b, indexed by the length of the prefix.
+func editDistances(a, b []rune) []int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+func min3(a, b, c int) int {
+	m := a
+	if b < m {
+		m = b
+	}
+	if c < m {
+		m = c
+	}
+	return m
+}
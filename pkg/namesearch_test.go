@@ -0,0 +1,88 @@
+package tms
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// testSearchingNames searches a store for strains with names which look alike.
+func testSearchingNames(t *testing.T, store StrainStore) {
+	assert := assert.New(t)
+	names := []string{"Afpak", "Afghani", "Afternoon Delight", "Blue Dream", "Blueberry", "100% OG", "1000 OG"}
+	for i, name := range names {
+		assert.Nil(store.CreateStrain(StrainRepr{ID: uint(i + 1), Name: name, Flavors: []string{"Pine"}}, WriteOptions{}))
+	}
+
+	type result struct {
+		name     string
+		match    NameMatch
+		distance int
+	}
+	tests := []struct {
+		name   string
+		search string
+		mode   NameMode
+		limit  int
+		expRes []result
+		expErr error
+	}{
+		{"exact", "Afpak", NameExact, 0, []result{{"Afpak", MatchedExactly, 0}}, nil},
+		{"exact_wrong_case", "afpak", NameExact, 0, nil, nil},
+		{"ignore_case", "afpak", NameIgnoreCase, 0, []result{{"Afpak", MatchedIgnoringCase, 0}}, nil},
+		{"prefix", "af", NamePrefix, 0, []result{
+			{"Afghani", MatchedPrefix, 0}, {"Afpak", MatchedPrefix, 0}, {"Afternoon Delight", MatchedPrefix, 0},
+		}, nil},
+		{"prefix_limited", "af", NamePrefix, 2, []result{{"Afghani", MatchedPrefix, 0}, {"Afpak", MatchedPrefix, 0}}, nil},
+		{"prefix_ranks_exact_first", "Blue", NamePrefix, 0, []result{
+			{"Blue Dream", MatchedPrefix, 0}, {"Blueberry", MatchedPrefix, 0},
+		}, nil},
+		{"substring", "dream", NameSubstring, 0, []result{{"Blue Dream", MatchedSubstring, 0}}, nil},
+		{"substring_wildcards_are_literal", "0%", NameSubstring, 0, []result{{"100% OG", MatchedSubstring, 0}}, nil},
+		{"typo", "afpk", NameFuzzy, 0, []result{{"Afpak", MatchedWithTypos, 1}}, nil},
+		{"typos", "blu drem", NameFuzzy, 0, []result{{"Blue Dream", MatchedWithTypos, 2}}, nil},
+		{"typo_in_prefix", "aftrnoon", NameFuzzy, 0, []result{{"Afternoon Delight", MatchedWithTypos, 1}}, nil},
+		{"fuzzy_ranks_by_match", "Blueberry", NameFuzzy, 0, []result{{"Blueberry", MatchedExactly, 0}}, nil},
+		{"too_many_typos", "xfxxk", NameFuzzy, 0, nil, nil},
+		{"unknown_mode", "afpak", "soundex", 0, nil, ErrInvalidNameMode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := store.StrainsByNameMatch(tt.search, tt.mode, tt.limit)
+			assert.Equal(tt.expErr, err)
+			var res []result
+			for _, r := range results {
+				res = append(res, result{r.Strain.Name, r.Match, r.Distance})
+				assert.Len(r.Strain.Flavors, 1, "expected strains to be found with their traits")
+			}
+			assert.Equal(tt.expRes, res)
+		})
+	}
+}
+
+func TestMemoryStoreSearchingNames(t *testing.T) {
+	t.Parallel()
+	testSearchingNames(t, NewMemoryStore())
+}
+
+func TestEditDistance(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		a, b string
+		exp  int
+	}{
+		{"", "", 0},
+		{"kush", "", 4},
+		{"kush", "kush", 0},
+		{"kush", "kosh", 1},
+		{"kush", "kus", 1},
+		{"kitten", "sitting", 3},
+		{"grüne", "grune", 1},
+	}
+	for _, tt := range tests {
+		assert.Equal(tt.exp, editDistance([]rune(tt.a), []rune(tt.b)), "%s to %s", tt.a, tt.b)
+		assert.Equal(tt.exp, editDistance([]rune(tt.b), []rune(tt.a)), "%s to %s", tt.b, tt.a)
+	}
+}
@@ -0,0 +1,418 @@
+package tms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MergePatchContentType is the media type of a JSON merge patch, as described by RFC 7386.
+	MergePatchContentType = "application/merge-patch+json"
+	// JSONPatchContentType is the media type of a JSON patch, as described by RFC 6902.
+	JSONPatchContentType = "application/json-patch+json"
+)
+
+var ErrUnsupportedPatch = errors.New("patch content type must be " + MergePatchContentType + " or " + JSONPatchContentType)
+
+// Patch changes some of the attributes of a strain, leaving the rest as they are.
+type Patch interface {
+	// Apply returns the JSON document of a strain, decoded into maps, slices and values, with the patch applied.
+	Apply(doc interface{}) (interface{}, error)
+}
+
+// PatchError is a patch which cannot be applied to the strain as it is, such as a JSON patch operation on a path
+// which does not exist or a test which fails.
+type PatchError struct {
+	// Op is the index of the operation of the JSON patch which failed.
+	Op  int
+	Msg string
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("patch operation %d: %s", e.Op, e.Msg)
+}
+
+// ParsePatch parses a patch of the given content type, which is a JSON merge patch or a JSON patch.
+// ErrUnsupportedPatch is returned for any other content type.
+func ParsePatch(contentType string, src io.Reader) (Patch, error) {
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read patch")
+	}
+	switch contentType {
+	case MergePatchContentType:
+		var p MergePatch
+		if err := decodeJSON(b, &p.doc); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal merge patch")
+		}
+		return p, nil
+	case JSONPatchContentType:
+		var p JSONPatch
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal JSON patch")
+		}
+		return p, p.check()
+	}
+	return nil, ErrUnsupportedPatch
+}
+
+// MergePatch is a JSON merge patch, which gives the new values of the attributes it changes.  Attributes set to
+// null are removed, and objects are merged attribute by attribute, but lists are replaced as a whole.
+type MergePatch struct {
+	doc interface{}
+}
+
+// Apply merges the patch into doc.
+func (p MergePatch) Apply(doc interface{}) (interface{}, error) {
+	return mergePatch(doc, p.doc), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// JSONPatch is a JSON patch, a list of operations applied in order which add, remove, replace, move, copy and test
+// values at JSON pointers such as /effects/negative/0.  The patch is applied as a whole or not at all.
+type JSONPatch []PatchOperation
+
+// PatchOperation is an operation of a JSON patch.
+type PatchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// From is the path moved or copied from.
+	From string `json:"from,omitempty"`
+	// Value is the value added, replaced or tested.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// check ensures every operation has the members its op needs.
+func (p JSONPatch) check() error {
+	for i, op := range p {
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return errors.Errorf("patch operation %d: %s needs a value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return errors.Errorf("patch operation %d: from %s", i, err)
+			}
+		case "remove":
+		default:
+			return errors.Errorf("patch operation %d: op must be one of add, remove, replace, move, copy or test", i)
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return errors.Errorf("patch operation %d: path %s", i, err)
+		}
+	}
+	return nil
+}
+
+// Apply applies each operation of the patch to doc in order, returning a *PatchError for the first which fails.
+func (p JSONPatch) Apply(doc interface{}) (interface{}, error) {
+	for i, op := range p {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, &PatchError{Op: i, Msg: err.Error()}
+		}
+	}
+	return doc, nil
+}
+
+func (op PatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	var value interface{}
+	if len(op.Value) > 0 {
+		if err := decodeJSON(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		if op.Path != op.From && strings.HasPrefix(op.Path+"/", op.From+"/") {
+			return nil, errors.Errorf("cannot move %s into itself", op.From)
+		}
+		doc, moved, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, moved)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		copied, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// the copy is decoded again so that changing it later does not change the original
+		b, _ := json.Marshal(copied)
+		if err := decodeJSON(b, &copied); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, copied)
+	case "test":
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, errors.Errorf("test of %s failed", op.Path)
+		}
+		return doc, nil
+	}
+	return nil, errors.Errorf("unknown op %s", op.Op)
+}
+
+// parsePointer splits a JSON pointer into the keys and indexes it refers to.  The empty pointer is the whole
+// document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Errorf("%s must be empty or start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// getValue gets the value at path.
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for i, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			v, ok := d[token]
+			if !ok {
+				return nil, errors.Errorf("%s does not exist", pointerString(path[:i+1]))
+			}
+			doc = v
+		case []interface{}:
+			idx, err := arrayIndex(token, len(d)-1)
+			if err != nil {
+				return nil, errors.Errorf("%s %s", pointerString(path[:i+1]), err)
+			}
+			doc = d[idx]
+		default:
+			return nil, errors.Errorf("%s does not exist", pointerString(path[:i+1]))
+		}
+	}
+	return doc, nil
+}
+
+// addValue adds value at path, replacing an attribute of an object or inserting into a list.  The index - appends to
+// a list.
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			idx := len(p)
+			if token != "-" {
+				var err error
+				if idx, err = arrayIndex(token, len(p)); err != nil {
+					return nil, errors.Errorf("%s %s", pointerString(path), err)
+				}
+			}
+			p = append(p, nil)
+			copy(p[idx+1:], p[idx:])
+			p[idx] = value
+			return p, nil
+		}
+		return nil, errors.Errorf("%s is not in an object or list", pointerString(path))
+	})
+}
+
+// removeValue removes the value at path, which must exist, returning the document and the value removed.
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("the whole strain cannot be removed")
+	}
+	var removed interface{}
+	doc, err := updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			v, ok := p[token]
+			if !ok {
+				return nil, errors.Errorf("%s does not exist", pointerString(path))
+			}
+			removed = v
+			delete(p, token)
+			return p, nil
+		case []interface{}:
+			idx, err := arrayIndex(token, len(p)-1)
+			if err != nil {
+				return nil, errors.Errorf("%s %s", pointerString(path), err)
+			}
+			removed = p[idx]
+			return append(p[:idx], p[idx+1:]...), nil
+		}
+		return nil, errors.Errorf("%s does not exist", pointerString(path))
+	})
+	return doc, removed, err
+}
+
+// updateParent replaces the object or list holding the value at path with the result of fn, which is given it and
+// the last token of the path.
+func updateParent(doc interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	parentPath, token := path[:len(path)-1], path[len(path)-1]
+	if len(parentPath) == 0 {
+		return fn(doc, token)
+	}
+	grandparent, err := getValue(doc, parentPath[:len(parentPath)-1])
+	if err != nil {
+		return nil, err
+	}
+	parent, err := getValue(grandparent, parentPath[len(parentPath)-1:])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := fn(parent, token)
+	if err != nil {
+		return nil, err
+	}
+	// lists can grow and shrink, so the updated list is set back in its place
+	switch g := grandparent.(type) {
+	case map[string]interface{}:
+		g[parentPath[len(parentPath)-1]] = updated
+	case []interface{}:
+		idx, _ := arrayIndex(parentPath[len(parentPath)-1], len(g)-1)
+		g[idx] = updated
+	}
+	return doc, nil
+}
+
+// arrayIndex parses a token indexing a list, which must be from 0 to max.
+func arrayIndex(token string, max int) (int, error) {
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errors.New("is not a valid index of a list")
+	}
+	if idx > max {
+		return 0, errors.New("is past the end of the list")
+	}
+	return idx, nil
+}
+
+// pointerString joins tokens back into a JSON pointer.
+func pointerString(path []string) string {
+	var b strings.Builder
+	for _, t := range path {
+		b.WriteString("/")
+		b.WriteString(strings.Replace(strings.Replace(t, "~", "~0", -1), "/", "~1", -1))
+	}
+	return b.String()
+}
+
+// decodeJSON unmarshals b into v keeping numbers as they were written, so that IDs are not rounded.
+func decodeJSON(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.More() {
+		return errors.New("unexpected data after the end of the JSON value")
+	}
+	return nil
+}
+
+// applyPatch applies the patch to the strain, returning the patched strain in canonical form.  A *ValidationError
+// listing every problem is returned if the patched strain is not valid, or changes the ID of the strain.
+func applyPatch(repr StrainRepr, patch Patch) (StrainRepr, error) {
+	// lists are patched as empty lists rather than null, so that values can be added to them
+	repr.DeletedAt = nil
+	for _, list := range []*[]string{&repr.Flavors, &repr.Effects.Positive, &repr.Effects.Negative, &repr.Effects.Medical} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	b, err := json.Marshal(repr)
+	if err != nil {
+		return repr, errors.Wrapf(err, "unable to marshal strain with ID %d", repr.ID)
+	}
+	var doc interface{}
+	if err := decodeJSON(b, &doc); err != nil {
+		return repr, errors.Wrapf(err, "unable to unmarshal strain with ID %d", repr.ID)
+	}
+	doc, err = patch.Apply(doc)
+	if err != nil {
+		return repr, err
+	}
+	if b, err = json.Marshal(doc); err != nil {
+		return repr, errors.Wrapf(err, "unable to marshal patched strain with ID %d", repr.ID)
+	}
+
+	patched, err := unmarshalStrain(b)
+	verr := &ValidationError{}
+	if err := verr.Merge(err); err != nil {
+		return patched, err
+	}
+	if patched.ID != repr.ID {
+		verr.Add("id", "must not be changed")
+	}
+	_ = verr.Merge(patched.Validate())
+	if err := verr.Err(); err != nil {
+		return patched, err
+	}
+	return patched.normalized(), nil
+}
+
+// patchChanged reports whether the patched strain differs from the strain it was patched from, comparing them as
+// their revisions would be stored.
+func patchChanged(from, to StrainRepr) (bool, error) {
+	fromRev, err := newStrainRevision(from, WriteOptions{})
+	if err != nil {
+		return false, err
+	}
+	toRev, err := newStrainRevision(to, WriteOptions{})
+	if err != nil {
+		return false, err
+	}
+	return toRev.Snapshot != fromRev.Snapshot, nil
+}
@@ -0,0 +1,202 @@
+package tms
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// mustParsePatch parses a patch of the given content type, failing the test if it is not valid.
+func mustParsePatch(t *testing.T, contentType, patch string) Patch {
+	t.Helper()
+	p, err := ParsePatch(contentType, bytes.NewBufferString(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParsingPatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		expErr      string
+	}{
+		{"merge", MergePatchContentType, `{"race":"indica"}`, ""},
+		{"json", JSONPatchContentType, `[{"op":"add","path":"/flavors/-","value":"Citrus"}]`, ""},
+		{"null_value", JSONPatchContentType, `[{"op":"replace","path":"/race","value":null}]`, ""},
+		{"unsupported", "application/json", `{"race":"indica"}`, ErrUnsupportedPatch.Error()},
+		{"malformed_merge", MergePatchContentType, `{"race":`, "unable to unmarshal merge patch"},
+		{"trailing_data", MergePatchContentType, `{} {}`, "unable to unmarshal merge patch"},
+		{"not_a_list", JSONPatchContentType, `{"op":"remove","path":"/race"}`, "unable to unmarshal JSON patch"},
+		{"unknown_op", JSONPatchContentType, `[{"op":"append","path":"/flavors"}]`, "patch operation 0: op must be one of"},
+		{"missing_value", JSONPatchContentType, `[{"op":"remove","path":"/race"},{"op":"add","path":"/race"}]`, "patch operation 1: add needs a value"},
+		{"relative_path", JSONPatchContentType, `[{"op":"remove","path":"race"}]`, "patch operation 0: path race must be empty or start with /"},
+		{"missing_from", JSONPatchContentType, `[{"op":"move","from":"name","path":"/race"}]`, "patch operation 0: from name must be"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePatch(tt.contentType, bytes.NewBufferString(tt.patch))
+			if tt.expErr == "" {
+				assert.Nil(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), tt.expErr)
+			}
+		})
+	}
+}
+
+func TestApplyingPatch(t *testing.T) {
+	t.Parallel()
+	doc := `{"name":"Afpak","id":1,"race":"hybrid","flavors":["Pine","Earthy"],"effects":{"positive":["Happy"],"negative":["Dizzy"],"medical":[]}}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		exp         string
+		expErr      string
+	}{
+		{"merge", MergePatchContentType, `{"race":"indica","effects":{"medical":["Insomnia"]}}`,
+			`{"effects":{"medical":["Insomnia"],"negative":["Dizzy"],"positive":["Happy"]},"flavors":["Pine","Earthy"],"id":1,"name":"Afpak","race":"indica"}`, ""},
+		{"merge_null_removes", MergePatchContentType, `{"race":null,"effects":{"negative":null}}`,
+			`{"effects":{"medical":[],"positive":["Happy"]},"flavors":["Pine","Earthy"],"id":1,"name":"Afpak"}`, ""},
+		{"add_and_remove", JSONPatchContentType, `[{"op":"add","path":"/flavors/-","value":"Citrus"},{"op":"remove","path":"/effects/negative/0"}]`,
+			`{"effects":{"medical":[],"negative":[],"positive":["Happy"]},"flavors":["Pine","Earthy","Citrus"],"id":1,"name":"Afpak","race":"hybrid"}`, ""},
+		{"insert", JSONPatchContentType, `[{"op":"add","path":"/flavors/1","value":"Citrus"}]`,
+			`{"effects":{"medical":[],"negative":["Dizzy"],"positive":["Happy"]},"flavors":["Pine","Citrus","Earthy"],"id":1,"name":"Afpak","race":"hybrid"}`, ""},
+		{"replace", JSONPatchContentType, `[{"op":"test","path":"/flavors/0","value":"Pine"},{"op":"replace","path":"/flavors/0","value":"Pineapple"}]`,
+			`{"effects":{"medical":[],"negative":["Dizzy"],"positive":["Happy"]},"flavors":["Pineapple","Earthy"],"id":1,"name":"Afpak","race":"hybrid"}`, ""},
+		{"move", JSONPatchContentType, `[{"op":"move","from":"/effects/negative/0","path":"/effects/medical/-"}]`,
+			`{"effects":{"medical":["Dizzy"],"negative":[],"positive":["Happy"]},"flavors":["Pine","Earthy"],"id":1,"name":"Afpak","race":"hybrid"}`, ""},
+		{"copy", JSONPatchContentType, `[{"op":"copy","from":"/effects/positive","path":"/effects/medical"},{"op":"add","path":"/effects/medical/-","value":"Pain"}]`,
+			`{"effects":{"medical":["Happy","Pain"],"negative":["Dizzy"],"positive":["Happy"]},"flavors":["Pine","Earthy"],"id":1,"name":"Afpak","race":"hybrid"}`, ""},
+		{"failed_test", JSONPatchContentType, `[{"op":"remove","path":"/race"},{"op":"test","path":"/name","value":"Afghan"}]`,
+			"", "patch operation 1: test of /name failed"},
+		{"missing_member", JSONPatchContentType, `[{"op":"remove","path":"/colour"}]`, "", "patch operation 0: /colour does not exist"},
+		{"past_end", JSONPatchContentType, `[{"op":"replace","path":"/flavors/2","value":"Citrus"}]`, "", "patch operation 0: /flavors/2 is past the end of the list"},
+		{"bad_index", JSONPatchContentType, `[{"op":"add","path":"/flavors/01","value":"Citrus"}]`, "", "patch operation 0: /flavors/01 is not a valid index"},
+		{"into_itself", JSONPatchContentType, `[{"op":"move","from":"/effects","path":"/effects/positive"}]`, "", "cannot move /effects into itself"},
+		{"remove_whole", JSONPatchContentType, `[{"op":"remove","path":""}]`, "", "the whole strain cannot be removed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			var d interface{}
+			assert.Nil(decodeJSON([]byte(doc), &d))
+			patched, err := mustParsePatch(t, tt.contentType, tt.patch).Apply(d)
+			if tt.expErr != "" {
+				if assert.NotNil(err) {
+					_, isPatchErr := err.(*PatchError)
+					assert.True(isPatchErr)
+					assert.Contains(err.Error(), tt.expErr)
+				}
+				return
+			}
+			assert.Nil(err)
+			b, err := json.Marshal(patched)
+			assert.Nil(err)
+			assert.Equal(tt.exp, string(b))
+		})
+	}
+}
+
+func TestMemoryStorePatchingStrains(t *testing.T) {
+	t.Parallel()
+	testPatchingStrains(t, NewMemoryStore(), 1)
+}
+
+// testPatchingStrains tests patching the strain with the given reference ID, which must not exist yet, through store.
+func testPatchingStrains(t *testing.T, store StrainStore, id uint) {
+	assert := assert.New(t)
+	repr := StrainRepr{ID: id, Name: "Afpak", Race: "hybrid", Flavors: []string{"Pine", "Earthy"}}
+	repr.Effects.Positive = []string{"Happy"}
+	repr.Effects.Negative = []string{"Dizzy"}
+	assert.Nil(store.CreateStrain(repr, WriteOptions{Author: "alice"}))
+
+	get := func() (Strain, StrainRepr) {
+		s, err := store.StrainByRefID(id)
+		assert.Nil(err)
+		return s, s.ToStrainRepr()
+	}
+
+	p := mustParsePatch(t, JSONPatchContentType, `[{"op":"add","path":"/flavors/-","value":"citrus"},{"op":"remove","path":"/effects/negative/0"}]`)
+	assert.Nil(store.PatchStrain(id, p, WriteOptions{Author: "bob"}))
+	s, patched := get()
+	assert.Equal(uint(2), s.Revision)
+	assert.ElementsMatch([]string{"Pine", "Earthy", "Citrus"}, patched.Flavors)
+	assert.Equal([]string{"Happy"}, patched.Effects.Positive)
+	assert.Empty(patched.Effects.Negative)
+
+	p = mustParsePatch(t, MergePatchContentType, `{"name":"Afpak Kush","race":"Indica","effects":{"medical":["insomnia"]}}`)
+	onRevision2 := WriteOptions{IfMatch: &Precondition{Versions: []StrainVersion{{StrainID: s.StrainID, Revision: 2}}}}
+	assert.Nil(store.PatchStrain(id, p, onRevision2))
+	s, patched = get()
+	assert.Equal(uint(3), s.Revision)
+	assert.Equal("Afpak Kush", patched.Name)
+	assert.Equal("indica", patched.Race)
+	assert.Equal([]string{"Insomnia"}, patched.Effects.Medical)
+	assert.Len(patched.Flavors, 3)
+
+	// a patch which changes nothing, or is empty, neither adds a revision nor touches the strain
+	for _, noop := range []Patch{
+		mustParsePatch(t, MergePatchContentType, `{"name":"Afpak Kush","race":"indica"}`),
+		mustParsePatch(t, MergePatchContentType, `{}`),
+		mustParsePatch(t, JSONPatchContentType, `[]`),
+	} {
+		assert.Nil(store.PatchStrain(id, noop, WriteOptions{Author: "carol"}))
+		unchanged, _ := get()
+		assert.Equal(uint(3), unchanged.Revision)
+		assert.True(s.UpdatedAt.Equal(unchanged.UpdatedAt))
+		history, err := store.StrainHistory(id)
+		assert.Nil(err)
+		assert.Len(history, 3)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		patch       string
+		opts        WriteOptions
+		expErr      error
+		expFields   []string
+	}{
+		{"stale", MergePatchContentType, `{"race":"sativa"}`, onRevision2, ErrPreconditionFailed, nil},
+		{"failed_test", JSONPatchContentType, `[{"op":"replace","path":"/race","value":"sativa"},{"op":"test","path":"/name","value":"Afpak"}]`, WriteOptions{}, &PatchError{}, nil},
+		{"invalid", MergePatchContentType, `{"race":"sativia","flavors":["Pine","pine"],"colour":"green"}`, WriteOptions{}, &ValidationError{}, []string{"colour", "race", "flavors[1]"}},
+		{"changed_id", MergePatchContentType, `{"id":99999}`, WriteOptions{}, &ValidationError{}, []string{"id"}},
+		{"not_an_object", JSONPatchContentType, `[{"op":"replace","path":"","value":"Afpak"}]`, WriteOptions{}, &ValidationError{}, []string{"strain", "id", "name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.PatchStrain(id, mustParsePatch(t, tt.contentType, tt.patch), tt.opts)
+			assert.IsType(tt.expErr, err, tt.name)
+			if verr, ok := err.(*ValidationError); ok {
+				var fields []string
+				for _, f := range verr.Fields {
+					fields = append(fields, f.Field)
+				}
+				assert.Equal(tt.expFields, fields)
+			}
+		})
+	}
+	s, patched = get()
+	assert.Equal(uint(3), s.Revision)
+	assert.Equal("indica", patched.Race)
+
+	history, err := store.StrainHistory(id)
+	assert.Nil(err)
+	if assert.Len(history, 3) {
+		assert.Equal("bob", history[1].Author)
+		assert.Equal("Afpak Kush", history[2].Strain.Name)
+	}
+
+	assert.Nil(store.DeleteStrain(id, WriteOptions{}))
+	assert.Equal(ErrNotExists, store.PatchStrain(id, mustParsePatch(t, MergePatchContentType, `{}`), WriteOptions{}))
+}
@@ -0,0 +1,186 @@
+package tms
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+const (
+	// ProblemContentType is the media type of error responses, which are problem details as described by RFC 7807.
+	ProblemContentType = "application/problem+json"
+	// RequestIDHeader is the header carrying the ID of a request, which is sent with every response and given in
+	// error responses so that they can be found in the server's logs.
+	RequestIDHeader = "X-Request-ID"
+	// maxRequestIDLength is the longest request ID taken from a request.  Longer IDs are replaced.
+	maxRequestIDLength = 128
+)
+
+// Codes of the problems the API responds with.  Codes are stable, so clients can rely on them rather than on the
+// wording of the detail.
+const (
+	CodeInvalidID             = "invalid_id"
+	CodeInvalidRevision       = "invalid_revision"
+	CodeInvalidLimit          = "invalid_limit"
+	CodeInvalidOffset         = "invalid_offset"
+	CodeInvalidSort           = "invalid_sort"
+	CodeInvalidCursor         = "invalid_cursor"
+	CodeInvalidMatch          = "invalid_match"
+	CodeInvalidEffectCategory = "invalid_effect_category"
+	CodeInvalidNameMode       = "invalid_name_mode"
+	CodeNameMatchNotPaged     = "name_match_not_paged"
+	CodeInvalidSuggestKind    = "invalid_suggest_kind"
+	CodeMissingQuery          = "missing_query"
+	CodeInvalidQuery          = "invalid_query"
+	CodeInvalidJSON           = "invalid_json"
+	CodeInvalidStrain         = "invalid_strain"
+	CodeInvalidPatch          = "invalid_patch"
+	CodeUnsupportedPatch      = "unsupported_patch"
+	CodePatchConflict         = "patch_conflict"
+	CodeInvalidBulkMode       = "invalid_bulk_mode"
+	CodeTooManyWrites         = "too_many_writes"
+	CodeBodyTooLarge          = "body_too_large"
+	CodeBulkFailed            = "bulk_failed"
+	CodeBulkAborted           = "bulk_aborted"
+	CodeStrainNotFound        = "strain_not_found"
+	CodeRevisionNotFound      = "revision_not_found"
+	CodeStrainExists          = "strain_exists"
+	CodePreconditionFailed    = "precondition_failed"
+	CodePreconditionRequired  = "precondition_required"
+	CodeReadOnly              = "read_only"
+	CodeNotEnabled            = "not_enabled"
+	CodeNotFound              = "not_found"
+	CodeMethodNotAllowed      = "method_not_allowed"
+	CodeBadRequest            = "bad_request"
+	CodeInternalError         = "internal_error"
+)
+
+// requestErrorCodes are the codes of the errors made by invalid requests.
+var requestErrorCodes = map[error]string{
+	ErrStrainIdMustBeInteger: CodeInvalidID,
+	ErrRevisionMustBeInteger: CodeInvalidRevision,
+	ErrInvalidLimit:          CodeInvalidLimit,
+	ErrInvalidOffset:         CodeInvalidOffset,
+	ErrInvalidSort:           CodeInvalidSort,
+	ErrInvalidCursor:         CodeInvalidCursor,
+	ErrInvalidMatch:          CodeInvalidMatch,
+	ErrInvalidEffectCategory: CodeInvalidEffectCategory,
+	ErrInvalidNameMode:       CodeInvalidNameMode,
+	ErrNameMatchNotPaged:     CodeNameMatchNotPaged,
+	ErrInvalidSuggestKind:    CodeInvalidSuggestKind,
+	ErrSuggestQueryMissing:   CodeMissingQuery,
+	ErrSearchQueryMissing:    CodeMissingQuery,
+	ErrInvalidBulkMode:       CodeInvalidBulkMode,
+}
+
+// Problem is the body of every error response.
+type Problem struct {
+	// Title is the standard text of the status.
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Code identifies the problem, one of the Code constants.
+	Code string `json:"code"`
+	// Detail explains this occurrence of the problem to a person.
+	Detail string `json:"detail"`
+	// RequestID is the ID of the request, as sent in the RequestIDHeader.
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the problems with each field of an invalid strain.
+	Errors []FieldError `json:"errors,omitempty"`
+	// Results are the outcome of each write of an atomic bulk write which was not made.
+	Results []BulkResult `json:"results,omitempty"`
+}
+
+// writeProblem writes p as the response body with its status, filling in its title and the ID of the request.
+func writeProblem(w http.ResponseWriter, p Problem) {
+	p.Title = http.StatusText(p.Status)
+	p.RequestID = responseRequestID(w)
+	b, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(b)
+	_, _ = fmt.Fprintf(w, "\n")
+}
+
+// writeError writes a problem with the given status and code, and the detail made from format and args.
+func writeError(w http.ResponseWriter, status int, code, format string, args ...interface{}) {
+	writeProblem(w, Problem{Status: status, Code: code, Detail: fmt.Sprintf(format, args...)})
+}
+
+// writeBadRequest writes a bad request problem for err, an error made by an invalid request.
+func writeBadRequest(w http.ResponseWriter, err error) {
+	code, ok := requestErrorCodes[err]
+	if !ok {
+		code = CodeBadRequest
+	}
+	writeError(w, http.StatusBadRequest, code, "%s", err)
+}
+
+// writeInternalError logs err, with the message made from format and args, and writes an internal server error
+// problem.  The error is only logged, as it can reveal details of the database such as SQL, and the request ID in
+// the response leads to it.
+func writeInternalError(w http.ResponseWriter, err error, format string, args ...interface{}) {
+	log.WithError(err).WithField("request_id", responseRequestID(w)).Errorf(format, args...)
+	writeError(w, http.StatusInternalServerError, CodeInternalError, "the server was unable to complete the request")
+}
+
+// pageNotFound writes a not found problem for a request which no handler is routed to.
+func pageNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, CodeNotFound, "page not found")
+}
+
+// methodNotAllowed writes a problem for a request made with a method the page does not support.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method %s is not allowed", r.Method)
+}
+
+// RequestIDMw sets the ID of the request in the RequestIDHeader of the response.  The ID sent by the client is used
+// if it has a valid one, so that requests can be traced through proxies, and a new ID is made otherwise.
+func RequestIDMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseRequestID gets the request ID set in the response, setting a new one if there is none yet.
+func responseRequestID(w http.ResponseWriter) string {
+	id := w.Header().Get(RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+		w.Header().Set(RequestIDHeader, id)
+	}
+	return id
+}
+
+// validRequestID reports whether a request ID sent by a client can be used.  Only short IDs of letters, digits and
+// a few punctuation marks are used, so they cannot forge lines of the logs or headers of the response.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID makes a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.WithError(err).Warn("unable to make random request ID")
+	}
+	return hex.EncodeToString(b)
+}
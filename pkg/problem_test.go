@@ -0,0 +1,108 @@
+package tms
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingStore is a StrainStore whose searches fail with err.
+type failingStore struct {
+	StrainStore
+	err error
+}
+
+func (s failingStore) StrainsByRace(race string, opts ListOptions) (StrainPage, error) {
+	return StrainPage{}, s.err
+}
+
+func TestInternalErrorsDoNotRevealCause(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	cause := errors.New("Error 1054: Unknown column 'strain.rase' in 'where clause' SELECT * FROM strain")
+	srv := Server{Store: failingStore{StrainStore: NewMemoryStore(), err: cause}}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/strains/race/indica", nil)
+	w := serve("/api/strains/race/{race}", srv.StrainByRaceHandler, req)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	p := problem(t, w)
+	assert.Equal(CodeInternalError, p.Code)
+	assert.Equal("Internal Server Error", p.Title)
+	assert.NotEmpty(p.RequestID)
+	assert.Equal(w.Header().Get(RequestIDHeader), p.RequestID)
+	assert.NotContains(w.Body.String(), "strain.rase")
+	assert.NotContains(w.Body.String(), "SELECT")
+}
+
+func TestProblemsThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		expStatus int
+		expCode   string
+	}{
+		{"revision_not_found", http.MethodGet, "/api/strains/id/1/history/9", http.StatusNotFound, CodeRevisionNotFound},
+		{"bad_revision", http.MethodGet, "/api/strains/id/1/history/x", http.StatusBadRequest, CodeInvalidRevision},
+		{"strain_not_found", http.MethodGet, "/api/strains/id/3", http.StatusNotFound, CodeStrainNotFound},
+		{"unrouted_method", http.MethodTrace, "/api/strains/id/1", http.StatusNotFound, CodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			var w *httptest.ResponseRecorder
+			if strings.Contains(tt.path, "history") {
+				w = serve("/api/strains/id/{id}/history/{rev}", srv.StrainRevisionHandler, req)
+			} else {
+				w = serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+			}
+			assert.Equal(tt.expStatus, w.Code)
+			p := problem(t, w)
+			assert.Equal(tt.expStatus, p.Status)
+			assert.Equal(tt.expCode, p.Code)
+			assert.NotEmpty(p.Detail)
+		})
+	}
+}
+
+func TestRequestIDMw(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		sent    string
+		expKept bool
+	}{
+		{"kept", "abc-123_def.4:5", true},
+		{"missing", "", false},
+		{"forged_log_line", "abc\nlevel=error", false},
+		{"too_long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req := httptest.NewRequest(http.MethodGet, "/api/strains/id/abc", nil)
+			if tt.sent != "" {
+				req.Header.Set(RequestIDHeader, tt.sent)
+			}
+			w := httptest.NewRecorder()
+			RequestIDMw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeBadRequest(w, ErrStrainIdMustBeInteger)
+			})).ServeHTTP(w, req)
+
+			id := w.Header().Get(RequestIDHeader)
+			assert.NotEmpty(id)
+			assert.Equal(tt.expKept, id == tt.sent)
+			assert.Equal(id, problem(t, w).RequestID)
+		})
+	}
+}
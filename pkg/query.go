@@ -0,0 +1,446 @@
+package tms
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SyntaxError is an error in a query language expression.
+type SyntaxError struct {
+	// Pos is the position of the error in the expression, counting characters from 1.
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// Expr is an expression of the strain query language, parsed by ParseQuery.  Expressions match strains, and are
+// searched for with the Filter of a StrainQuery.
+type Expr interface {
+	// String formats the expression in the query language.
+	String() string
+	// matches reports whether the strain matches the expression.
+	matches(s Strain) bool
+	// sql compiles the expression to a condition on the strain table and its arguments.
+	sql() (string, []interface{})
+}
+
+// And matches strains which match every expression.
+type And []Expr
+
+// Or matches strains which match any of the expressions.
+type Or []Expr
+
+// Not matches strains which do not match the expression.
+type Not struct {
+	X Expr
+}
+
+// Term matches strains with a value of a field, in any case.  Races and traits are compared in canonical form.
+type Term struct {
+	// Field is one of name, race, flavor or effect.
+	Field string
+	// Category limits an effect to one category, if set.
+	Category string
+	Value    string
+}
+
+// queryFields are the fields of terms, with the effect category they select.
+var queryFields = map[string]Term{
+	"name":            {Field: "name"},
+	"race":            {Field: "race"},
+	"flavor":          {Field: "flavor"},
+	"effect":          {Field: "effect"},
+	"effect.positive": {Field: "effect", Category: "positive"},
+	"effect.negative": {Field: "effect", Category: "negative"},
+	"effect.medical":  {Field: "effect", Category: "medical"},
+}
+
+// ParseQuery parses an expression of the strain query language, returning a *SyntaxError if it is not valid.
+//
+// Terms are written field:value, where the field is one of name, race, flavor, effect, effect.positive,
+// effect.negative or effect.medical.  Values with spaces or special characters are quoted.  Terms are combined with
+// AND, OR and NOT or -, and grouped with parentheses.  AND binds tighter than OR, and is implied between terms
+// written next to each other.  A field applies to every value of a group, so flavor:(earthy OR pine) is the same as
+// (flavor:earthy OR flavor:pine).
+func ParseQuery(q string) (Expr, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokColon
+	tokMinus
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// pos is the position of the token, counting characters from 1.
+	pos int
+}
+
+// lexQuery splits a query language expression into tokens.
+func lexQuery(q string) ([]token, error) {
+	var tokens []token
+	runes := []rune(q)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", pos})
+			i++
+		case r == ':':
+			tokens = append(tokens, token{tokColon, ":", pos})
+			i++
+		case r == '-':
+			tokens = append(tokens, token{tokMinus, "-", pos})
+			i++
+		case r == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, &SyntaxError{pos, "unterminated quoted value"}
+			}
+			i++
+			tokens = append(tokens, token{tokString, b.String(), pos})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`():"`, runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, string(runes[start:i]), pos})
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(runes) + 1}), nil
+}
+
+// queryParser is a recursive descent parser of the query language.
+type queryParser struct {
+	tokens []token
+	next   int
+	// field is the field of the group being parsed, which applies to its bare values, or nil outside a group.
+	field *Term
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *queryParser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokEOF {
+		p.next++
+	}
+	return t
+}
+
+// isKeyword reports whether the token is the keyword, which is always upper case.
+func isKeyword(t token, keyword string) bool {
+	return t.kind == tokWord && t.text == keyword
+}
+
+// or parses expressions separated by OR.
+func (p *queryParser) or() (Expr, error) {
+	var exprs Or
+	for {
+		e, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !isKeyword(p.peek(), "OR") {
+			break
+		}
+		p.take()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+// and parses expressions separated by AND, or written next to each other.
+func (p *queryParser) and() (Expr, error) {
+	var exprs And
+	for {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		t := p.peek()
+		if isKeyword(t, "AND") {
+			p.take()
+			continue
+		}
+		if t.kind == tokEOF || t.kind == tokRParen || isKeyword(t, "OR") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+// unary parses an expression which may be negated.
+func (p *queryParser) unary() (Expr, error) {
+	if t := p.peek(); t.kind == tokMinus || isKeyword(t, "NOT") {
+		p.take()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{e}, nil
+	}
+	return p.primary()
+}
+
+// primary parses a group or a term.
+func (p *queryParser) primary() (Expr, error) {
+	t := p.take()
+	switch {
+	case t.kind == tokLParen:
+		return p.group(t)
+	case t.kind == tokString && p.field != nil:
+		return p.term(*p.field, t.text), nil
+	case t.kind == tokWord && !isKeyword(t, "AND") && !isKeyword(t, "OR"):
+		if p.peek().kind != tokColon {
+			if p.field != nil {
+				return p.term(*p.field, t.text), nil
+			}
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("expected field:value, found %q without a field", t.text)}
+		}
+		if p.field != nil {
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("field %s inside a group for field %s", t.text, p.fieldName())}
+		}
+		field, ok := queryFields[t.text]
+		if !ok {
+			return nil, &SyntaxError{t.pos, fmt.Sprintf("unknown field %s", t.text)}
+		}
+		p.take()
+		v := p.take()
+		switch v.kind {
+		case tokWord, tokString:
+			return p.term(field, v.text), nil
+		case tokLParen:
+			p.field = &field
+			defer func() { p.field = nil }()
+			return p.group(v)
+		}
+		return nil, p.expected("a value", v)
+	}
+	return nil, p.expected("a term", t)
+}
+
+// group parses the rest of a group opened by the token open.
+func (p *queryParser) group(open token) (Expr, error) {
+	if p.peek().kind == tokRParen {
+		return nil, &SyntaxError{p.peek().pos, "empty group"}
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.take(); t.kind != tokRParen {
+		return nil, p.expected(fmt.Sprintf("\")\" to close \"(\" at position %d", open.pos), t)
+	}
+	return e, nil
+}
+
+func (p *queryParser) term(field Term, value string) Term {
+	field.Value = value
+	return field
+}
+
+// fieldName is the name of the field of the group being parsed.
+func (p *queryParser) fieldName() string {
+	if p.field.Category != "" {
+		return p.field.Field + "." + p.field.Category
+	}
+	return p.field.Field
+}
+
+func (p *queryParser) expected(what string, found token) error {
+	if found.kind == tokEOF {
+		return &SyntaxError{found.pos, fmt.Sprintf("expected %s, found end of query", what)}
+	}
+	return &SyntaxError{found.pos, fmt.Sprintf("expected %s, found %q", what, found.text)}
+}
+
+func (p *queryParser) unexpected(found token) error {
+	return &SyntaxError{found.pos, fmt.Sprintf("unexpected %q", found.text)}
+}
+
+func (e And) String() string {
+	return joinExprs(e, " AND ")
+}
+
+func (e And) matches(s Strain) bool {
+	for _, x := range e {
+		if !x.matches(s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e And) sql() (string, []interface{}) {
+	return joinSQL(e, " AND ")
+}
+
+func (e Or) String() string {
+	return joinExprs(e, " OR ")
+}
+
+func (e Or) matches(s Strain) bool {
+	for _, x := range e {
+		if x.matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Or) sql() (string, []interface{}) {
+	return joinSQL(e, " OR ")
+}
+
+func (e Not) String() string {
+	return "-" + groupExpr(e.X)
+}
+
+func (e Not) matches(s Strain) bool {
+	return !e.X.matches(s)
+}
+
+func (e Not) sql() (string, []interface{}) {
+	cond, args := e.X.sql()
+	return "NOT " + cond, args
+}
+
+func (e Term) String() string {
+	field := e.Field
+	if e.Category != "" {
+		field += "." + e.Category
+	}
+	value := e.Value
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`():"-\`, r)
+	}) >= 0 || value == "AND" || value == "OR" || value == "NOT" {
+		value = strconv.Quote(value)
+	}
+	return field + ":" + value
+}
+
+func (e Term) matches(s Strain) bool {
+	switch e.Field {
+	case "name":
+		return strings.EqualFold(s.Name, e.Value)
+	case "race":
+		return s.Race == CanonicalRace(e.Value)
+	case "flavor":
+		for _, f := range s.Flavors {
+			if f.Name == CanonicalTrait(e.Value) {
+				return true
+			}
+		}
+	case "effect":
+		for _, eff := range s.Effects {
+			if eff.Name == CanonicalTrait(e.Value) && (e.Category == "" || eff.Category == e.Category) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e Term) sql() (string, []interface{}) {
+	switch e.Field {
+	case "name":
+		return "(LOWER(strain.name) = ?)", []interface{}{strings.ToLower(e.Value)}
+	case "race":
+		// strains stored without a race may have a NULL race, which must compare as the empty race does in memory so
+		// that negated terms find them
+		return "(COALESCE(strain.race, '') = ?)", []interface{}{CanonicalRace(e.Value)}
+	case "flavor":
+		return "(strain.strain_id IN (SELECT strain_flavors.strain_strain_id FROM strain_flavors " +
+			"JOIN flavor ON strain_flavors.flavor_flavor_id = flavor.flavor_id " +
+			"WHERE flavor.name = ?))", []interface{}{CanonicalTrait(e.Value)}
+	case "effect":
+		sub := "SELECT strain_effects.strain_strain_id FROM strain_effects " +
+			"JOIN effect ON strain_effects.effect_effect_id = effect.effect_id " +
+			"WHERE effect.name = ?"
+		args := []interface{}{CanonicalTrait(e.Value)}
+		if e.Category != "" {
+			sub += " AND effect.category = ?"
+			args = append(args, e.Category)
+		}
+		return "(strain.strain_id IN (" + sub + "))", args
+	}
+	// terms are only made by the parser, which only knows the fields above
+	return "(1 = 0)", nil
+}
+
+// groupExpr formats the expression, in parentheses if it combines other expressions.
+func groupExpr(e Expr) string {
+	switch e.(type) {
+	case And, Or:
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+func joinExprs(exprs []Expr, sep string) string {
+	parts := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		parts = append(parts, groupExpr(e))
+	}
+	return strings.Join(parts, sep)
+}
+
+func joinSQL(exprs []Expr, sep string) (string, []interface{}) {
+	conds := make([]string, 0, len(exprs))
+	var args []interface{}
+	for _, e := range exprs {
+		cond, a := e.sql()
+		conds = append(conds, cond)
+		args = append(args, a...)
+	}
+	return "(" + strings.Join(conds, sep) + ")", args
+}
@@ -0,0 +1,95 @@
+package tms
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// mustParseQuery parses an expression which is known to be valid.
+func mustParseQuery(q string) Expr {
+	e, err := ParseQuery(q)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func TestParsingQuery(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		name  string
+		query string
+		exp   Expr
+		// expString is the expression formatted back into the query language.
+		expString string
+	}{
+		{"term", "race:indica", Term{Field: "race", Value: "indica"}, "race:indica"},
+		{"category", "effect.medical:insomnia", Term{Field: "effect", Category: "medical", Value: "insomnia"},
+			"effect.medical:insomnia"},
+		{"quoted", `effect:"dry mouth"`, Term{Field: "effect", Value: "dry mouth"}, `effect:"dry mouth"`},
+		{"escaped_quote", `name:"the \"one\""`, Term{Field: "name", Value: `the "one"`}, `name:"the \"one\""`},
+		{"implied_and", "race:indica -effect:paranoid", And{
+			Term{Field: "race", Value: "indica"},
+			Not{Term{Field: "effect", Value: "paranoid"}},
+		}, "race:indica AND -effect:paranoid"},
+		{"and_before_or", "name:a OR name:b AND race:indica", Or{
+			Term{Field: "name", Value: "a"},
+			And{Term{Field: "name", Value: "b"}, Term{Field: "race", Value: "indica"}},
+		}, "name:a OR (name:b AND race:indica)"},
+		{"field_group", "flavor:(earthy OR NOT pine)", Or{
+			Term{Field: "flavor", Value: "earthy"},
+			Not{Term{Field: "flavor", Value: "pine"}},
+		}, "flavor:earthy OR -flavor:pine"},
+		{"nested", "-(race:indica OR race:hybrid) flavor:pine", And{
+			Not{Or{Term{Field: "race", Value: "indica"}, Term{Field: "race", Value: "hybrid"}}},
+			Term{Field: "flavor", Value: "pine"},
+		}, "-(race:indica OR race:hybrid) AND flavor:pine"},
+		{"hyphenated_value", "name:og-kush", Term{Field: "name", Value: "og-kush"}, `name:"og-kush"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseQuery(tt.query)
+			assert.Nil(err)
+			assert.Equal(tt.exp, e)
+			assert.Equal(tt.expString, e.String())
+			again, err := ParseQuery(e.String())
+			assert.Nil(err)
+			assert.Equal(tt.exp, again, "formatted expressions should parse to the same expression")
+		})
+	}
+}
+
+func TestParsingInvalidQueryReturnsPosition(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		name   string
+		query  string
+		expErr *SyntaxError
+	}{
+		{"empty", "", &SyntaxError{1, "expected a term, found end of query"}},
+		{"missing_field", "race:indica earthy", &SyntaxError{13, `expected field:value, found "earthy" without a field`}},
+		{"unknown_field", "race:indica AND taste:sweet", &SyntaxError{17, "unknown field taste"}},
+		{"unknown_category", "effect.fun:happy", &SyntaxError{1, "unknown field effect.fun"}},
+		{"missing_value", "race:", &SyntaxError{6, "expected a value, found end of query"}},
+		{"unclosed_group", "flavor:(earthy OR pine", &SyntaxError{23, `expected ")" to close "(" at position 8, found end of query`}},
+		{"empty_group", "race:indica ()", &SyntaxError{14, "empty group"}},
+		{"unopened_group", "race:indica)", &SyntaxError{12, `unexpected ")"`}},
+		{"dangling_operator", "race:indica AND", &SyntaxError{16, "expected a term, found end of query"}},
+		{"leading_operator", "OR race:indica", &SyntaxError{1, `expected a term, found "OR"`}},
+		{"field_in_group", "flavor:(earthy OR race:indica)", &SyntaxError{19, "field race inside a group for field flavor"}},
+		{"unterminated_quote", `effect:"dry mouth`, &SyntaxError{8, "unterminated quoted value"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			assert.Equal(tt.expErr, err)
+		})
+	}
+	assert.EqualError(&SyntaxError{5, "empty group"}, "syntax error at position 5: empty group")
+}
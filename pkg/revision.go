@@ -0,0 +1,211 @@
+package tms
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SeedAuthor is the author of strains written from a seed file.
+const SeedAuthor = "seed"
+
+var ErrPreconditionFailed = errors.New("the strain does not match the precondition of the write")
+
+// WriteOptions describe who is writing a strain and why, and are recorded in the strain's revision history.
+type WriteOptions struct {
+	// Author is who made the change.
+	Author string
+	// Message optionally explains the change.
+	Message string
+	// IfMatch makes the write fail with ErrPreconditionFailed unless the strain matches it.  The write is
+	// unconditional if unset.
+	IfMatch *Precondition
+}
+
+// Precondition is what a strain must match for a conditional write to go ahead, so that a write based on a stale
+// read of the strain does not overwrite changes made since.
+type Precondition struct {
+	// Any matches any existing strain.
+	Any bool
+	// Versions matches a strain which is on any of the versions.
+	Versions []StrainVersion
+}
+
+// StrainVersion identifies a revision of a strain as stored in a single database record.  Revisions are numbered
+// again from 1 when a purged strain is created anew, but the new strain is stored in a new record, so the versions
+// of the strain which was purged never match it.
+type StrainVersion struct {
+	// StrainID is the database ID of the strain.
+	StrainID uint
+	// Revision is the revision of the strain.
+	Revision uint
+}
+
+// check ensures a strain which exists as given matches the precondition of the write.
+func (opts WriteOptions) check(exists bool, s Strain) error {
+	p := opts.IfMatch
+	if p == nil {
+		return nil
+	}
+	if exists && p.Any {
+		return nil
+	}
+	for _, v := range p.Versions {
+		if exists && v.StrainID == s.StrainID && v.Revision == s.Revision {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// where gets the SQL condition, and its arguments, which select a strain on any of the versions of the precondition.
+func (p *Precondition) where() (string, []interface{}) {
+	if len(p.Versions) == 0 {
+		return "1 = 0", nil
+	}
+	var conds []string
+	var args []interface{}
+	for _, v := range p.Versions {
+		conds = append(conds, "(strain_id = ? AND revision = ?)")
+		args = append(args, v.StrainID, v.Revision)
+	}
+	return strings.Join(conds, " OR "), args
+}
+
+// StrainRevision is an immutable snapshot of a strain, recorded each time the strain is changed.
+type StrainRevision struct {
+	RevisionID uint `gorm:"primary_key;auto_increment" json:"-"`
+	// ReferenceID is the reference ID of the strain the revision belongs to.
+	ReferenceID uint `gorm:"not null" json:"id"`
+	// Revision numbers the revisions of a single strain, starting from 1.
+	Revision uint `gorm:"not null" json:"revision"`
+	// Author is who wrote the revision.
+	Author string `json:"author"`
+	// Message optionally explains the revision.
+	Message string `json:"message,omitempty"`
+	// CreatedAt is when the revision was written.
+	CreatedAt time.Time `json:"created_at"`
+	// Snapshot holds the strain as written, in JSON.
+	Snapshot string `gorm:"type:text;not null" json:"-"`
+	// Strain is the strain as written, decoded from the snapshot.
+	Strain StrainRepr `gorm:"-" json:"strain"`
+}
+
+// newStrainRevision creates a revision holding the snapshot of repr.  The repr is normalized first, so that the
+// snapshot has the same shape as the strain when it is read back.
+func newStrainRevision(repr StrainRepr, opts WriteOptions) (StrainRevision, error) {
+	s := repr.ToStrain()
+	snapshot := s.ToStrainRepr()
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return StrainRevision{}, errors.Wrapf(err, "unable to marshal snapshot of strain with ID %d", repr.ID)
+	}
+	return StrainRevision{
+		ReferenceID: repr.ID,
+		Author:      opts.Author,
+		Message:     opts.Message,
+		CreatedAt:   time.Now(),
+		Snapshot:    string(b),
+		Strain:      snapshot,
+	}, nil
+}
+
+// decode populates Strain from Snapshot.
+func (rev *StrainRevision) decode() error {
+	rev.Strain = StrainRepr{}
+	if err := json.Unmarshal([]byte(rev.Snapshot), &rev.Strain); err != nil {
+		return errors.Wrapf(err, "unable to unmarshal revision %d of strain with ID %d", rev.Revision, rev.ReferenceID)
+	}
+	return nil
+}
+
+// CreateInDB records the revision as the next revision of its strain, unless the snapshot is the same as the
+// latest revision in which case Revision is set to the latest revision.  It is meant to run in the transaction
+// which writes the strain, so that revisions are numbered in the order the writes happened.
+func (rev *StrainRevision) CreateInDB(tx *gorm.DB) error {
+	var last StrainRevision
+	err := tx.Where("reference_id = ?", rev.ReferenceID).Order("revision DESC").First(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return errors.Wrapf(err, "unable to get last revision of strain with ID %d", rev.ReferenceID)
+	}
+	if last.Revision > 0 && last.Snapshot == rev.Snapshot {
+		rev.Revision = last.Revision
+		return nil
+	}
+	rev.Revision = last.Revision + 1
+	if err := tx.Create(rev).Error; err != nil {
+		return errors.Wrapf(err, "unable to record revision %d of strain with ID %d", rev.Revision, rev.ReferenceID)
+	}
+	return nil
+}
+
+// ValueChange is a change of a single value between two revisions.
+type ValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// SetChange lists the values added and removed between two revisions.
+type SetChange struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// RevisionDiff describes the changes made to a strain between two revisions.  Unchanged attributes are omitted.
+type RevisionDiff struct {
+	ID      uint         `json:"id"`
+	From    uint         `json:"from"`
+	To      uint         `json:"to"`
+	Name    *ValueChange `json:"name,omitempty"`
+	Race    *ValueChange `json:"race,omitempty"`
+	Flavors SetChange    `json:"flavors"`
+	Effects struct {
+		Positive SetChange `json:"positive"`
+		Negative SetChange `json:"negative"`
+		Medical  SetChange `json:"medical"`
+	} `json:"effects"`
+}
+
+// DiffRevisions describes the changes made to a strain from one revision to another.
+func DiffRevisions(from, to StrainRevision) RevisionDiff {
+	d := RevisionDiff{ID: to.ReferenceID, From: from.Revision, To: to.Revision}
+	if from.Strain.Name != to.Strain.Name {
+		d.Name = &ValueChange{From: from.Strain.Name, To: to.Strain.Name}
+	}
+	if from.Strain.Race != to.Strain.Race {
+		d.Race = &ValueChange{From: from.Strain.Race, To: to.Strain.Race}
+	}
+	d.Flavors = diffSet(from.Strain.Flavors, to.Strain.Flavors)
+	d.Effects.Positive = diffSet(from.Strain.Effects.Positive, to.Strain.Effects.Positive)
+	d.Effects.Negative = diffSet(from.Strain.Effects.Negative, to.Strain.Effects.Negative)
+	d.Effects.Medical = diffSet(from.Strain.Effects.Medical, to.Strain.Effects.Medical)
+	return d
+}
+
+// diffSet returns the values in to but not in from as added, and the values in from but not in to as removed.
+func diffSet(from, to []string) SetChange {
+	var c SetChange
+	c.Added = missingFrom(from, to)
+	c.Removed = missingFrom(to, from)
+	return c
+}
+
+// missingFrom returns the values of src which are not in set, sorted.
+func missingFrom(set, src []string) []string {
+	in := make(map[string]bool, len(set))
+	for _, v := range set {
+		in[v] = true
+	}
+	var missing []string
+	for _, v := range src {
+		if !in[v] {
+			missing = append(missing, v)
+			in[v] = true
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
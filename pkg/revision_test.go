@@ -0,0 +1,35 @@
+package tms
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiffingRevisions(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	from, err := newStrainRevision(StrainRepr{ID: 1, Name: "Afpak", Race: "hybrid", Flavors: []string{"Earthy", "Pine"}}, WriteOptions{})
+	assert.Nil(err)
+	from.Revision = 1
+	toRepr := StrainRepr{ID: 1, Name: "Afpak", Race: "indica", Flavors: []string{"Pine", "Lime"}}
+	toRepr.Effects.Positive = []string{"Relaxed"}
+	to, err := newStrainRevision(toRepr, WriteOptions{})
+	assert.Nil(err)
+	to.Revision = 2
+
+	d := DiffRevisions(from, to)
+	assert.Equal(uint(1), d.ID)
+	assert.Equal(uint(1), d.From)
+	assert.Equal(uint(2), d.To)
+	assert.Nil(d.Name)
+	assert.Equal(&ValueChange{From: "hybrid", To: "indica"}, d.Race)
+	assert.Equal(SetChange{Added: []string{"Lime"}, Removed: []string{"Earthy"}}, d.Flavors)
+	assert.Equal(SetChange{Added: []string{"Relaxed"}}, d.Effects.Positive)
+	assert.Equal(SetChange{}, d.Effects.Negative)
+
+	// diffing the other way round swaps the changes
+	d = DiffRevisions(to, from)
+	assert.Equal(&ValueChange{From: "indica", To: "hybrid"}, d.Race)
+	assert.Equal(SetChange{Added: []string{"Earthy"}, Removed: []string{"Lime"}}, d.Flavors)
+}
@@ -0,0 +1,147 @@
+package tms
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidMatch          = errors.New("match must be one of any or all")
+	ErrInvalidEffectCategory = errors.New("effect category must be one of positive, negative or medical")
+)
+
+// Match is how the values of a search criterion are matched against a strain.
+type Match string
+
+const (
+	// MatchAll matches strains which have every value.
+	MatchAll Match = "all"
+	// MatchAny matches strains which have at least one of the values.
+	MatchAny Match = "any"
+)
+
+// StrainQuery searches for strains by any combination of criteria.  A strain must meet every criterion which is
+// set, and criteria which are left empty match every strain.
+type StrainQuery struct {
+	// Names matches strains with any of the names.
+	Names []string
+	// Races matches strains of any of the races, in any case.
+	Races []string
+	// Flavors matches strains with the flavors in any case, as set by FlavorMatch.
+	Flavors []string
+	// FlavorMatch is whether strains need all of Flavors or any of them.  It defaults to MatchAll.
+	FlavorMatch Match
+	// Effects matches strains with the effects in any case, as set by EffectMatch.
+	Effects []string
+	// EffectMatch is whether strains need all of Effects or any of them.  It defaults to MatchAll.
+	EffectMatch Match
+	// EffectCategories limits Effects to effects in any of the categories.  Effects in every category are matched
+	// when empty.
+	EffectCategories []string
+	// ExcludeEffects matches strains with none of the effects, in any category.
+	ExcludeEffects []string
+	// Filter matches strains which match the query language expression, if set.  See ParseQuery.
+	Filter Expr
+}
+
+// normalize checks the query is valid and returns it with defaults set, races and traits in canonical form and
+// repeated values removed.
+func (q StrainQuery) normalize() (StrainQuery, error) {
+	for _, m := range []*Match{&q.FlavorMatch, &q.EffectMatch} {
+		switch *m {
+		case "":
+			*m = MatchAll
+		case MatchAll, MatchAny:
+		default:
+			return q, ErrInvalidMatch
+		}
+	}
+	for _, c := range q.EffectCategories {
+		switch c {
+		case "positive", "negative", "medical":
+		default:
+			return q, ErrInvalidEffectCategory
+		}
+	}
+	races := q.Races
+	q.Races = nil
+	for _, r := range races {
+		q.Races = append(q.Races, CanonicalRace(r))
+	}
+	q.Names = unique(q.Names)
+	q.Races = unique(q.Races)
+	q.Flavors = canonicalTraits(q.Flavors)
+	q.Effects = canonicalTraits(q.Effects)
+	q.EffectCategories = unique(q.EffectCategories)
+	q.ExcludeEffects = canonicalTraits(q.ExcludeEffects)
+	return q, nil
+}
+
+// matches reports whether the strain meets every criterion of the normalized query.
+func (q StrainQuery) matches(s Strain) bool {
+	if len(q.Names) > 0 && !contains(q.Names, s.Name) {
+		return false
+	}
+	if len(q.Races) > 0 && !contains(q.Races, s.Race) {
+		return false
+	}
+
+	var flavors []string
+	for _, f := range s.Flavors {
+		flavors = append(flavors, f.Name)
+	}
+	if !matchValues(q.Flavors, flavors, q.FlavorMatch) {
+		return false
+	}
+
+	var effects []string
+	for _, e := range s.Effects {
+		if contains(q.ExcludeEffects, e.Name) {
+			return false
+		}
+		if len(q.EffectCategories) == 0 || contains(q.EffectCategories, e.Category) {
+			effects = append(effects, e.Name)
+		}
+	}
+	if !matchValues(q.Effects, effects, q.EffectMatch) {
+		return false
+	}
+	return q.Filter == nil || q.Filter.matches(s)
+}
+
+// matchValues reports whether a strain with the given values has the wanted values, as set by m.  Any values match
+// when none are wanted.
+func matchValues(want, have []string, m Match) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		found := contains(have, w)
+		if found && m == MatchAny {
+			return true
+		}
+		if !found && m == MatchAll {
+			return false
+		}
+	}
+	return m == MatchAll
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// unique returns the values with repeats removed, keeping the first of each.
+func unique(values []string) []string {
+	var u []string
+	for _, v := range values {
+		if !contains(u, v) {
+			u = append(u, v)
+		}
+	}
+	return u
+}
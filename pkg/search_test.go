@@ -0,0 +1,134 @@
+package tms
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// searchableStrains are strains with overlapping races, flavors and effects.  Strain 4 has the same effect in two
+// categories.
+func searchableStrains() []StrainRepr {
+	reprs := []StrainRepr{
+		{ID: 1, Name: "a", Race: "indica", Flavors: []string{"Earthy", "Pine"}},
+		{ID: 2, Name: "b", Race: "indica", Flavors: []string{"Earthy"}},
+		{ID: 3, Name: "c", Race: "sativa", Flavors: []string{"Pine", "Citrus"}},
+		{ID: 4, Name: "d", Race: "hybrid", Flavors: []string{"Earthy", "Pine", "Citrus"}},
+	}
+	reprs[0].Effects.Positive = []string{"Relaxed"}
+	reprs[0].Effects.Medical = []string{"Insomnia"}
+	reprs[0].Effects.Negative = []string{"Dry Mouth"}
+	reprs[1].Effects.Medical = []string{"Insomnia"}
+	reprs[1].Effects.Negative = []string{"Paranoid"}
+	reprs[2].Effects.Positive = []string{"Happy"}
+	reprs[2].Effects.Negative = []string{"Paranoid"}
+	reprs[3].Effects.Positive = []string{"Insomnia"}
+	reprs[3].Effects.Medical = []string{"Insomnia"}
+	reprs[3].Effects.Negative = []string{"Dry Mouth"}
+	return reprs
+}
+
+// strainQueryTests are searches of searchableStrains and the reference IDs they find.
+var strainQueryTests = []struct {
+	name   string
+	query  StrainQuery
+	expIDs []uint
+	expErr error
+}{
+	{"everything", StrainQuery{}, []uint{1, 2, 3, 4}, nil},
+	{"race", StrainQuery{Races: []string{"indica"}}, []uint{1, 2}, nil},
+	{"races", StrainQuery{Races: []string{"indica", "hybrid"}}, []uint{1, 2, 4}, nil},
+	{"names", StrainQuery{Names: []string{"b", "c", "b"}}, []uint{2, 3}, nil},
+	{"all_flavors", StrainQuery{Flavors: []string{"Earthy", "Pine"}}, []uint{1, 4}, nil},
+	{"any_flavor", StrainQuery{Flavors: []string{"Earthy", "Citrus"}, FlavorMatch: MatchAny}, []uint{1, 2, 3, 4}, nil},
+	{"repeated_flavor", StrainQuery{Flavors: []string{"Citrus", "Citrus"}}, []uint{3, 4}, nil},
+	{"all_effects", StrainQuery{Effects: []string{"Insomnia", "Dry Mouth"}}, []uint{1, 4}, nil},
+	{"any_effect", StrainQuery{Effects: []string{"Relaxed", "Happy"}, EffectMatch: MatchAny}, []uint{1, 3}, nil},
+	{"effect_in_category", StrainQuery{Effects: []string{"Insomnia"}, EffectCategories: []string{"positive"}}, []uint{4}, nil},
+	{"exclude_effect", StrainQuery{ExcludeEffects: []string{"Dry Mouth"}}, []uint{2, 3}, nil},
+	{"combined", StrainQuery{
+		Races:          []string{"indica"},
+		Flavors:        []string{"Earthy", "Pine"},
+		Effects:        []string{"Insomnia"},
+		ExcludeEffects: []string{"Paranoid"},
+	}, []uint{1}, nil},
+	{"filter", StrainQuery{Filter: mustParseQuery(
+		"race:indica AND flavor:(earthy OR citrus) AND -effect:paranoid AND effect.medical:insomnia")}, []uint{1}, nil},
+	{"filter_or", StrainQuery{Filter: mustParseQuery(`name:c OR effect.negative:"dry mouth"`)}, []uint{1, 3, 4}, nil},
+	{"filter_not_group", StrainQuery{Filter: mustParseQuery("NOT (race:indica OR race:hybrid)")}, []uint{3}, nil},
+	{"filter_and_criteria", StrainQuery{Races: []string{"indica"}, Filter: mustParseQuery("-flavor:pine")}, []uint{2}, nil},
+	{"no_match", StrainQuery{Races: []string{"sativa"}, Flavors: []string{"Earthy"}}, nil, nil},
+	{"invalid_match", StrainQuery{Flavors: []string{"Pine"}, FlavorMatch: "some"}, nil, ErrInvalidMatch},
+	{"invalid_category", StrainQuery{EffectCategories: []string{"psychedelic"}}, nil, ErrInvalidEffectCategory},
+}
+
+// testSearchingStrains runs strainQueryTests against a store holding searchableStrains.
+func testSearchingStrains(t *testing.T, store StrainStore) {
+	assert := assert.New(t)
+	for _, repr := range searchableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+
+	for _, tt := range strainQueryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := store.SearchStrains(tt.query, ListOptions{})
+			assert.Equal(tt.expErr, err)
+			var ids []uint
+			for _, s := range page.Strains {
+				ids = append(ids, s.ReferenceID)
+			}
+			assert.Equal(tt.expIDs, ids)
+			assert.Equal(len(tt.expIDs), page.Total)
+		})
+	}
+}
+
+func TestMemoryStoreSearchingStrainsByQuery(t *testing.T) {
+	t.Parallel()
+	testSearchingStrains(t, NewMemoryStore())
+}
+
+// racelessStrains are strains of which only the first has a race.
+func racelessStrains() []StrainRepr {
+	return []StrainRepr{
+		{ID: 1, Name: "a", Race: "indica"},
+		{ID: 2, Name: "b"},
+	}
+}
+
+// testSearchingRacelessStrains checks that a store holding racelessStrains finds the strain without a race when
+// terms on the race are negated.
+func testSearchingRacelessStrains(t *testing.T, store StrainStore) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		filter string
+		expIDs []uint
+	}{
+		{"race:indica", []uint{1}},
+		{"-race:indica", []uint{2}},
+		{"-race:sativa", []uint{1, 2}},
+		{"NOT (race:indica OR race:sativa)", []uint{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			page, err := store.SearchStrains(StrainQuery{Filter: mustParseQuery(tt.filter)}, ListOptions{})
+			assert.Nil(err)
+			var ids []uint
+			for _, s := range page.Strains {
+				ids = append(ids, s.ReferenceID)
+			}
+			assert.Equal(tt.expIDs, ids)
+		})
+	}
+}
+
+func TestMemoryStoreSearchingRacelessStrains(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+	for _, repr := range racelessStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	testSearchingRacelessStrains(t, store)
+}
@@ -1,36 +1,118 @@
 package tms
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var ErrStrainIdMustBeInteger = errors.New("strain ID must be an integer")
+var (
+	ErrStrainIdMustBeInteger = errors.New("strain ID must be an integer")
+	ErrRevisionMustBeInteger = errors.New("revision must be a positive integer")
+	ErrInvalidLimit          = fmt.Errorf("limit must be an integer from 1 to %d", MaxPageSize)
+	ErrInvalidOffset         = errors.New("offset must be a non-negative integer")
+	ErrSuggestQueryMissing   = errors.New("q must be set to the text typed so far")
+)
+
+const (
+	// AuthorHeader is the request header which names the author of a change, recorded in the strain's history.
+	AuthorHeader = "X-Author"
+	// TotalCountHeader is the response header giving the number of strains in a list, across all pages.
+	TotalCountHeader = "X-Total-Count"
+	// DefaultPageSize is how many strains of a list are returned when the request does not set a limit.
+	DefaultPageSize = 100
+	// MaxPageSize is the most strains of a list returned at once.
+	MaxPageSize = 1000
+	// DefaultSuggestions is how many suggestions are made when the request does not set a limit.
+	DefaultSuggestions = 10
+	// acceptPatch is the value of the Accept-Patch header, listing the content types of the patches accepted.
+	acceptPatch = MergePatchContentType + ", " + JSONPatchContentType
+)
 
 type Server struct {
 	// Port is the port where the server will listen.
 	Port int32
-	// DB is the database instance
-	DB *gorm.DB
+	// Store is where strains are read from and written to.
+	Store StrainStore
+	// ReadOnly rejects every request which would write to the store.
+	ReadOnly bool
+	// RequireIfMatch rejects writes to existing strains which are not conditional on an If-Match header, so that
+	// clients cannot overwrite changes they have not seen.
+	RequireIfMatch bool
+	// CacheControl is the Cache-Control header sent with strains read from the store.  No header is sent if empty.
+	CacheControl string
+	// Suggestions makes suggestions as users type.  Suggestions are not made if nil.
+	Suggestions *SuggestIndex
+	// FullText searches strains for free text.  Free text search is not enabled if nil.
+	FullText *TextIndex
+	// TrustedProxies are the networks of the proxies in front of the server.  The X-Forwarded-Proto and
+	// X-Forwarded-Host headers are only believed when links to the server are made for requests from these proxies.
+	TrustedProxies []*net.IPNet
 }
 
-// ListenAndServer starts the API server.
-func (s *Server) ListenAndServe() error {
+// route is a page of the API, the methods it supports and its handler.
+type route struct {
+	path    string
+	methods []string
+	handler http.HandlerFunc
+}
+
+// routes are the pages of the API.
+func (s *Server) routes() []route {
+	return []route{
+		{"/api/strains", []string{http.MethodGet}, s.SearchStrainsHandler},
+		{"/api/strains/", []string{http.MethodPost}, s.CreateStrainHandler},
+		{"/api/strains/bulk", []string{http.MethodPost, http.MethodPut, http.MethodDelete}, s.BulkStrainsHandler},
+		{"/api/strains/id/{id}", []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete}, s.StrainByIDHandler},
+		{"/api/strains/id/{id}/restore", []string{http.MethodPost}, s.RestoreStrainHandler},
+		{"/api/strains/id/{id}/history", []string{http.MethodGet}, s.StrainHistoryHandler},
+		{"/api/strains/id/{id}/history/{rev}", []string{http.MethodGet}, s.StrainRevisionHandler},
+		{"/api/strains/id/{id}/diff/{from}/{to}", []string{http.MethodGet}, s.StrainDiffHandler},
+		{"/api/strains/id/{id}/revert/{rev}", []string{http.MethodPost}, s.RevertStrainHandler},
+		{"/api/strains/deleted", []string{http.MethodGet}, s.DeletedStrainsHandler},
+		{"/api/strains/name/{name}", []string{http.MethodGet}, s.StrainByNameHandler},
+		{"/api/strains/race/{race}", []string{http.MethodGet}, s.StrainByRaceHandler},
+		{"/api/strains/effect/{effect}", []string{http.MethodGet}, s.StrainByEffectHandler},
+		{"/api/strains/flavor/{flavor}", []string{http.MethodGet}, s.StrainByFlavorHandler},
+		{"/api/suggest", []string{http.MethodGet}, s.SuggestHandler},
+		{"/api/search", []string{http.MethodGet}, s.FullTextSearchHandler},
+	}
+}
+
+// Handler routes API requests to their handlers.  Pages which can be read also answer HEAD requests, every page
+// answers OPTIONS requests with the methods it allows, and requests with other methods are rejected with 405 Method
+// Not Allowed.
+func (s *Server) Handler() http.Handler {
 	r := mux.NewRouter()
-	r.HandleFunc("/api/strains/", s.CreateStrainHandler).Methods("POST")
-	r.HandleFunc("/api/strains/id/{id}", s.StrainByIDHandler).Methods("GET", "PUT", "DELETE")
-	r.HandleFunc("/api/strains/name/{name}", s.StrainByNameHandler).Methods("GET")
-	r.HandleFunc("/api/strains/race/{race}", s.StrainByRaceHandler).Methods("GET")
-	r.HandleFunc("/api/strains/effect/{effect}", s.StrainByEffectHandler).Methods("GET")
-	r.HandleFunc("/api/strains/flavor/{flavor}", s.StrainByFlavorHandler).Methods("GET")
+	for _, rt := range s.routes() {
+		methods := append([]string{}, rt.methods...)
+		if contains(methods, http.MethodGet) {
+			methods = append(methods, http.MethodHead)
+		}
+		r.HandleFunc(rt.path, serveHeadAsGet(rt.handler)).Methods(methods...)
+		r.HandleFunc(rt.path, allowMethods(append(methods, http.MethodOptions)))
+	}
+	r.NotFoundHandler = http.HandlerFunc(pageNotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	r.Use(RequestIDMw)
 	r.Use(LogInboundRequestMw)
+	r.Use(s.ReadOnlyMw)
+	return r
+}
 
+// ListenAndServer starts the API server.
+func (s *Server) ListenAndServe() error {
+	r := s.Handler()
 	http.Handle("/", r)
 	httpSrv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", s.Port),
@@ -45,58 +127,290 @@ func (s *Server) ListenAndServe() error {
 // StrainByIDHandler handles API requests for strains by the strain ID.
 func (s *Server) StrainByIDHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	strain := s.newStrain()
 
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		log.Debugf("request for strain with non-integer ID %s", vars["id"])
-		_, _ = fmt.Fprintf(w, "%s\n", ErrStrainIdMustBeInteger)
+		writeBadRequest(w, ErrStrainIdMustBeInteger)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		err := strain.FromDBByRefID(uint(id))
+		strain, err := s.Store.StrainByRefID(uint(id))
 		if err == ErrNotExists {
-			w.WriteHeader(http.StatusNotFound)
 			log.WithError(err).Debugf("request for strain with ID %d, strain not found", id)
-			_, _ = fmt.Fprintf(w, "404 strain not found\n")
+			writeError(w, http.StatusNotFound, CodeStrainNotFound, "strain not found")
 			return
 		} else if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("could not get strain with ID %d", id)
-			_, _ = fmt.Fprintf(w, "%s\n", err)
+			writeInternalError(w, err, "could not get strain with ID %d", id)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		repr := strain.ToStrainRepr()
-		repr.Write(w)
-		_, _ = fmt.Fprintf(w, "\n")
+		if s.notModified(w, r, etag(strain), strain.UpdatedAt) {
+			return
+		}
+		writeJSON(w, http.StatusOK, strain.ToStrainRepr())
 
 	case http.MethodPut:
-		// TODO: handle list of strains.. current method only handle one strain
-		repr, err := ParseStrain(r.Body)
+		if !s.requirePrecondition(w, r) {
+			return
+		}
+		repr, ok := parseStrain(w, r, uint(id))
+		if !ok {
+			return
+		}
+		var created bool
+		var err error
+
+		// If-None-Match: * only writes the strain if it does not exist yet
+		if r.Header.Get("If-None-Match") == "*" {
+			created = true
+			err = s.Store.CreateStrain(repr, writeOptions(r))
+			if err == ErrRecordAlreadyExists {
+				err = ErrPreconditionFailed
+			}
+		} else {
+			created, err = s.Store.ReplaceStrain(repr, writeOptions(r))
+		}
+		if err == ErrPreconditionFailed {
+			log.WithError(err).Debugf("request to update strain with ID %d, precondition failed", repr.ID)
+			writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed,
+				"strain with ID %d has changed, get it again and retry", repr.ID)
+			return
+		} else if err != nil {
+			writeInternalError(w, err, "could not update strain with ID %d", repr.ID)
+			return
+		}
+		if created {
+			w.Header().Set("Location", s.strainURL(r, repr.ID))
+			s.writeStoredStrain(w, repr.ID, http.StatusCreated)
+			return
+		}
+		s.writeStoredStrain(w, repr.ID, http.StatusOK)
+
+	case http.MethodPatch:
+		if !s.requirePrecondition(w, r) {
+			return
+		}
+		patch, ok := parsePatch(w, r)
+		if !ok {
+			return
+		}
+		err := s.Store.PatchStrain(uint(id), patch, writeOptions(r))
+		if verr, ok := err.(*ValidationError); ok {
+			log.WithError(err).Debugf("request to patch strain with ID %d, patched strain is invalid", id)
+			writeInvalidStrain(w, verr)
+			return
+		} else if perr, ok := err.(*PatchError); ok {
+			log.WithError(err).Debugf("request to patch strain with ID %d, patch cannot be applied", id)
+			writeError(w, http.StatusConflict, CodePatchConflict, "%s", perr)
+			return
+		} else if err == ErrNotExists {
+			log.WithError(err).Debugf("request to patch strain with ID %d, strain not found", id)
+			writeError(w, http.StatusNotFound, CodeStrainNotFound, "strain not found")
+			return
+		} else if err == ErrPreconditionFailed {
+			log.WithError(err).Debugf("request to patch strain with ID %d, precondition failed", id)
+			writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed,
+				"strain with ID %d has changed, get it again and retry", id)
+			return
+		} else if err != nil {
+			writeInternalError(w, err, "could not patch strain with ID %d", id)
+			return
+		}
+		s.writeStoredStrain(w, uint(id), http.StatusOK)
+
+	case http.MethodDelete:
+		if !s.requirePrecondition(w, r) {
+			return
+		}
+		err := s.Store.DeleteStrain(uint(id), writeOptions(r))
+		if err == ErrNotExists {
+			log.WithError(err).Debugf("request to delete strain with ID %d, strain not found", id)
+			writeError(w, http.StatusNotFound, CodeStrainNotFound, "strain not found")
+			return
+		} else if err == ErrPreconditionFailed {
+			log.WithError(err).Debugf("request to delete strain with ID %d, precondition failed", id)
+			writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed,
+				"strain with ID %d has changed, get it again and retry", id)
+			return
+		} else if err != nil {
+			writeInternalError(w, err, "could not delete strain with ID %d", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		pageNotFound(w, r)
+	}
+}
+
+// RestoreStrainHandler handles API requests to bring back a deleted strain by the strain ID.
+func (s *Server) RestoreStrainHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		log.Debugf("request to restore strain with non-integer ID %s", vars["id"])
+		writeBadRequest(w, ErrStrainIdMustBeInteger)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		err := s.Store.RestoreStrain(uint(id))
+		if err == ErrNotExists {
+			log.WithError(err).Debugf("request to restore strain with ID %d, deleted strain not found", id)
+			writeError(w, http.StatusNotFound, CodeStrainNotFound, "deleted strain not found")
+			return
+		} else if err != nil {
+			writeInternalError(w, err, "could not restore strain with ID %d", id)
+			return
+		}
+
+		strain, err := s.Store.StrainByRefID(uint(id))
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = fmt.Fprintf(w, "invalid strain json")
+			writeInternalError(w, err, "could not get restored strain with ID %d", id)
 			return
 		}
+		writeJSON(w, http.StatusOK, strain.ToStrainRepr())
 
-		repr.DB = s.DB
-		err = repr.ReplaceInDB()
+	default:
+		pageNotFound(w, r)
+	}
+}
+
+// StrainHistoryHandler handles API requests for every revision of a strain by the strain ID.
+func (s *Server) StrainHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := uintVar(w, r, "id", ErrStrainIdMustBeInteger)
+	if !ok {
+		return
+	}
+
+	history, err := s.Store.StrainHistory(id)
+	if err == ErrNotExists {
+		log.WithError(err).Debugf("request for history of strain with ID %d, no history found", id)
+		writeError(w, http.StatusNotFound, CodeStrainNotFound, "strain history not found")
+		return
+	} else if err != nil {
+		writeInternalError(w, err, "could not get history of strain with ID %d", id)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+// StrainRevisionHandler handles API requests for a single revision of a strain by the strain ID.
+func (s *Server) StrainRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := uintVar(w, r, "id", ErrStrainIdMustBeInteger)
+	if !ok {
+		return
+	}
+	rev, ok := uintVar(w, r, "rev", ErrRevisionMustBeInteger)
+	if !ok {
+		return
+	}
+
+	revision, ok := s.revision(w, id, rev)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, revision)
+}
+
+// StrainDiffHandler handles API requests for the changes made to a strain between two revisions.
+func (s *Server) StrainDiffHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := uintVar(w, r, "id", ErrStrainIdMustBeInteger)
+	if !ok {
+		return
+	}
+	from, ok := uintVar(w, r, "from", ErrRevisionMustBeInteger)
+	if !ok {
+		return
+	}
+	to, ok := uintVar(w, r, "to", ErrRevisionMustBeInteger)
+	if !ok {
+		return
+	}
+
+	fromRev, ok := s.revision(w, id, from)
+	if !ok {
+		return
+	}
+	toRev, ok := s.revision(w, id, to)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, DiffRevisions(fromRev, toRev))
+}
+
+// RevertStrainHandler handles API requests to write an old revision of a strain again.  The revert is a write like
+// any other, so it is recorded as a new revision.
+func (s *Server) RevertStrainHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := uintVar(w, r, "id", ErrStrainIdMustBeInteger)
+	if !ok {
+		return
+	}
+	rev, ok := uintVar(w, r, "rev", ErrRevisionMustBeInteger)
+	if !ok {
+		return
+	}
+
+	if !s.requirePrecondition(w, r) {
+		return
+	}
+	revision, ok := s.revision(w, id, rev)
+	if !ok {
+		return
+	}
+	opts := writeOptions(r)
+	opts.Message = fmt.Sprintf("revert to revision %d", rev)
+	_, err := s.Store.ReplaceStrain(revision.Strain, opts)
+	if err == ErrPreconditionFailed {
+		log.WithError(err).Debugf("request to revert strain with ID %d, precondition failed", id)
+		writeError(w, http.StatusPreconditionFailed, CodePreconditionFailed,
+			"strain with ID %d has changed, get it again and retry", id)
+		return
+	} else if err != nil {
+		writeInternalError(w, err, "could not revert strain with ID %d to revision %d", id, rev)
+		return
+	}
+	s.writeStoredStrain(w, id, http.StatusOK)
+}
+
+// revision gets a single revision of a strain from the store, writing the error response if it cannot.
+func (s *Server) revision(w http.ResponseWriter, id, rev uint) (StrainRevision, bool) {
+	revision, err := s.Store.StrainRevision(id, rev)
+	if err == ErrNotExists {
+		log.WithError(err).Debugf("request for revision %d of strain with ID %d, revision not found", rev, id)
+		writeError(w, http.StatusNotFound, CodeRevisionNotFound, "revision not found")
+		return revision, false
+	} else if err != nil {
+		writeInternalError(w, err, "could not get revision %d of strain with ID %d", rev, id)
+		return revision, false
+	}
+	return revision, true
+}
+
+// DeletedStrainsHandler handles API requests for strains which have been deleted and can still be restored.
+func (s *Server) DeletedStrainsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		found, err := s.Store.DeletedStrains()
+		if err != nil {
+			writeInternalError(w, err, "could not get deleted strains")
+			return
+		}
+		strains := Strains{strains: found}
+		strainReprs := strains.ToStrainRepr()
+		b, err := strainReprs.ToJson()
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = fmt.Fprintf(w, "unable to update strain with ID %d", repr.ID)
+			writeInternalError(w, err, "failed to marshal deleted strains")
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		// TODO: write https instead if they are using TLS
-		_, _ = fmt.Fprintf(w, `{"link"":"http://%s/api/strains/id/%d"}`, r.Host, repr.ID)
-
+		_, _ = w.Write(b)
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = fmt.Fprintf(w, "page not found\n")
+		pageNotFound(w, r)
 	}
 }
 
@@ -104,146 +418,884 @@ func (s *Server) StrainByIDHandler(w http.ResponseWriter, r *http.Request) {
 func (s *Server) CreateStrainHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
-		repr, err := ParseStrain(r.Body)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = fmt.Fprintf(w, "invalid strain json")
+		repr, ok := parseStrain(w, r, 0)
+		if !ok {
 			return
 		}
 
-		repr.DB = s.DB
-		err = repr.CreateInDB()
+		err := s.Store.CreateStrain(repr, writeOptions(r))
 		if err == ErrRecordAlreadyExists {
-			w.WriteHeader(http.StatusConflict)
-			_, _ = fmt.Fprintf(w, "strain with ID %d already exists\n", repr.ID)
+			writeError(w, http.StatusConflict, CodeStrainExists, "strain with ID %d already exists", repr.ID)
 			return
 		} else if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = fmt.Fprintf(w, "%s\n", err)
+			writeInternalError(w, err, "could not create strain with ID %d", repr.ID)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		// TODO: write https instead if they are using TLS
-		_, _ = fmt.Fprintf(w, `{"link"":"http://%s/api/strains/id/%d"}`, r.Host, repr.ID)
+		w.Header().Set("Location", s.strainURL(r, repr.ID))
+		s.writeStoredStrain(w, repr.ID, http.StatusCreated)
+
+	default:
+		pageNotFound(w, r)
+	}
+}
+
+// BulkReport is the response to a bulk write, with the outcome of each of its writes in the order they were given.
+type BulkReport struct {
+	Mode BulkMode `json:"mode"`
+	// Written is the number of strains written.
+	Written int `json:"written"`
+	// Failed is the number of strains which were not written.
+	Failed  int          `json:"failed"`
+	Results []BulkResult `json:"results"`
+}
+
+// BulkResult is the outcome of a single write of a bulk write.
+type BulkResult struct {
+	// Index is the position of the strain in the request, starting from 0.
+	Index int `json:"index"`
+	// ID is the reference ID of the strain, if it has one.
+	ID uint `json:"id,omitempty"`
+	// Status is the status the write would have been answered with had it been requested on its own.
+	Status int `json:"status"`
+	// Location is the URL of a strain which was created or replaced.
+	Location string `json:"location,omitempty"`
+	// Code, Detail and Errors explain why a write failed, as they do in a Problem.
+	Code   string       `json:"code,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// BulkStrainsHandler handles API requests writing many strains at once.  POST creates strains and PUT creates or
+// replaces them, given as a JSON list or as NDJSON with a strain on each line, and DELETE deletes the strains with
+// the IDs given in the same way.  The mode query parameter chooses whether every strain is written or none are, or
+// whether every strain which can be written is, and the outcome of each write is reported in order.
+func (s *Server) BulkStrainsHandler(w http.ResponseWriter, r *http.Request) {
+	var action BulkAction
+	switch r.Method {
+	case http.MethodPost:
+		action = BulkCreate
+	case http.MethodPut:
+		action = BulkReplace
+	case http.MethodDelete:
+		action = BulkDelete
+	default:
+		pageNotFound(w, r)
+		return
+	}
+
+	mode, err := ParseBulkMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		log.WithError(err).Debugf("request for bulk write with invalid mode %s", r.URL.Query().Get("mode"))
+		writeBadRequest(w, err)
+		return
+	}
+	// there is no If-Match header for each strain, so only new strains can be written when writes must be conditional
+	if s.RequireIfMatch && action != BulkCreate {
+		log.Debugf("rejected unconditional bulk %s request", r.Method)
+		writeError(w, http.StatusPreconditionRequired, CodePreconditionRequired,
+			"bulk writes cannot be conditional, write existing strains one at a time with an If-Match header")
+		return
+	}
+	writes, results, ok := parseBulkWrites(w, r, action)
+	if !ok {
+		return
+	}
+
+	// invalid strains already have their result, so only the others are written
+	var valid []BulkWrite
+	var indexes []int
+	for i, res := range results {
+		if res.Status == 0 {
+			valid = append(valid, writes[i])
+			indexes = append(indexes, i)
+		}
+	}
+	outcomes := make([]BulkOutcome, len(valid))
+	switch {
+	case mode == BulkAtomic && len(valid) < len(writes):
+		// some strains are not valid, so none are written
+		for i := range outcomes {
+			outcomes[i].Err = ErrBulkAborted
+		}
+	case len(valid) > 0:
+		opts := WriteOptions{Author: r.Header.Get(AuthorHeader)}
+		if outcomes, err = s.Store.WriteStrains(valid, mode, opts); err != nil {
+			writeInternalError(w, err, "could not write %d strains in bulk", len(valid))
+			return
+		}
+	}
+	for i, o := range outcomes {
+		results[indexes[i]] = s.bulkResult(w, r, indexes[i], valid[i], o)
+	}
 
+	report := BulkReport{Mode: mode, Results: results}
+	status := http.StatusUnprocessableEntity
+	for _, res := range results {
+		if res.Status < http.StatusBadRequest {
+			report.Written++
+			continue
+		}
+		report.Failed++
+		if res.Status >= http.StatusInternalServerError {
+			status = http.StatusInternalServerError
+		}
+	}
+	switch {
+	case report.Failed == 0:
+		writeJSON(w, http.StatusOK, report)
+	case mode == BulkBestEffort:
+		writeJSON(w, http.StatusMultiStatus, report)
+	case status == http.StatusInternalServerError:
+		writeProblem(w, Problem{Status: status, Code: CodeInternalError,
+			Detail: "the server was unable to complete the request, so no strains were written", Results: results})
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = fmt.Fprintf(w, "page not found\n")
+		writeProblem(w, Problem{Status: status, Code: CodeBulkFailed,
+			Detail: "some strains could not be written, so none were, see results for the outcome of each", Results: results})
 	}
 }
 
-// StrainByNameHandler handles API requests for strains by the strain name.
+// parseBulkWrites parses the strains, or the IDs of the strains to delete, in the body of a bulk write request,
+// writing an error response if the body is not a list of them.  The result of writing each strain which is not valid
+// is filled in, while those of the other writes are left empty.  The body is only read up to MaxBulkBodySize, and up
+// to the strain after the last of MaxBulkWrites.
+func parseBulkWrites(w http.ResponseWriter, r *http.Request, action BulkAction) ([]BulkWrite, []BulkResult, bool) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := contentType == NDJSONContentType
+	body := http.MaxBytesReader(w, r.Body, MaxBulkBodySize)
+
+	var writes []BulkWrite
+	var errs []error
+	var err error
+	if action == BulkDelete {
+		var ids []uint
+		ids, err = ParseStrainIDs(body, ndjson)
+		for _, id := range ids {
+			writes = append(writes, BulkWrite{Action: action, Strain: StrainRepr{ID: id}})
+		}
+	} else {
+		var reprs StrainReprs
+		var parseErrs []error
+		reprs, parseErrs, err = ParseBulkStrains(body, ndjson)
+		for i, repr := range reprs {
+			writes = append(writes, BulkWrite{Action: action, Strain: repr})
+			verr := &ValidationError{}
+			_ = verr.Merge(parseErrs[i])
+			_ = verr.Merge(repr.Validate())
+			errs = append(errs, verr.Err())
+		}
+	}
+	if _, tooLarge := errors.Cause(err).(*http.MaxBytesError); tooLarge {
+		log.WithError(err).Debug("request to write strains in bulk with too large a body")
+		writeError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "%s", ErrBulkBodyTooLarge)
+		return nil, nil, false
+	} else if err == ErrTooManyBulkWrites {
+		log.WithError(err).Debug("request to write too many strains in bulk")
+		writeError(w, http.StatusRequestEntityTooLarge, CodeTooManyWrites, "%s", err)
+		return nil, nil, false
+	} else if err != nil {
+		log.WithError(err).Debugf("request to %s strains in bulk with invalid JSON", action)
+		writeError(w, http.StatusBadRequest, CodeInvalidJSON, "%s", err)
+		return nil, nil, false
+	}
+
+	results := make([]BulkResult, len(writes))
+	for i, err := range errs {
+		if verr, ok := err.(*ValidationError); ok {
+			results[i] = BulkResult{Index: i, ID: writes[i].Strain.ID, Status: http.StatusUnprocessableEntity,
+				Code: CodeInvalidStrain, Detail: "the strain is not valid, see errors for the problem with each field",
+				Errors: verr.Fields}
+		}
+	}
+	return writes, results, true
+}
+
+// bulkResult is the result reported for a write of a bulk write with the given outcome.  Internal errors are logged
+// with the ID of the request rather than reported, as they are for a write of a single strain.
+func (s *Server) bulkResult(w http.ResponseWriter, r *http.Request, index int, write BulkWrite, outcome BulkOutcome) BulkResult {
+	res := BulkResult{Index: index, ID: write.Strain.ID}
+	switch err := outcome.Err; {
+	case err == nil && write.Action == BulkDelete:
+		res.Status = http.StatusNoContent
+	case err == nil:
+		res.Status = http.StatusOK
+		if outcome.Created {
+			res.Status = http.StatusCreated
+		}
+		res.Location = s.strainURL(r, write.Strain.ID)
+	case err == ErrBulkAborted:
+		res.Status, res.Code, res.Detail = http.StatusFailedDependency, CodeBulkAborted, err.Error()
+	case err == ErrRecordAlreadyExists:
+		res.Status, res.Code = http.StatusConflict, CodeStrainExists
+		res.Detail = fmt.Sprintf("strain with ID %d already exists", write.Strain.ID)
+	case err == ErrNotExists:
+		res.Status, res.Code, res.Detail = http.StatusNotFound, CodeStrainNotFound, "strain not found"
+	default:
+		log.WithError(err).WithField("request_id", responseRequestID(w)).
+			Errorf("could not %s strain with ID %d in bulk", write.Action, write.Strain.ID)
+		res.Status, res.Code = http.StatusInternalServerError, CodeInternalError
+		res.Detail = "the server was unable to complete the request"
+	}
+	return res
+}
+
+// StrainByNameHandler handles API requests for strains by the strain name.  With a match query parameter the name
+// is searched for rather than looked up, and every strain which matches is returned best match first.
 func (s *Server) StrainByNameHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	strain := s.newStrain()
 
 	switch r.Method {
 	case http.MethodGet:
-		err := strain.FromDBByName(vars["name"])
+		if mode := r.URL.Query().Get("match"); mode != "" {
+			s.searchNames(w, r, vars["name"], NameMode(mode))
+			return
+		}
+		strain, err := s.Store.StrainByName(vars["name"])
 		if err == ErrNotExists {
-			w.WriteHeader(http.StatusNotFound)
 			log.WithError(err).Debugf("request for strain with name %s, strain not found", vars["name"])
-			_, _ = fmt.Fprintf(w, "404 strain not found\n")
+			writeError(w, http.StatusNotFound, CodeStrainNotFound, "strain not found")
 			return
 		} else if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("could not get strain with name %s", vars["name"])
-			_, _ = fmt.Fprintf(w, "%s\n", err)
+			writeInternalError(w, err, "could not get strain with name %s", vars["name"])
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		repr := strain.ToStrainRepr()
-		repr.Write(w)
-		_, _ = fmt.Fprintf(w, "\n")
+		if s.notModified(w, r, etag(strain), strain.UpdatedAt) {
+			return
+		}
+		writeJSON(w, http.StatusOK, strain.ToStrainRepr())
 
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = fmt.Fprintf(w, "page not found\n")
+		pageNotFound(w, r)
+	}
+}
+
+// nameResultRepr is how a strain found by a name search is written in responses.
+type nameResultRepr struct {
+	Match    NameMatch  `json:"match"`
+	Distance int        `json:"distance"`
+	Strain   StrainRepr `json:"strain"`
+}
+
+// searchNames writes the strains whose names match name as set by mode, best match first.  Only the limit of the
+// list options applies, as the results are ranked rather than paged.
+func (s *Server) searchNames(w http.ResponseWriter, r *http.Request, name string, mode NameMode) {
+	opts, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+	if q := r.URL.Query(); q.Get("offset") != "" || q.Get("sort") != "" || q.Get("cursor") != "" {
+		log.Debugf("request for strains matching name %s with paging options %s", name, r.URL.RawQuery)
+		writeBadRequest(w, ErrNameMatchNotPaged)
+		return
+	}
+	results, err := s.Store.StrainsByNameMatch(name, mode, opts.Limit)
+	if err == ErrInvalidNameMode {
+		log.WithError(err).Debugf("request for strains matching name %s with unknown match %s", name, mode)
+		writeBadRequest(w, err)
+		return
+	} else if err != nil {
+		writeInternalError(w, err, "could not get strains matching name %s", name)
+		return
+	}
+	reprs := make([]nameResultRepr, 0, len(results))
+	for _, res := range results {
+		reprs = append(reprs, nameResultRepr{Match: res.Match, Distance: res.Distance, Strain: res.Strain.ToStrainRepr()})
 	}
+	writeJSON(w, http.StatusOK, reprs)
 }
 
 // StrainByRaceHandler handles API requests for strains by race.
 func (s *Server) StrainByRaceHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	strains := s.newStrains()
 
 	switch r.Method {
 	case http.MethodGet:
-		if err := strains.FromDBByRace(vars["race"]); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("could not get strains by race for race %s", vars["race"])
+		opts, ok := listOptions(w, r)
+		if !ok {
+			return
 		}
-		w.WriteHeader(http.StatusOK)
-		strainReprs := strains.ToStrainRepr()
-		b, err := strainReprs.ToJson()
+		page, err := s.Store.StrainsByRace(vars["race"], opts)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("failed to unmarshal getting strain by race")
+			writeInternalError(w, err, "could not get strains by race for race %s", vars["race"])
+			return
 		}
-		_, _ = fmt.Fprintf(w, string(b))
+		s.writeStrains(w, r, page)
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = fmt.Fprintf(w, "page not found\n")
+		pageNotFound(w, r)
 	}
 }
 
 // StrainByFlavorHandler handles API requests for strains by flavor.
 func (s *Server) StrainByFlavorHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	strains := s.newStrains()
 
 	switch r.Method {
 	case http.MethodGet:
-		if err := strains.FromDBByFlavor(vars["flavor"]); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("could not get strains by flavor for flavor %s", vars["flavor"])
+		opts, ok := listOptions(w, r)
+		if !ok {
+			return
 		}
-		w.WriteHeader(http.StatusOK)
-		strainReprs := strains.ToStrainRepr()
-		b, err := strainReprs.ToJson()
+		page, err := s.Store.StrainsByFlavor(vars["flavor"], opts)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("failed to unmarshal getting strain by flavor")
+			writeInternalError(w, err, "could not get strains by flavor for flavor %s", vars["flavor"])
+			return
 		}
-		_, _ = fmt.Fprintf(w, string(b))
+		s.writeStrains(w, r, page)
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = fmt.Fprintf(w, "page not found\n")
+		pageNotFound(w, r)
 	}
 }
 
 // StrainByEffectHandler handles API requests for strains by Effect.
 func (s *Server) StrainByEffectHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	strains := s.newStrains()
 
 	switch r.Method {
 	case http.MethodGet:
-		if err := strains.FromDBByEffect(vars["effect"]); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("could not get strains by effect for effect %s", vars["effect"])
+		opts, ok := listOptions(w, r)
+		if !ok {
+			return
 		}
-		w.WriteHeader(http.StatusOK)
-		strainReprs := strains.ToStrainRepr()
-		b, err := strainReprs.ToJson()
+		page, err := s.Store.StrainsByEffect(vars["effect"], opts)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithError(err).Errorf("failed to unmarshal getting strain by effect")
+			writeInternalError(w, err, "could not get strains by effect for effect %s", vars["effect"])
+			return
 		}
-		_, _ = fmt.Fprintf(w, string(b))
+		s.writeStrains(w, r, page)
 	default:
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = fmt.Fprintf(w, "page not found\n")
+		pageNotFound(w, r)
 	}
 }
 
-func (s *Server) newStrain() Strain {
-	return Strain{DB: s.DB}
+// SearchStrainsHandler handles API requests for strains which meet any combination of search criteria.  Each
+// criterion can be repeated, and flavor_match and effect_match set whether strains need all or any of the
+// flavors and effects.  q further narrows the strains with an expression of the query language parsed by ParseQuery.
+func (s *Server) SearchStrainsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		opts, ok := listOptions(w, r)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		query := StrainQuery{
+			Names:            q["name"],
+			Races:            q["race"],
+			Flavors:          q["flavor"],
+			FlavorMatch:      Match(q.Get("flavor_match")),
+			Effects:          q["effect"],
+			EffectMatch:      Match(q.Get("effect_match")),
+			EffectCategories: q["effect_category"],
+			ExcludeEffects:   q["exclude_effect"],
+		}
+		if expr := q.Get("q"); expr != "" {
+			filter, err := ParseQuery(expr)
+			if err != nil {
+				log.WithError(err).Debugf("invalid query for strains %q", expr)
+				writeError(w, http.StatusBadRequest, CodeInvalidQuery, "%s", err)
+				return
+			}
+			query.Filter = filter
+		}
+		page, err := s.Store.SearchStrains(query, opts)
+		if err == ErrInvalidMatch || err == ErrInvalidEffectCategory {
+			log.WithError(err).Debugf("invalid search for strains %s", r.URL.RawQuery)
+			writeBadRequest(w, err)
+			return
+		} else if err != nil {
+			writeInternalError(w, err, "could not search for strains %s", r.URL.RawQuery)
+			return
+		}
+		s.writeStrains(w, r, page)
+	default:
+		pageNotFound(w, r)
+	}
 }
 
-func (s *Server) newStrains() Strains {
-	return Strains{DB: s.DB}
+// SuggestHandler handles API requests for strain names, flavors and effects which start with the text typed so far.
+// The kind query parameter can be repeated to limit suggestions to some kinds.
+func (s *Server) SuggestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if s.Suggestions == nil {
+			writeError(w, http.StatusNotFound, CodeNotEnabled, "suggestions are not enabled")
+			return
+		}
+		q := r.URL.Query()
+		prefix := q.Get("q")
+		if prefix == "" {
+			writeBadRequest(w, ErrSuggestQueryMissing)
+			return
+		}
+		var kinds []SuggestKind
+		for _, k := range q["kind"] {
+			switch kind := SuggestKind(k); kind {
+			case SuggestName, SuggestFlavor, SuggestEffect:
+				kinds = append(kinds, kind)
+			default:
+				log.Debugf("request for suggestions of unknown kind %s", k)
+				writeBadRequest(w, ErrInvalidSuggestKind)
+				return
+			}
+		}
+		limit := DefaultSuggestions
+		if v := q.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > MaxPageSize {
+				writeBadRequest(w, ErrInvalidLimit)
+				return
+			}
+			limit = l
+		}
+		writeJSON(w, http.StatusOK, s.Suggestions.Suggest(prefix, kinds, limit))
+	default:
+		pageNotFound(w, r)
+	}
+}
+
+// FullTextSearchHandler handles API requests for strains which have any of the words of a free text query in their
+// name, race, flavors or effects, most relevant first.
+func (s *Server) FullTextSearchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if s.FullText == nil {
+			writeError(w, http.StatusNotFound, CodeNotEnabled, "full text search is not enabled")
+			return
+		}
+		opts, ok := listOptions(w, r)
+		if !ok {
+			return
+		}
+		results, total, err := s.FullText.Search(r.URL.Query().Get("q"), opts.Offset, opts.Limit)
+		if err == ErrSearchQueryMissing {
+			writeBadRequest(w, err)
+			return
+		} else if err != nil {
+			writeInternalError(w, err, "could not search for %s", r.URL.Query().Get("q"))
+			return
+		}
+		w.Header().Set(TotalCountHeader, strconv.Itoa(total))
+		writeJSON(w, http.StatusOK, results)
+	default:
+		pageNotFound(w, r)
+	}
+}
+
+// writeOptions describes the write made by the request.
+func writeOptions(r *http.Request) WriteOptions {
+	return WriteOptions{
+		Author:  r.Header.Get(AuthorHeader),
+		IfMatch: parseIfMatch(r.Header.Get("If-Match")),
+	}
+}
+
+// requirePrecondition rejects the request with 428 Precondition Required if the server requires conditional writes
+// and the request is not conditional.  It reports whether the request may go ahead.
+func (s *Server) requirePrecondition(w http.ResponseWriter, r *http.Request) bool {
+	if !s.RequireIfMatch || r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") == "*" {
+		return true
+	}
+	log.Debugf("rejected unconditional %s request", r.Method)
+	writeError(w, http.StatusPreconditionRequired, CodePreconditionRequired,
+		"an If-Match header with the ETag of the strain is required")
+	return false
+}
+
+// etag is the entity tag of the strain, which changes whenever a new revision of the strain is written.  It holds
+// the database ID of the strain as well as the revision, so that a strain which is purged and then created again
+// does not get the tags of the strain it replaces.
+func etag(s Strain) string {
+	return fmt.Sprintf(`"%d-%d"`, s.StrainID, s.Revision)
+}
+
+// collectionETag is the entity tag of a page of strains and the time the newest of them was modified.  The tag is
+// a hash of the list's total and of which strain, on which revision, is at each place in the page, so it changes
+// whenever a strain joins or leaves the page or the list, moves within the page, or is changed.  It is weak, as it
+// is derived from the strains rather than from the bytes of the response.
+func collectionETag(page StrainPage) (string, time.Time) {
+	var newest time.Time
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d", page.Total)
+	for _, strain := range page.Strains {
+		if strain.UpdatedAt.After(newest) {
+			newest = strain.UpdatedAt
+		}
+		// the strain record ID tells apart a strain which was purged and created again, as etag() does
+		_, _ = fmt.Fprintf(h, ";%d-%d-%d", strain.ReferenceID, strain.StrainID, strain.Revision)
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64()), newest
+}
+
+// notModified sets the caching headers of a response with the given entity tag and modification time, and writes
+// 304 Not Modified if the request's If-None-Match or If-Modified-Since header shows the client has the response
+// cached already.  It reports whether the 304 was written.  If-Modified-Since is ignored when If-None-Match is sent,
+// as entity tags also catch changes made in the same second.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, tag string, modified time.Time) bool {
+	w.Header().Set("ETag", tag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if s.CacheControl != "" {
+		w.Header().Set("Cache-Control", s.CacheControl)
+	}
+
+	cached := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		cached = etagMatches(inm, tag)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		cached = err == nil && !modified.Truncate(time.Second).After(since)
+	}
+	if !cached {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether any of the entity tags in the value of an If-None-Match header matches tag.  The
+// comparison is weak, as is usual for If-None-Match, so the W/ prefix is ignored.
+func etagMatches(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeStrains writes a page of the strains found by a search as the response body, or 304 Not Modified if the
+// client has it cached already.  The total number of strains found and links to the pages either side are sent in
+// headers.
+func (s *Server) writeStrains(w http.ResponseWriter, r *http.Request, page StrainPage) {
+	w.Header().Set(TotalCountHeader, strconv.Itoa(page.Total))
+	if links := pageLinks(r, page); links != "" {
+		w.Header().Set("Link", links)
+	}
+	tag, modified := collectionETag(page)
+	if s.notModified(w, r, tag, modified) {
+		return
+	}
+	strains := Strains{strains: page.Strains}
+	strainReprs := strains.ToStrainRepr()
+	b, err := strainReprs.ToJson()
+	if err != nil {
+		writeInternalError(w, err, "failed to marshal found strains")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
+
+// parseStrain parses and validates the strain in the body of a request to write it, writing a bad request response
+// if the body is not JSON, or an unprocessable entity response listing every problem with the strain.  A strain
+// written to the URL of a strain ID takes that ID if it has none, and must not have another.
+func parseStrain(w http.ResponseWriter, r *http.Request, id uint) (StrainRepr, bool) {
+	repr, err := ParseStrain(r.Body)
+	verr := &ValidationError{}
+	if err := verr.Merge(err); err != nil {
+		log.WithError(err).Debug("request to write strain with invalid JSON")
+		writeError(w, http.StatusBadRequest, CodeInvalidJSON, "%s", err)
+		return repr, false
+	}
+	if id != 0 && repr.ID == 0 {
+		repr.ID = id
+	}
+	if id != 0 && repr.ID != id {
+		verr.Add("id", "must match the ID %d in the URL", id)
+	}
+	_ = verr.Merge(repr.Validate())
+	if verr.Err() != nil {
+		log.WithError(verr).Debugf("request to write invalid strain with ID %d", repr.ID)
+		writeInvalidStrain(w, verr)
+		return repr, false
+	}
+	return repr, true
+}
+
+// writeInvalidStrain writes an unprocessable entity problem listing every problem with the strain.
+func writeInvalidStrain(w http.ResponseWriter, verr *ValidationError) {
+	writeProblem(w, Problem{
+		Status: http.StatusUnprocessableEntity,
+		Code:   CodeInvalidStrain,
+		Detail: "the strain is not valid, see errors for the problem with each field",
+		Errors: verr.Fields,
+	})
+}
+
+// parsePatch parses the patch in the body of a request, writing an unsupported media type response if it is neither
+// a JSON merge patch nor a JSON patch, or a bad request response if it is not valid.
+func parsePatch(w http.ResponseWriter, r *http.Request) (Patch, bool) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	patch, err := ParsePatch(contentType, r.Body)
+	if err == ErrUnsupportedPatch {
+		log.Debugf("request to patch strain with unsupported content type %s", r.Header.Get("Content-Type"))
+		w.Header().Set("Accept-Patch", acceptPatch)
+		writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedPatch, "%s", err)
+		return nil, false
+	} else if err != nil {
+		log.WithError(err).Debug("request to patch strain with invalid patch")
+		writeError(w, http.StatusBadRequest, CodeInvalidPatch, "%s", err)
+		return nil, false
+	}
+	return patch, true
+}
+
+// listOptions parses the limit, offset, sort and cursor query parameters of a request for a list of strains,
+// writing a bad request response if they are not valid.
+func listOptions(w http.ResponseWriter, r *http.Request) (ListOptions, bool) {
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		log.WithError(err).Debugf("request for strains with invalid list options %s", r.URL.RawQuery)
+		writeBadRequest(w, err)
+		return opts, false
+	}
+	return opts, true
+}
+
+// parseListOptions parses the query parameters selecting a page of a list of strains.  A cursor belongs to a sort
+// order, so the sort may be left out when paging with a cursor but must not be changed.
+func parseListOptions(q url.Values) (ListOptions, error) {
+	opts := ListOptions{Limit: DefaultPageSize, Sort: q.Get("sort")}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return opts, ErrInvalidLimit
+		}
+		opts.Limit = limit
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return opts, ErrInvalidOffset
+		}
+		opts.Offset = offset
+	}
+	key, err := parseSort(opts.Sort)
+	if err != nil {
+		return opts, err
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := ParseCursor(v)
+		if err != nil {
+			return opts, err
+		}
+		if opts.Sort == "" {
+			opts.Sort = c.Sort
+		} else if c.Sort != key.String() {
+			return opts, ErrInvalidCursor
+		}
+		opts.Cursor = c
+	}
+	return opts, nil
+}
+
+// pageLinks is the value of the Link header pointing to the pages either side of page, or empty if there are none.
+// The links page with cursors, so they keep their place while strains are added and removed.
+func pageLinks(r *http.Request, page StrainPage) string {
+	var links []string
+	for _, l := range []struct {
+		rel    string
+		cursor *Cursor
+	}{{"next", page.Next}, {"prev", page.Prev}} {
+		if l.cursor == nil {
+			continue
+		}
+		q := r.URL.Query()
+		q.Del("offset")
+		q.Set("cursor", l.cursor.String())
+		u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, u.String(), l.rel))
+	}
+	return strings.Join(links, ", ")
+}
+
+// writeStoredStrain writes the strain with the given reference ID as the response body with the given status and
+// its ETag.  The strain is read back from the store after a write, so the response shows it as it was stored.
+func (s *Server) writeStoredStrain(w http.ResponseWriter, id uint, status int) {
+	strain, err := s.Store.StrainByRefID(id)
+	if err != nil {
+		writeInternalError(w, err, "could not get written strain with ID %d", id)
+		return
+	}
+	w.Header().Set("ETag", etag(strain))
+	writeJSON(w, status, strain.ToStrainRepr())
+}
+
+// strainURL is the absolute URL of the strain with the given reference ID.
+func (s *Server) strainURL(r *http.Request, id uint) string {
+	return fmt.Sprintf("%s/api/strains/id/%d", s.baseURL(r), id)
+}
+
+// baseURL is the URL of the server as the client reached it.  A proxy in front of the server tells it the scheme and
+// host the client used in the X-Forwarded-Proto and X-Forwarded-Host headers, which are only believed from
+// TrustedProxies as any client could send them.
+func (s *Server) baseURL(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if s.trustedProxy(r.RemoteAddr) {
+		// each proxy a request passes through appends its own value, after any the client sent itself, so only the
+		// last value was added by the trusted proxy
+		switch proto := strings.ToLower(lastHeaderValue(r, "X-Forwarded-Proto")); proto {
+		case "http", "https":
+			scheme = proto
+		}
+		if fwdHost := lastHeaderValue(r, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// trustedProxy reports whether the request was sent from the address of one of TrustedProxies.
+func (s *Server) trustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastHeaderValue gets the last of the comma separated values of the request header, which may be sent more than
+// once.
+func lastHeaderValue(r *http.Request, name string) string {
+	values := r.Header[http.CanonicalHeaderKey(name)]
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	return strings.TrimSpace(last[strings.LastIndex(last, ",")+1:])
+}
+
+// ParseTrustedProxies parses the IP addresses and CIDR networks of trusted proxies.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %s must be an IP address or CIDR network", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s must be an IP address or CIDR network", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseIfMatch parses the value of an If-Match header into the precondition of a write, returning nil if the header
+// is empty.  Weak entity tags never match, as If-Match uses strong comparison.
+func parseIfMatch(header string) *Precondition {
+	if header == "" {
+		return nil
+	}
+	p := &Precondition{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			p.Any = true
+			continue
+		}
+		if len(tag) < 2 || !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+			continue
+		}
+		parts := strings.Split(tag[1:len(tag)-1], "-")
+		if len(parts) != 2 {
+			continue
+		}
+		id, idErr := strconv.ParseUint(parts[0], 10, 32)
+		rev, revErr := strconv.ParseUint(parts[1], 10, 32)
+		if idErr == nil && revErr == nil {
+			p.Versions = append(p.Versions, StrainVersion{StrainID: uint(id), Revision: uint(rev)})
+		}
+	}
+	return p
+}
+
+// uintVar gets the positive integer route variable called name, writing a bad request response with invalidErr if
+// the variable is not a positive integer.
+func uintVar(w http.ResponseWriter, r *http.Request, name string, invalidErr error) (uint, bool) {
+	v, err := strconv.ParseUint(mux.Vars(r)[name], 10, 32)
+	if err != nil || v == 0 {
+		log.Debugf("request with invalid %s %s", name, mux.Vars(r)[name])
+		writeBadRequest(w, invalidErr)
+		return 0, false
+	}
+	return uint(v), true
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeInternalError(w, err, "failed to marshal response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+	_, _ = fmt.Fprintf(w, "\n")
+}
+
+// serveHeadAsGet serves HEAD requests with the handler of GET requests, leaving out the body of the response.
+func serveHeadAsGet(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			handler(w, r)
+			return
+		}
+		get := r.WithContext(r.Context())
+		get.Method = http.MethodGet
+		handler(headResponseWriter{w}, get)
+	}
+}
+
+// headResponseWriter is a response writer which discards the body, as a response to a HEAD request has none.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// allowMethods answers requests to a page with methods other than those it routes to a handler.  OPTIONS requests
+// are told the methods the page allows, and requests with any other method are rejected.
+func allowMethods(methods []string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		if contains(methods, http.MethodPatch) {
+			w.Header().Set("Accept-Patch", acceptPatch)
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		methodNotAllowed(w, r)
+	}
 }
 
 func LogInboundRequestMw(next http.Handler) http.Handler {
@@ -252,3 +1304,19 @@ func LogInboundRequestMw(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// ReadOnlyMw rejects requests which could write to the store when the server is read-only.
+func (s *Server) ReadOnlyMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if s.ReadOnly {
+				log.Debugf("rejected %s request while read-only", r.Method)
+				writeError(w, http.StatusServiceUnavailable, CodeReadOnly, "server is read-only")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
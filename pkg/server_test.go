@@ -0,0 +1,993 @@
+package tms
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve routes req to the handler registered under pattern and returns the recorded response.
+func serve(pattern string, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc(pattern, handler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// problem decodes the problem in the body of an error response.
+func problem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+	var p Problem
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &p), w.Body.String())
+	return p
+}
+
+func TestGettingStrainByIDFromServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	tests := []struct {
+		name      string
+		path      string
+		expStatus int
+		expBody   string
+	}{
+		{"found", "/api/strains/id/1", http.StatusOK, `{"name":"foo","id":1,"race":"r1","flavors":["F1","F2"],"effects":{"positive":["Pos1","Pos2"],"negative":["Neg1"],"medical":["Med1"]}}` + "\n"},
+		{"not_found", "/api/strains/id/3", http.StatusNotFound, CodeStrainNotFound},
+		{"bad_id", "/api/strains/id/abc", http.StatusBadRequest, CodeInvalidID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+			assert.Equal(tt.expStatus, w.Code)
+			if tt.expStatus == http.StatusOK {
+				assert.Equal(tt.expBody, w.Body.String())
+				assert.Equal("application/json", w.Header().Get("Content-Type"))
+			} else {
+				assert.Equal(tt.expBody, problem(t, w).Code)
+			}
+		})
+	}
+}
+
+func TestCreatingStrainThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: NewMemoryStore()}
+
+	body := `{"name":"baz","id":7,"race":"Indica","flavors":["pine"]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/strains/", bytes.NewBufferString(body))
+	w := serve("/api/strains/", srv.CreateStrainHandler, req)
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Equal("http://example.com/api/strains/id/7", w.Header().Get("Location"))
+	assert.Equal(`"1-1"`, w.Header().Get("ETag"))
+	// the strain is returned as it was stored
+	assert.Equal(`{"name":"baz","id":7,"race":"indica","flavors":["Pine"],"effects":{"positive":null,"negative":null,"medical":null}}`+"\n", w.Body.String())
+
+	s, err := srv.Store.StrainByRefID(7)
+	assert.Nil(err)
+	assert.Equal("baz", s.Name)
+
+	// creating the same strain again conflicts
+	req = httptest.NewRequest(http.MethodPost, "/api/strains/", bytes.NewBufferString(body))
+	w = serve("/api/strains/", srv.CreateStrainHandler, req)
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.Equal(CodeStrainExists, problem(t, w).Code)
+}
+
+func TestReplacingStrainThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	put := func(id string) *httptest.ResponseRecorder {
+		body := bytes.NewBufferString(`{"name":"baz","id":` + id + `}`)
+		req := httptest.NewRequest(http.MethodPut, "/api/strains/id/"+id, body)
+		return serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	}
+
+	// putting a strain which does not exist creates it
+	w := put("7")
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Equal("http://example.com/api/strains/id/7", w.Header().Get("Location"))
+
+	w = put("7")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("Location"))
+	w = put("1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("Location"))
+}
+
+func TestWritingInvalidStrainThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: NewMemoryStore()}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		expStatus int
+		expBody   string
+	}{
+		{"malformed", http.MethodPost, "/api/strains/", `{"name":`, http.StatusBadRequest, "unable to unmarshal strain"},
+		{"every_problem", http.MethodPost, "/api/strains/", `{"name":"","race":"sativia","flavors":["Pine","pine"],"colour":"green"}`,
+			http.StatusUnprocessableEntity, `"errors":[` +
+				`{"field":"colour","message":"is not a field of a strain"},` +
+				`{"field":"id","message":"is required"},` +
+				`{"field":"name","message":"is required"},` +
+				`{"field":"race","message":"must be one of indica, sativa or hybrid"},` +
+				`{"field":"flavors[1]","message":"repeats flavors[0]"}]}`},
+		{"wrong_type_reported_once", http.MethodPost, "/api/strains/", `{"name":7,"id":1}`,
+			http.StatusUnprocessableEntity, `"errors":[{"field":"name","message":"must be a string"}]}`},
+		{"id_mismatch", http.MethodPut, "/api/strains/id/2", `{"name":"a","id":3}`,
+			http.StatusUnprocessableEntity, `"errors":[{"field":"id","message":"must match the ID 2 in the URL"}]}`},
+		{"id_from_url", http.MethodPut, "/api/strains/id/2", `{"name":"a"}`, http.StatusCreated, `{"name":"a","id":2,`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			var w *httptest.ResponseRecorder
+			if tt.method == http.MethodPost {
+				w = serve("/api/strains/", srv.CreateStrainHandler, req)
+			} else {
+				w = serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+			}
+			assert.Equal(tt.expStatus, w.Code)
+			assert.Contains(w.Body.String(), tt.expBody)
+		})
+	}
+}
+
+func TestSearchingStrainsByRaceThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/strains/race/r2", nil)
+	w := serve("/api/strains/race/{race}", srv.StrainByRaceHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`[{"name":"bar","id":2,"race":"r2","flavors":["F1","F3"],"effects":{"positive":["Pos3"],"negative":["Neg2"],"medical":["Med2"]}}]`, w.Body.String())
+}
+
+func TestPagingStrainsThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+	for _, repr := range listableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	srv := Server{Store: store}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		return serve("/api/strains/race/{race}", srv.StrainByRaceHandler, req)
+	}
+	link := func(w *httptest.ResponseRecorder, rel string) string {
+		for _, l := range strings.Split(w.Header().Get("Link"), ", ") {
+			if strings.HasSuffix(l, `; rel="`+rel+`"`) {
+				return strings.TrimSuffix(strings.TrimPrefix(l, "<"), `>; rel="`+rel+`"`)
+			}
+		}
+		return ""
+	}
+
+	w := get("/api/strains/race/hybrid?sort=-name&limit=3")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("7", w.Header().Get(TotalCountHeader))
+	assert.True(strings.HasPrefix(w.Body.String(), `[{"name":"zkittlez","id":5,`))
+	assert.Empty(link(w, "prev"))
+	next := link(w, "next")
+	assert.True(strings.HasPrefix(next, "/api/strains/race/hybrid?"))
+
+	w = get(next)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(strings.HasPrefix(w.Body.String(), `[{"name":"lime","id":3,`))
+	assert.NotEmpty(link(w, "prev"))
+
+	w = get("/api/strains/race/hybrid?limit=2&offset=6")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(strings.HasPrefix(w.Body.String(), `[{"name":"blue dream","id":7,`))
+	assert.Empty(link(w, "next"))
+	prev := link(w, "prev")
+	assert.NotContains(prev, "offset")
+
+	tests := []struct {
+		name   string
+		query  string
+		expErr error
+	}{
+		{"zero_limit", "limit=0", ErrInvalidLimit},
+		{"huge_limit", "limit=100000", ErrInvalidLimit},
+		{"negative_offset", "offset=-1", ErrInvalidOffset},
+		{"unknown_sort", "sort=race", ErrInvalidSort},
+		{"bad_cursor", "cursor=abc", ErrInvalidCursor},
+		{"cursor_of_other_sort", "sort=name&" + strings.SplitN(next, "?", 2)[1], ErrInvalidCursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get("/api/strains/race/hybrid?" + tt.query)
+			assert.Equal(http.StatusBadRequest, w.Code)
+			p := problem(t, w)
+			assert.Equal(requestErrorCodes[tt.expErr], p.Code)
+			assert.Equal(tt.expErr.Error(), p.Detail)
+		})
+	}
+}
+
+func TestSearchingStrainsThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	store := NewMemoryStore()
+	for _, repr := range searchableStrains() {
+		assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+	}
+	srv := Server{Store: store}
+
+	tests := []struct {
+		name      string
+		query     string
+		expStatus int
+		expBody   string
+	}{
+		{"combined", "race=indica&flavor=Earthy&flavor=Pine&effect=Insomnia&exclude_effect=Paranoid", http.StatusOK, `"id":1,`},
+		{"any_flavor", "flavor=Pine&flavor=Citrus&flavor_match=any&race=sativa", http.StatusOK, `"id":3,`},
+		{"effect_category", "effect=Insomnia&effect_category=positive", http.StatusOK, `"id":4,`},
+		{"invalid_match", "effect=Insomnia&effect_match=most", http.StatusBadRequest, ErrInvalidMatch.Error()},
+		{"invalid_category", "effect_category=psychedelic", http.StatusBadRequest, ErrInvalidEffectCategory.Error()},
+		{"query", "q=" + url.QueryEscape("race:indica AND -effect:paranoid"), http.StatusOK, `"id":1,`},
+		{"query_and_criteria", "flavor=Citrus&q=" + url.QueryEscape("race:sativa"), http.StatusOK, `"id":3,`},
+		{"invalid_query", "q=" + url.QueryEscape("race:indica AND"), http.StatusBadRequest,
+			"syntax error at position 16: expected a term, found end of query"},
+		{"invalid_limit", "race=indica&limit=none", http.StatusBadRequest, ErrInvalidLimit.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/strains?"+tt.query, nil)
+			w := serve("/api/strains", srv.SearchStrainsHandler, req)
+			assert.Equal(tt.expStatus, w.Code)
+			assert.Contains(w.Body.String(), tt.expBody)
+			if tt.expStatus == http.StatusOK {
+				assert.Equal("1", w.Header().Get(TotalCountHeader))
+			}
+		})
+	}
+}
+
+func TestSearchingNamesThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	tests := []struct {
+		name      string
+		path      string
+		expStatus int
+		expBody   string
+	}{
+		{"exact", "/api/strains/name/foo", http.StatusOK, `{"name":"foo","id":1,`},
+		{"ignore_case", "/api/strains/name/FOO?match=ignore_case", http.StatusOK, `[{"match":"ignore_case","distance":0,"strain":{"name":"foo","id":1,`},
+		// three letter names are too short to have typos
+		{"short_typo", "/api/strains/name/bqr?match=fuzzy", http.StatusOK, "[]\n"},
+		{"fuzzy", "/api/strains/name/baar?match=fuzzy", http.StatusOK, `[{"match":"typo","distance":1,"strain":{"name":"bar","id":2,`},
+		{"no_match", "/api/strains/name/xyz?match=substring", http.StatusOK, "[]\n"},
+		{"unknown_match", "/api/strains/name/foo?match=soundex", http.StatusBadRequest, `{"title":"Bad Request","status":400,"code":"invalid_name_mode",`},
+		{"limit", "/api/strains/name/ba?match=prefix&limit=1", http.StatusOK, `[{"match":"prefix","distance":0,"strain":{"name":"bar","id":2,`},
+		{"offset", "/api/strains/name/ba?match=prefix&offset=1", http.StatusBadRequest, `{"title":"Bad Request","status":400,"code":"name_match_not_paged",`},
+		{"sort", "/api/strains/name/ba?match=prefix&sort=name", http.StatusBadRequest, `{"title":"Bad Request","status":400,"code":"name_match_not_paged",`},
+		{"cursor", "/api/strains/name/ba?match=prefix&cursor=" + (&Cursor{Sort: "name", Name: "bar"}).String(), http.StatusBadRequest, `{"title":"Bad Request","status":400,"code":"name_match_not_paged",`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := serve("/api/strains/name/{name}", srv.StrainByNameHandler, req)
+			assert.Equal(tt.expStatus, w.Code)
+			assert.True(strings.HasPrefix(w.Body.String(), tt.expBody), w.Body.String())
+			if tt.expStatus == http.StatusOK {
+				assert.Equal("application/json", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestSuggestingThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	idx := NewSuggestIndex()
+	idx.Put(StrainRepr{Name: "Earthquake", Flavors: []string{"Earthy"}})
+	srv := Server{Store: NewMemoryStore(), Suggestions: idx}
+
+	tests := []struct {
+		name      string
+		query     string
+		expStatus int
+		expBody   string
+	}{
+		{"all_kinds", "q=ear", http.StatusOK, `[{"kind":"name","text":"Earthquake"},{"kind":"flavor","text":"Earthy"}]` + "\n"},
+		{"kind", "q=ear&kind=flavor", http.StatusOK, `[{"kind":"flavor","text":"Earthy"}]` + "\n"},
+		{"limit", "q=ear&limit=1", http.StatusOK, `[{"kind":"name","text":"Earthquake"}]` + "\n"},
+		{"no_match", "q=xyz", http.StatusOK, "[]\n"},
+		{"missing_query", "kind=name", http.StatusBadRequest, `"code":"missing_query","detail":"` + ErrSuggestQueryMissing.Error()},
+		{"unknown_kind", "q=ear&kind=race", http.StatusBadRequest, `"code":"invalid_suggest_kind","detail":"` + ErrInvalidSuggestKind.Error()},
+		{"invalid_limit", "q=ear&limit=0", http.StatusBadRequest, `"code":"invalid_limit","detail":"` + ErrInvalidLimit.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/suggest?"+tt.query, nil)
+			w := serve("/api/suggest", srv.SuggestHandler, req)
+			assert.Equal(tt.expStatus, w.Code)
+			if tt.expStatus == http.StatusOK {
+				assert.Equal(tt.expBody, w.Body.String())
+			} else {
+				assert.Contains(w.Body.String(), tt.expBody)
+			}
+		})
+	}
+}
+
+func TestFullTextSearchThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	idx := NewTextIndex()
+	for _, repr := range textSearchableStrains() {
+		idx.Put(repr)
+	}
+	srv := Server{Store: NewMemoryStore(), FullText: idx}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)
+		return serve("/api/search", srv.FullTextSearchHandler, req)
+	}
+
+	w := get("q=sweet+relaxing+sativa&limit=1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("4", w.Header().Get(TotalCountHeader))
+	assert.Contains(w.Body.String(), `"highlights":{"effects":["Relaxed"],"flavors":["Sweet"],"race":["sativa"]},"strain":{"name":"Blue Dream"`)
+
+	w = get("q=")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(CodeMissingQuery, problem(t, w).Code)
+	w = get("q=sweet&offset=-1")
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestDeletingAndRestoringStrainThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/strains/id/1", nil)
+	w := serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	assert.Equal(http.StatusNoContent, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/strains/id/1", nil)
+	w = serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/strains/id/1", nil)
+	w = serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/strains/deleted", nil)
+	w = serve("/api/strains/deleted", srv.DeletedStrainsHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"id":1,`)
+	assert.Contains(w.Body.String(), `"deleted_at":`)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/strains/id/1/restore", nil)
+	w = serve("/api/strains/id/{id}/restore", srv.RestoreStrainHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"name":"foo","id":1,"race":"r1","flavors":["F1","F2"],"effects":{"positive":["Pos1","Pos2"],"negative":["Neg1"],"medical":["Med1"]}}`+"\n", w.Body.String())
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+
+	req = httptest.NewRequest(http.MethodPost, "/api/strains/id/1/restore", nil)
+	w = serve("/api/strains/id/{id}/restore", srv.RestoreStrainHandler, req)
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestStrainHistoryThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: NewMemoryStore()}
+
+	for i, race := range []string{"hybrid", "indica"} {
+		body := bytes.NewBufferString(`{"name":"Afpak","id":7,"race":"` + race + `","flavors":["Pine"]}`)
+		req := httptest.NewRequest(http.MethodPut, "/api/strains/id/7", body)
+		req.Header.Set(AuthorHeader, "curator")
+		w := serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+		assert.Equal([]int{http.StatusCreated, http.StatusOK}[i], w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/strains/id/7/history", nil)
+	w := serve("/api/strains/id/{id}/history", srv.StrainHistoryHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"revision":2,"author":"curator"`)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/strains/id/7/history/1", nil)
+	w = serve("/api/strains/id/{id}/history/{rev}", srv.StrainRevisionHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"strain":{"name":"Afpak","id":7,"race":"hybrid","flavors":["Pine"]`)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/strains/id/7/diff/1/2", nil)
+	w = serve("/api/strains/id/{id}/diff/{from}/{to}", srv.StrainDiffHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"id":7,"from":1,"to":2,"race":{"from":"hybrid","to":"indica"},"flavors":{},"effects":{"positive":{},"negative":{},"medical":{}}}`+"\n", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/strains/id/7/revert/1", nil)
+	req.Header.Set(AuthorHeader, "editor")
+	w = serve("/api/strains/id/{id}/revert/{rev}", srv.RevertStrainHandler, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"race":"hybrid"`)
+
+	// the revert is recorded as a revision of its own
+	rev, err := srv.Store.StrainRevision(7, 3)
+	assert.Nil(err)
+	assert.Equal("editor", rev.Author)
+	assert.Equal("revert to revision 1", rev.Message)
+	assert.Equal("hybrid", rev.Strain.Race)
+
+	tests := []struct {
+		name      string
+		path      string
+		expStatus int
+	}{
+		{"missing_revision", "/api/strains/id/7/history/9", http.StatusNotFound},
+		{"missing_strain", "/api/strains/id/8/history/1", http.StatusNotFound},
+		{"bad_revision", "/api/strains/id/7/history/first", http.StatusBadRequest},
+		{"zero_revision", "/api/strains/id/7/history/0", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := serve("/api/strains/id/{id}/history/{rev}", srv.StrainRevisionHandler, req)
+			assert.Equal(tt.expStatus, w.Code)
+		})
+	}
+}
+
+func TestConditionalWritesThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/strains/id/1", nil)
+		return serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	}
+	write := func(method, ifMatch string) *httptest.ResponseRecorder {
+		body := bytes.NewBufferString(`{"name":"changed","id":1}`)
+		req := httptest.NewRequest(method, "/api/strains/id/1", body)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	}
+
+	w := get()
+	assert.Equal(`"1-1"`, w.Header().Get("ETag"))
+
+	w = write(http.MethodPut, `"1-1"`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`"1-2"`, w.Header().Get("ETag"))
+
+	// the strain was changed since the first read, so writes based on it fail
+	w = write(http.MethodPut, `"1-1"`)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+	w = write(http.MethodDelete, `"1-1"`)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+	w = write(http.MethodDelete, `W/"1-2"`)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+	w = write(http.MethodDelete, `"1-1", "1-2"`)
+	assert.Equal(http.StatusNoContent, w.Code)
+	w = write(http.MethodPut, "*")
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+}
+
+func TestPatchingStrainThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	patch := func(id, contentType, ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/strains/id/"+id, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+	}
+
+	w := patch("1", MergePatchContentType+"; charset=utf-8", `"1-1"`, `{"race":"Indica","effects":{"negative":null}}`)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(`"1-2"`, w.Header().Get("ETag"))
+	var repr StrainRepr
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &repr))
+	assert.Equal("foo", repr.Name)
+	assert.Equal("indica", repr.Race)
+	assert.Equal([]string{"F1", "F2"}, repr.Flavors)
+	assert.Empty(repr.Effects.Negative)
+	assert.Equal([]string{"Med1"}, repr.Effects.Medical)
+
+	w = patch("1", JSONPatchContentType, "", `[{"op":"test","path":"/name","value":"foo"},{"op":"add","path":"/flavors/-","value":"citrus"}]`)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(`"1-3"`, w.Header().Get("ETag"))
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &repr))
+	assert.Equal([]string{"F1", "F2", "Citrus"}, repr.Flavors)
+
+	tests := []struct {
+		name        string
+		id          string
+		contentType string
+		ifMatch     string
+		body        string
+		expStatus   int
+		expCode     string
+	}{
+		{"stale", "1", MergePatchContentType, `"1-2"`, `{"name":"baz"}`, http.StatusPreconditionFailed, CodePreconditionFailed},
+		{"failed_test", "1", JSONPatchContentType, "", `[{"op":"test","path":"/name","value":"bar"}]`, http.StatusConflict, CodePatchConflict},
+		{"missing_path", "1", JSONPatchContentType, "", `[{"op":"remove","path":"/effects/negative/0"}]`, http.StatusConflict, CodePatchConflict},
+		{"invalid_strain", "1", MergePatchContentType, "", `{"race":"sativia","name":""}`, http.StatusUnprocessableEntity, CodeInvalidStrain},
+		{"changed_id", "1", MergePatchContentType, "", `{"id":2}`, http.StatusUnprocessableEntity, CodeInvalidStrain},
+		{"plain_json", "1", "application/json", "", `{"name":"baz"}`, http.StatusUnsupportedMediaType, CodeUnsupportedPatch},
+		{"no_content_type", "1", "", "", `{"name":"baz"}`, http.StatusUnsupportedMediaType, CodeUnsupportedPatch},
+		{"malformed", "1", JSONPatchContentType, "", `[{"op":"add","path":"/name"}]`, http.StatusBadRequest, CodeInvalidPatch},
+		{"not_exists", "99", MergePatchContentType, "", `{"name":"baz"}`, http.StatusNotFound, CodeStrainNotFound},
+		{"bad_id", "abc", MergePatchContentType, "", `{"name":"baz"}`, http.StatusBadRequest, CodeInvalidID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := patch(tt.id, tt.contentType, tt.ifMatch, tt.body)
+			assert.Equal(tt.expStatus, w.Code, w.Body.String())
+			assert.Equal(tt.expCode, problem(t, w).Code)
+			if tt.expStatus == http.StatusUnsupportedMediaType {
+				assert.Equal(acceptPatch, w.Header().Get("Accept-Patch"))
+			}
+		})
+	}
+
+	// failed patches change nothing
+	s, err := srv.Store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal(uint(3), s.Revision)
+	assert.Equal("foo", s.Name)
+}
+
+func TestBulkWritingThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t)}
+
+	bulk := func(method, query, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/strains/bulk"+query, bytes.NewBufferString(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set(AuthorHeader, "alice")
+		return serve("/api/strains/bulk", srv.BulkStrainsHandler, req)
+	}
+	report := func(w *httptest.ResponseRecorder) BulkReport {
+		var r BulkReport
+		assert.Equal("application/json", w.Header().Get("Content-Type"))
+		assert.Nil(json.Unmarshal(w.Body.Bytes(), &r), w.Body.String())
+		return r
+	}
+	statuses := func(results []BulkResult) []int {
+		var st []int
+		for i, res := range results {
+			assert.Equal(i, res.Index)
+			st = append(st, res.Status)
+		}
+		return st
+	}
+	name := func(id uint) string {
+		s, err := srv.Store.StrainByRefID(id)
+		if err != nil {
+			return ""
+		}
+		return s.Name
+	}
+
+	w := bulk(http.MethodPost, "", "", `[{"id":10,"name":"Afpak","race":"hybrid"},{"id":11,"name":"Afghani"}]`)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	r := report(w)
+	assert.Equal(BulkAtomic, r.Mode)
+	assert.Equal(2, r.Written)
+	assert.Equal([]int{http.StatusCreated, http.StatusCreated}, statuses(r.Results))
+	assert.Equal("http://example.com/api/strains/id/10", r.Results[0].Location)
+	assert.Equal("Afghani", name(11))
+	history, err := srv.Store.StrainHistory(11)
+	assert.Nil(err)
+	assert.Equal("alice", history[0].Author)
+
+	ndjson := "{\"id\":12,\"name\":\"Alaska\"}\n{\"id\":1,\"name\":\"foo\"}\n\n{\"id\":13,\"name\":\"Amnesia\",\"race\":\"sativia\"}\n"
+	w = bulk(http.MethodPost, "?mode=best_effort", NDJSONContentType+"; charset=utf-8", ndjson)
+	assert.Equal(http.StatusMultiStatus, w.Code, w.Body.String())
+	r = report(w)
+	assert.Equal(BulkBestEffort, r.Mode)
+	assert.Equal(1, r.Written)
+	assert.Equal(2, r.Failed)
+	assert.Equal([]int{http.StatusCreated, http.StatusConflict, http.StatusUnprocessableEntity}, statuses(r.Results))
+	assert.Equal(CodeStrainExists, r.Results[1].Code)
+	assert.Equal(CodeInvalidStrain, r.Results[2].Code)
+	assert.Equal(uint(13), r.Results[2].ID)
+	if assert.Len(r.Results[2].Errors, 1) {
+		assert.Equal("race", r.Results[2].Errors[0].Field)
+	}
+	assert.Equal("Alaska", name(12))
+	assert.Equal("", name(13))
+
+	// an atomic write with an invalid strain writes none of them
+	w = bulk(http.MethodPut, "?mode=atomic", "", `[{"id":10,"name":"Afpak Kush"},{"id":11,"name":""}]`)
+	assert.Equal(http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	p := problem(t, w)
+	assert.Equal(CodeBulkFailed, p.Code)
+	assert.Equal([]int{http.StatusFailedDependency, http.StatusUnprocessableEntity}, statuses(p.Results))
+	assert.Equal(CodeBulkAborted, p.Results[0].Code)
+	assert.Equal("Afpak", name(10))
+
+	w = bulk(http.MethodPut, "", "", `[{"id":10,"name":"Afpak Kush"},{"id":14,"name":"Blueberry"}]`)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	// strain 14 did not exist, so replacing it created it as a PUT of it alone would
+	r = report(w)
+	assert.Equal([]int{http.StatusOK, http.StatusCreated}, statuses(r.Results))
+	assert.Equal("http://example.com/api/strains/id/14", r.Results[1].Location)
+	assert.Equal("Afpak Kush", name(10))
+	assert.Equal("Blueberry", name(14))
+
+	// as does one where the store cannot make a write
+	w = bulk(http.MethodDelete, "", "", `[10, 99]`)
+	assert.Equal(http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	p = problem(t, w)
+	assert.Equal([]int{http.StatusFailedDependency, http.StatusNotFound}, statuses(p.Results))
+	assert.Equal(CodeStrainNotFound, p.Results[1].Code)
+	assert.Equal("Afpak Kush", name(10))
+
+	w = bulk(http.MethodDelete, "?mode=best_effort", NDJSONContentType, "10\n11\n")
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	assert.Equal([]int{http.StatusNoContent, http.StatusNoContent}, statuses(report(w).Results))
+	assert.Equal("", name(10))
+	assert.Equal("", name(11))
+
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		contentType string
+		body        string
+		expStatus   int
+		expCode     string
+	}{
+		{"bad_mode", http.MethodPost, "?mode=all", "", `[]`, http.StatusBadRequest, CodeInvalidBulkMode},
+		{"malformed", http.MethodPost, "", "", `[{"id":15}`, http.StatusBadRequest, CodeInvalidJSON},
+		{"single_strain", http.MethodPut, "", "", `{"id":15,"name":"Blue Dream"}`, http.StatusBadRequest, CodeInvalidJSON},
+		{"malformed_line", http.MethodPost, "", NDJSONContentType, "{\"id\":15}\n{", http.StatusBadRequest, CodeInvalidJSON},
+		{"bad_ids", http.MethodDelete, "", "", `["1"]`, http.StatusBadRequest, CodeInvalidJSON},
+		{"too_many", http.MethodDelete, "", "", "[" + strings.Repeat("1,", MaxBulkWrites) + "1]", http.StatusRequestEntityTooLarge, CodeTooManyWrites},
+		{"too_many_lines", http.MethodPost, "", NDJSONContentType, strings.Repeat("{\"id\":15}\n", MaxBulkWrites+1), http.StatusRequestEntityTooLarge, CodeTooManyWrites},
+		{"too_large", http.MethodPut, "", "", `[{"id":15,"name":"` + strings.Repeat("a", MaxBulkBodySize) + `"}]`, http.StatusRequestEntityTooLarge, CodeBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := bulk(tt.method, tt.query, tt.contentType, tt.body)
+			assert.Equal(tt.expStatus, w.Code, w.Body.String())
+			assert.Equal(tt.expCode, problem(t, w).Code)
+		})
+	}
+}
+
+func TestServerRequiringIfMatchOnlyCreatesInBulk(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t), RequireIfMatch: true}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/api/strains/bulk", bytes.NewBufferString(`[1]`))
+		w := serve("/api/strains/bulk", srv.BulkStrainsHandler, req)
+		assert.Equal(http.StatusPreconditionRequired, w.Code)
+		assert.Equal(CodePreconditionRequired, problem(t, w).Code)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/strains/bulk", bytes.NewBufferString(`[{"id":10,"name":"Afpak"}]`))
+	w := serve("/api/strains/bulk", srv.BulkStrainsHandler, req)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestCachingReadsThroughServer(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t), CacheControl: "no-cache"}
+
+	get := func(path, pattern string, handler http.HandlerFunc, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return serve(pattern, handler, req)
+	}
+	byID := func(header, value string) *httptest.ResponseRecorder {
+		return get("/api/strains/id/1", "/api/strains/id/{id}", srv.StrainByIDHandler, header, value)
+	}
+	byRace := func(header, value string) *httptest.ResponseRecorder {
+		return get("/api/strains/race/r1", "/api/strains/race/{race}", srv.StrainByRaceHandler, header, value)
+	}
+
+	w := byID("", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`"1-1"`, w.Header().Get("ETag"))
+	assert.Equal("no-cache", w.Header().Get("Cache-Control"))
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEmpty(lastModified)
+
+	w = byID("If-None-Match", `"1-1"`)
+	assert.Equal(http.StatusNotModified, w.Code)
+	assert.Empty(w.Body.String())
+	w = byID("If-None-Match", `W/"1-1"`)
+	assert.Equal(http.StatusNotModified, w.Code)
+	w = byID("If-None-Match", `"1-2"`)
+	assert.Equal(http.StatusOK, w.Code)
+	w = byID("If-Modified-Since", lastModified)
+	assert.Equal(http.StatusNotModified, w.Code)
+	w = byID("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = get("/api/strains/name/foo", "/api/strains/name/{name}", srv.StrainByNameHandler, "If-None-Match", `"1-1"`)
+	assert.Equal(http.StatusNotModified, w.Code)
+
+	w = byRace("", "")
+	assert.Equal(http.StatusOK, w.Code)
+	tag := w.Header().Get("ETag")
+	assert.True(strings.HasPrefix(tag, `W/"`))
+	w = byRace("If-None-Match", tag)
+	assert.Equal(http.StatusNotModified, w.Code)
+
+	// changing a strain in the list changes the tag of the list
+	_, err := srv.Store.ReplaceStrain(StrainRepr{ID: 1, Name: "changed", Race: "r1"}, WriteOptions{})
+	assert.Nil(err)
+	w = byRace("If-None-Match", tag)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotEqual(tag, w.Header().Get("ETag"))
+	tag = w.Header().Get("ETag")
+
+	// as does removing a strain from the list
+	assert.Nil(srv.Store.DeleteStrain(1, WriteOptions{}))
+	w = byRace("If-None-Match", tag)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotEqual(tag, w.Header().Get("ETag"))
+}
+
+func TestCollectionETagCoversWhichStrainsArePaged(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	now := time.Now()
+	strain := func(ref, id, revision uint, updated time.Time) Strain {
+		return Strain{ReferenceID: ref, StrainID: id, Revision: revision, UpdatedAt: updated}
+	}
+	page := StrainPage{Strains: []Strain{strain(1, 1, 2, now), strain(2, 2, 1, now)}, Total: 2}
+	tag, modified := collectionETag(page)
+	assert.Equal(now, modified)
+	same, _ := collectionETag(StrainPage{Strains: []Strain{strain(1, 1, 2, now), strain(2, 2, 1, now)}, Total: 2})
+	assert.Equal(tag, same)
+
+	for name, other := range map[string]StrainPage{
+		"swapped_for_older":  {Strains: []Strain{strain(1, 1, 2, now), strain(3, 3, 1, now.Add(-time.Hour))}, Total: 2},
+		"reordered":          {Strains: []Strain{strain(2, 2, 1, now), strain(1, 1, 2, now)}, Total: 2},
+		"same_revision_sum":  {Strains: []Strain{strain(1, 1, 1, now), strain(2, 2, 2, now)}, Total: 2},
+		"purged_and_created": {Strains: []Strain{strain(1, 1, 2, now), strain(2, 4, 1, now)}, Total: 2},
+	} {
+		changed, _ := collectionETag(other)
+		assert.NotEqual(tag, changed, name)
+	}
+}
+
+func TestServerRequiringIfMatchRejectsUnconditionalWrites(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t), RequireIfMatch: true}
+
+	tests := []struct {
+		name      string
+		method    string
+		id        string
+		header    string
+		value     string
+		expStatus int
+	}{
+		{"unconditional_put", http.MethodPut, "1", "", "", http.StatusPreconditionRequired},
+		{"unconditional_delete", http.MethodDelete, "1", "", "", http.StatusPreconditionRequired},
+		{"create_existing", http.MethodPut, "1", "If-None-Match", "*", http.StatusPreconditionFailed},
+		{"create_new", http.MethodPut, "9", "If-None-Match", "*", http.StatusCreated},
+		{"conditional_put", http.MethodPut, "2", "If-Match", `"2-1"`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.NewBufferString(`{"name":"changed","id":` + tt.id + `}`)
+			req := httptest.NewRequest(tt.method, "/api/strains/id/"+tt.id, body)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := serve("/api/strains/id/{id}", srv.StrainByIDHandler, req)
+			assert.Equal(tt.expStatus, w.Code)
+		})
+	}
+}
+
+func TestParsingIfMatch(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		name   string
+		header string
+		exp    *Precondition
+	}{
+		{"empty", "", nil},
+		{"any", "*", &Precondition{Any: true}},
+		{"one", `"1-3"`, &Precondition{Versions: []StrainVersion{{1, 3}}}},
+		{"many", `"1-3", "2-4"`, &Precondition{Versions: []StrainVersion{{1, 3}, {2, 4}}}},
+		{"weak", `W/"1-3"`, &Precondition{}},
+		{"unquoted", `1-3`, &Precondition{}},
+		{"revision_only", `"3"`, &Precondition{}},
+		{"not_a_revision", `"1-abc"`, &Precondition{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(tt.exp, parseIfMatch(tt.header))
+		})
+	}
+}
+
+func TestReadOnlyServerRejectsWrites(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	srv := Server{Store: seededMemoryStore(t), ReadOnly: true}
+
+	tests := []struct {
+		method    string
+		expStatus int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodPut, http.StatusServiceUnavailable},
+		{http.MethodDelete, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			body := bytes.NewBufferString(`{"name":"changed","id":1}`)
+			req := httptest.NewRequest(tt.method, "/api/strains/id/1", body)
+			w := httptest.NewRecorder()
+			srv.ReadOnlyMw(http.HandlerFunc(srv.StrainByIDHandler)).ServeHTTP(w, mux.SetURLVars(req, map[string]string{"id": "1"}))
+			assert.Equal(tt.expStatus, w.Code)
+			if tt.expStatus != http.StatusOK {
+				assert.Equal(CodeReadOnly, problem(t, w).Code)
+			}
+		})
+	}
+
+	s, err := srv.Store.StrainByRefID(1)
+	assert.Nil(err)
+	assert.Equal("foo", s.Name)
+}
+
+func TestRoutingThroughServer(t *testing.T) {
+	t.Parallel()
+	srv := Server{Store: seededMemoryStore(t)}
+	h := srv.Handler()
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		expStatus int
+		expAllow  string
+	}{
+		{"get", http.MethodGet, "/api/strains/id/1", http.StatusOK, ""},
+		{"head", http.MethodHead, "/api/strains/id/1", http.StatusOK, ""},
+		{"options", http.MethodOptions, "/api/strains/id/1", http.StatusNoContent, "GET, PUT, PATCH, DELETE, HEAD, OPTIONS"},
+		{"options_write_only", http.MethodOptions, "/api/strains/", http.StatusNoContent, "POST, OPTIONS"},
+		{"options_bulk", http.MethodOptions, "/api/strains/bulk", http.StatusNoContent, "POST, PUT, DELETE, OPTIONS"},
+		{"not_allowed", http.MethodPost, "/api/strains/id/1", http.StatusMethodNotAllowed, "GET, PUT, PATCH, DELETE, HEAD, OPTIONS"},
+		{"not_found", http.MethodGet, "/api/strainz", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			assert.Equal(tt.expStatus, w.Code)
+			assert.Equal(tt.expAllow, w.Header().Get("Allow"))
+			assert.NotEmpty(w.Header().Get(RequestIDHeader))
+			switch tt.method {
+			case http.MethodHead:
+				assert.Equal(`"1-1"`, w.Header().Get("ETag"))
+				assert.Empty(w.Body.String())
+			case http.MethodOptions:
+				assert.Empty(w.Body.String())
+			}
+			if strings.Contains(tt.expAllow, http.MethodPatch) {
+				assert.Equal(acceptPatch, w.Header().Get("Accept-Patch"))
+			} else {
+				assert.Empty(w.Header().Get("Accept-Patch"))
+			}
+			if tt.expStatus == http.StatusMethodNotAllowed {
+				assert.Equal(CodeMethodNotAllowed, problem(t, w).Code)
+			}
+		})
+	}
+}
+
+func TestLinkingThroughProxies(t *testing.T) {
+	t.Parallel()
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	assert.Nil(t, err)
+	srv := Server{TrustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		host       string
+		exp        string
+	}{
+		{"direct", "203.0.113.9:4000", false, "", "", "http://example.com"},
+		{"direct_tls", "203.0.113.9:4000", true, "", "", "https://example.com"},
+		{"trusted_network", "10.1.2.3:4000", false, "https", "strains.example.org", "https://strains.example.org"},
+		{"trusted_address", "192.0.2.1:4000", false, "HTTPS", "strains.example.org", "https://strains.example.org"},
+		{"client_header_first", "10.1.2.3:4000", false, "http, https", "evil.example, strains.example.org", "https://strains.example.org"},
+		{"client_values_ignored", "10.1.2.3:4000", false, "https, gopher", "evil.example, ", "http://example.com"},
+		{"untrusted", "192.0.2.2:4000", false, "https", "evil.example.net", "http://example.com"},
+		{"unknown_scheme", "10.1.2.3:4000", false, "gopher", "", "http://example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/strains/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.host != "" {
+				req.Header.Set("X-Forwarded-Host", tt.host)
+			}
+			assert.Equal(t, tt.exp, srv.baseURL(req))
+		})
+	}
+
+	// a header sent again by the proxy comes after the one sent by the client
+	req := httptest.NewRequest(http.MethodPost, "/api/strains/", nil)
+	req.RemoteAddr = "10.1.2.3:4000"
+	req.Header.Add("X-Forwarded-Host", "evil.example")
+	req.Header.Add("X-Forwarded-Host", "strains.example.org")
+	assert.Equal(t, "http://strains.example.org", srv.baseURL(req))
+
+	_, err = ParseTrustedProxies([]string{"proxy.internal"})
+	assert.NotNil(t, err)
+}
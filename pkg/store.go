@@ -0,0 +1,281 @@
+package tms
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// StrainStore is the storage layer behind the API server.  Implementations must be safe for concurrent use.
+type StrainStore interface {
+	// StrainByRefID gets the strain with the given reference ID.  ErrNotExists is returned if there is no such strain.
+	StrainByRefID(id uint) (Strain, error)
+	// StrainByName gets the strain with the given name.  ErrNotExists is returned if there is no such strain.
+	StrainByName(name string) (Strain, error)
+	// StrainsByNameMatch gets up to limit strains whose names match name as set by mode, best matches first, or
+	// every match if limit is zero.  ErrInvalidNameMode is returned if the mode is not known.
+	StrainsByNameMatch(name string, mode NameMode, limit int) ([]NameResult, error)
+	// StrainsByRace gets the page of strains of the given race selected by opts.
+	StrainsByRace(race string, opts ListOptions) (StrainPage, error)
+	// StrainsByFlavor gets the page of strains which have the given flavor selected by opts.
+	StrainsByFlavor(flavor string, opts ListOptions) (StrainPage, error)
+	// StrainsByEffect gets the page of strains which have the given effect, in any category, selected by opts.
+	StrainsByEffect(effect string, opts ListOptions) (StrainPage, error)
+	// SearchStrains gets the page of strains which meet every criterion of the query selected by opts.
+	// ErrInvalidMatch or ErrInvalidEffectCategory is returned if the query is not valid.
+	SearchStrains(q StrainQuery, opts ListOptions) (StrainPage, error)
+	// CreateStrain stores a new strain.  ErrRecordAlreadyExists is returned if the strain ID is already taken.
+	CreateStrain(repr StrainRepr, opts WriteOptions) error
+	// ReplaceStrain creates the strain, or replaces every attribute of the strain if it already exists, reporting
+	// whether the strain was created.  ErrPreconditionFailed is returned if the strain does not match opts.IfMatch.
+	ReplaceStrain(repr StrainRepr, opts WriteOptions) (bool, error)
+	// PatchStrain applies patch to the strain with the given reference ID, keeping what the patch does not change.
+	// ErrNotExists is returned if there is no such strain and ErrPreconditionFailed if the strain does not match
+	// opts.IfMatch.  A *PatchError is returned if the patch cannot be applied, and a *ValidationError if the patched
+	// strain is not valid.
+	PatchStrain(id uint, patch Patch, opts WriteOptions) error
+	// DeleteStrain removes the strain with the given reference ID.  ErrNotExists is returned if there is
+	// no such strain.
+	DeleteStrain(id uint, opts WriteOptions) error
+	// WriteStrains makes each of the writes in order, returning the outcome of each write.  In BulkAtomic mode
+	// either every write is made or, if any of them fails, none of them are, and the writes which did not fail
+	// themselves fail with ErrBulkAborted.  The error returned separately is a failure of the store as a whole.
+	WriteStrains(writes []BulkWrite, mode BulkMode, opts WriteOptions) ([]BulkOutcome, error)
+	// RestoreStrain brings back the deleted strain with the given reference ID.  ErrNotExists is returned if there
+	// is no such deleted strain.
+	RestoreStrain(id uint) error
+	// DeletedStrains gets all deleted strains which can still be restored, ordered by reference ID.
+	DeletedStrains() ([]Strain, error)
+	// StrainHistory gets every revision of the strain with the given reference ID, oldest first.  ErrNotExists is
+	// returned if the strain has no revisions.
+	StrainHistory(id uint) ([]StrainRevision, error)
+	// StrainRevision gets a single revision of the strain with the given reference ID.  ErrNotExists is returned if
+	// there is no such revision.
+	StrainRevision(id, revision uint) (StrainRevision, error)
+}
+
+// GormStore is a StrainStore backed by a gorm database connection.
+type GormStore struct {
+	// DB is the database connection through which all transactions are brokered.
+	DB *gorm.DB
+}
+
+// NewGormStore creates a GormStore using the given database connection.
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{DB: db}
+}
+
+// StrainByRefID gets the strain with the given reference ID from the database.
+func (gs *GormStore) StrainByRefID(id uint) (Strain, error) {
+	s := Strain{DB: gs.DB}
+	err := s.FromDBByRefID(id)
+	return s, err
+}
+
+// StrainByName gets the strain with the given name from the database.
+func (gs *GormStore) StrainByName(name string) (Strain, error) {
+	s := Strain{DB: gs.DB}
+	err := s.FromDBByName(name)
+	return s, err
+}
+
+// StrainsByNameMatch gets the strains whose names match name from the database, best matches first.
+func (gs *GormStore) StrainsByNameMatch(name string, mode NameMode, limit int) ([]NameResult, error) {
+	s := Strains{DB: gs.DB}
+	return s.FromDBByNameMatch(name, mode, limit)
+}
+
+// StrainsByRace gets the page of strains of the given race from the database.
+func (gs *GormStore) StrainsByRace(race string, opts ListOptions) (StrainPage, error) {
+	s := Strains{DB: gs.DB, List: opts}
+	err := s.FromDBByRace(race)
+	return s.page(), err
+}
+
+// StrainsByFlavor gets the page of strains with the given flavor from the database.
+func (gs *GormStore) StrainsByFlavor(flavor string, opts ListOptions) (StrainPage, error) {
+	s := Strains{DB: gs.DB, List: opts}
+	err := s.FromDBByFlavor(flavor)
+	return s.page(), err
+}
+
+// StrainsByEffect gets the page of strains with the given effect from the database.
+func (gs *GormStore) StrainsByEffect(effect string, opts ListOptions) (StrainPage, error) {
+	s := Strains{DB: gs.DB, List: opts}
+	err := s.FromDBByEffect(effect)
+	return s.page(), err
+}
+
+// SearchStrains gets the page of strains which meet every criterion of the query from the database.
+func (gs *GormStore) SearchStrains(q StrainQuery, opts ListOptions) (StrainPage, error) {
+	s := Strains{DB: gs.DB, List: opts}
+	err := s.FromDBByQuery(q)
+	return s.page(), err
+}
+
+// CreateStrain creates the strain in the database.
+func (gs *GormStore) CreateStrain(repr StrainRepr, opts WriteOptions) error {
+	repr.DB = gs.DB
+	return repr.CreateInDB(opts)
+}
+
+// ReplaceStrain creates or replaces the strain in the database, reporting whether it was created.
+func (gs *GormStore) ReplaceStrain(repr StrainRepr, opts WriteOptions) (bool, error) {
+	repr.DB = gs.DB
+	return repr.ReplaceInDB(opts)
+}
+
+// PatchStrain applies the patch to the strain in the database, writing only what it changes.
+func (gs *GormStore) PatchStrain(id uint, patch Patch, opts WriteOptions) error {
+	s := Strain{DB: gs.DB}
+	return s.PatchInDB(id, patch, opts)
+}
+
+// DeleteStrain soft deletes the strain from the database, leaving its traits in place so that it can be restored.
+func (gs *GormStore) DeleteStrain(id uint, opts WriteOptions) error {
+	if gs.DB == nil {
+		return ErrDatabaseConnectionNil
+	}
+	return deleteStrainInDB(gs.DB, id, opts)
+}
+
+// WriteStrains makes the writes to the database.  An atomic bulk write is made in a single transaction, while each
+// write of a best effort bulk write is made in a transaction of its own.
+func (gs *GormStore) WriteStrains(writes []BulkWrite, mode BulkMode, opts WriteOptions) ([]BulkOutcome, error) {
+	if gs.DB == nil {
+		return nil, ErrDatabaseConnectionNil
+	}
+	if mode == BulkAtomic {
+		return writeBulkInDB(gs.DB, writes, opts)
+	}
+	outcomes := make([]BulkOutcome, len(writes))
+	for i := range writes {
+		written, err := writeBulkInDB(gs.DB, writes[i:i+1], opts)
+		if err != nil {
+			outcomes[i] = BulkOutcome{Err: err}
+			continue
+		}
+		outcomes[i] = written[0]
+	}
+	return outcomes, nil
+}
+
+// deleteStrainInDB soft deletes the strain with the given reference ID through db, which may be a transaction.
+func deleteStrainInDB(db *gorm.DB, id uint, opts WriteOptions) error {
+	query := db.Where("reference_id = ?", id)
+	if opts.IfMatch != nil && !opts.IfMatch.Any {
+		cond, args := opts.IfMatch.where()
+		query = query.Where(cond, args...)
+	}
+	res := query.Delete(&Strain{})
+	if res.Error != nil {
+		return errors.Wrapf(res.Error, "unable to delete strain with reference ID %d", id)
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+	// tell a strain which is on another revision apart from one which does not exist
+	if opts.IfMatch != nil {
+		var count int
+		if err := db.Model(&Strain{}).Where("reference_id = ?", id).Count(&count).Error; err != nil {
+			return errors.Wrapf(err, "unable to check for strain with reference ID %d", id)
+		}
+		if count > 0 {
+			return ErrPreconditionFailed
+		}
+	}
+	return ErrNotExists
+}
+
+// RestoreStrain clears the deletion time of the strain in the database.
+func (gs *GormStore) RestoreStrain(id uint) error {
+	if gs.DB == nil {
+		return ErrDatabaseConnectionNil
+	}
+	res := gs.DB.Unscoped().Model(&Strain{}).
+		Where("reference_id = ? AND deleted_at IS NOT NULL", id).
+		Update("deleted_at", nil)
+	if res.Error != nil {
+		return errors.Wrapf(res.Error, "unable to restore strain with reference ID %d", id)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotExists
+	}
+	return nil
+}
+
+// DeletedStrains gets all soft deleted strains from the database.
+func (gs *GormStore) DeletedStrains() ([]Strain, error) {
+	s := Strains{DB: gs.DB}
+	err := s.FromDBDeleted()
+	return s.strains, err
+}
+
+// StrainHistory gets every revision of the strain from the database.
+func (gs *GormStore) StrainHistory(id uint) ([]StrainRevision, error) {
+	if gs.DB == nil {
+		return nil, ErrDatabaseConnectionNil
+	}
+	var revs []StrainRevision
+	if err := gs.DB.Where("reference_id = ?", id).Order("revision").Find(&revs).Error; err != nil {
+		return nil, errors.Wrapf(err, "unable to get history of strain with reference ID %d", id)
+	}
+	if len(revs) == 0 {
+		return nil, ErrNotExists
+	}
+	for i := range revs {
+		if err := revs[i].decode(); err != nil {
+			return nil, err
+		}
+	}
+	return revs, nil
+}
+
+// StrainRevision gets a single revision of the strain from the database.
+func (gs *GormStore) StrainRevision(id, revision uint) (StrainRevision, error) {
+	var rev StrainRevision
+	if gs.DB == nil {
+		return rev, ErrDatabaseConnectionNil
+	}
+	err := gs.DB.Where("reference_id = ? AND revision = ?", id, revision).First(&rev).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return rev, ErrNotExists
+	} else if err != nil {
+		return rev, errors.Wrapf(err, "unable to get revision %d of strain with reference ID %d", revision, id)
+	}
+	return rev, rev.decode()
+}
+
+// PurgeDeletedStrains permanently removes strains which were deleted before the given time, along with their
+// flavor and effect associations and revision history.  The number of strains removed is returned.
+func (gs *GormStore) PurgeDeletedStrains(before time.Time) (int64, error) {
+	if gs.DB == nil {
+		return 0, ErrDatabaseConnectionNil
+	}
+	tx := gs.DB.Begin()
+	if tx.Error != nil {
+		return 0, errors.Wrap(tx.Error, "unable to begin transaction")
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	purged := "SELECT strain_id FROM strain WHERE deleted_at IS NOT NULL AND deleted_at < ?"
+	for _, table := range []string{"strain_flavors", "strain_effects"} {
+		err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE strain_strain_id IN (%s)", table, purged), before).Error
+		if err != nil {
+			return 0, errors.Wrapf(err, "unable to purge %s of deleted strains", table)
+		}
+	}
+	err := tx.Exec("DELETE FROM strain_revision WHERE reference_id IN (SELECT reference_id FROM strain WHERE deleted_at IS NOT NULL AND deleted_at < ?)", before).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to purge history of deleted strains")
+	}
+	res := tx.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", before).Delete(&Strain{})
+	if res.Error != nil {
+		return 0, errors.Wrap(res.Error, "unable to purge deleted strains")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, errors.Wrap(err, "unable to commit purge of deleted strains")
+	}
+	return res.RowsAffected, nil
+}
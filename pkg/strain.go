@@ -2,14 +2,36 @@ package tms
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
+	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"math"
+	"strings"
 	"time"
 )
 
+const (
+	// maxWriteAttempts is how many times a strain write is attempted when it conflicts with concurrent writes.
+	maxWriteAttempts = 5
+	// writeRetryBackoff is how long to wait before retrying a conflicting write, multiplied by the attempt.
+	writeRetryBackoff = 20 * time.Millisecond
+	// traitBatchSize is how many strains at most have their traits loaded by a single query, keeping the number
+	// of bound parameters within database limits.
+	traitBatchSize = 500
+)
+
+// MySQL error numbers which indicate a conflict with a concurrent write.
+const (
+	mysqlErrDuplicateEntry  = 1062
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
 var (
 	ErrRecordAlreadyExists   = errors.New("the record already exists")
 	ErrNotExists             = errors.New("the record does not exist")
@@ -36,6 +58,8 @@ type Strain struct {
 	Name string `gorm:"not null"`
 	// Race indicates the strain's genetic makeup.
 	Race string
+	// Revision is the latest revision of the strain in its history, or zero if it has none.
+	Revision uint `gorm:"not null;default:0"`
 	// Flavors stores all flavors of the strain.
 	Flavors []Flavor `gorm:"many2many:strain_flavors"`
 	// Effects stores side effects and their category.
@@ -45,8 +69,8 @@ type Strain struct {
 	DB *gorm.DB `gorm:"-" json:"-"`
 }
 
-// ReplaceInDB creates the entry in the database.  An error is returned if the create fails, or if the
-// record already exists.
+// CreateInDB creates the entry in the database, finding or creating its traits.  An error is returned if the
+// create fails, or if the record already exists.
 func (s *Strain) CreateInDB() error {
 	if s.DB == nil {
 		return ErrDatabaseConnectionNil
@@ -59,26 +83,9 @@ func (s *Strain) CreateInDB() error {
 		return ErrRecordAlreadyExists
 	}
 
-	maxRetries := 3
-	if err := s.createWithRetries(maxRetries, 0, nil); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *Strain) createWithRetries(max, attempts int, err error) error {
-	if attempts > 0 {
-		log.Tracef("%d failed attempts to create record with ID %d", attempts, s.ReferenceID)
-	}
-	if attempts > max {
-		return err
-	}
-	err = s.DB.Create(s).Error
-	if err != nil {
-		attempts++
-		err = s.createWithRetries(max, attempts, err)
-	}
-	return nil
+	repr := s.ToStrainRepr()
+	repr.DB = s.DB
+	return repr.CreateInDB(WriteOptions{})
 }
 
 // FromDBByRefID populates the struct with details from the database by searching on the strain id.
@@ -147,6 +154,7 @@ func (s *Strain) FlavorsFromDBByRefID(id uint) (Flavors, error) {
 	if err != nil {
 		return flavors, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var f Flavor
@@ -170,6 +178,7 @@ func (s *Strain) EffectsFromDBByRefID(id uint) (Effects, error) {
 	if err != nil {
 		return effects, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var e Effect
@@ -183,10 +192,11 @@ func (s *Strain) EffectsFromDBByRefID(id uint) (Effects, error) {
 
 func (s *Strain) ToStrainRepr() StrainRepr {
 	r := StrainRepr{
-		Name:    s.Name,
-		ID:      s.ReferenceID,
-		Race:    s.Race,
-		Flavors: []string{},
+		Name:      s.Name,
+		ID:        s.ReferenceID,
+		Race:      s.Race,
+		DeletedAt: s.DeletedAt,
+		Flavors:   []string{},
 		Effects: struct {
 			Positive []string `json:"positive"`
 			Negative []string `json:"negative"`
@@ -212,105 +222,375 @@ func (s *Strain) ToStrainRepr() StrainRepr {
 type Strains struct {
 	strains []Strain
 	DB      *gorm.DB
+	// List selects the page of strains searched for, and how they are sorted.
+	List ListOptions
+	// Total is the number of strains found by the last search, across all pages.
+	Total int
+	// Next and Prev are cursors to the pages either side of the strains found by the last search, nil if there is
+	// no such page.
+	Next *Cursor
+	Prev *Cursor
 }
 
-// FromDBByRace populates the struct with all strains from the database by searching on strain race.
+// FromDBByRace populates the struct with strains from the database by searching on strain race, in any case.
 func (s *Strains) FromDBByRace(race string) error {
 	if s.DB == nil {
 		return ErrDatabaseConnectionNil
 	}
 
-	rows, err := s.DB.Table("strain").
-		Select("strain.name, strain.reference_id").
-		Where("strain.race = ?", race).
-		Rows()
-	if err != nil {
+	query := s.DB.Table("strain").
+		Where("strain.race = ? AND strain.deleted_at IS NULL", CanonicalRace(race))
+	if err := s.fromDBPage(query); err != nil {
 		return errors.Wrapf(err, "unable to get strains by race %s from DB", race)
 	}
-	for rows.Next() {
-		strain := Strain{Race: race, DB: s.DB}
-		if err := rows.Scan(&strain.Name, &strain.ReferenceID); err != nil {
-			return errors.Wrap(err, "error scanning results for strain search")
-		}
-		strain.Flavors, err = strain.FlavorsFromDBByRefID(strain.ReferenceID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to get flavors for strain with reference ID %d", strain.ReferenceID)
-		}
-		strain.Effects, err = strain.EffectsFromDBByRefID(strain.ReferenceID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to get effects for strain with reference ID %d", strain.ReferenceID)
-		}
-		s.strains = append(s.strains, strain)
-	}
 	return nil
 }
 
-// FromDBByFlavor populates the struct with all strains from the database by searching on strain flavor names.
+// FromDBByFlavor populates the struct with strains from the database by searching on strain flavor names, in any
+// case.
 func (s *Strains) FromDBByFlavor(flavor string) error {
 	if s.DB == nil {
 		return ErrDatabaseConnectionNil
 	}
 
-	rows, err := s.DB.Table("strain_flavors").
-		Select("strain.name, strain.race, strain.reference_id").
+	query := s.DB.Table("strain_flavors").
 		Joins("JOIN strain ON strain_flavors.strain_strain_id = strain.strain_id").
 		Joins("JOIN flavor ON strain_flavors.flavor_flavor_id = flavor.flavor_id").
-		Where("flavor.name = ?", flavor).
-		Rows()
-	if err != nil {
+		Where("flavor.name = ? AND strain.deleted_at IS NULL", CanonicalTrait(flavor))
+	if err := s.fromDBPage(query); err != nil {
 		return errors.Wrapf(err, "unable to get strains by flavor %s from DB", flavor)
 	}
+	return nil
+}
+
+// FromDBByEffect populates the struct with strains from the database by searching on strain effect name, in any
+// case and category.
+func (s *Strains) FromDBByEffect(effect string) error {
+	if s.DB == nil {
+		return ErrDatabaseConnectionNil
+	}
+
+	query := s.DB.Table("strain_effects").
+		Joins("JOIN strain ON strain_effects.strain_strain_id = strain.strain_id").
+		Joins("JOIN effect ON strain_effects.effect_effect_id = effect.effect_id").
+		Where("effect.name = ? AND strain.deleted_at IS NULL", CanonicalTrait(effect))
+	if err := s.fromDBPage(query); err != nil {
+		return errors.Wrapf(err, "unable to get strains by effect %s from DB", effect)
+	}
+	return nil
+}
+
+// FromDBByQuery populates the struct with strains from the database which meet every criterion of the query.  The
+// criteria are compiled into a single query, with a subquery for each trait criterion.
+func (s *Strains) FromDBByQuery(q StrainQuery) error {
+	if s.DB == nil {
+		return ErrDatabaseConnectionNil
+	}
+	q, err := q.normalize()
+	if err != nil {
+		return err
+	}
+
+	query := s.DB.Table("strain").Where("strain.deleted_at IS NULL")
+	if len(q.Names) > 0 {
+		query = query.Where("strain.name IN (?)", q.Names)
+	}
+	if len(q.Races) > 0 {
+		query = query.Where("strain.race IN (?)", q.Races)
+	}
+	if len(q.Flavors) > 0 {
+		sub := "SELECT strain_flavors.strain_strain_id FROM strain_flavors " +
+			"JOIN flavor ON strain_flavors.flavor_flavor_id = flavor.flavor_id " +
+			"WHERE flavor.name IN (?)"
+		args := []interface{}{q.Flavors}
+		if q.FlavorMatch == MatchAll {
+			sub += " GROUP BY strain_flavors.strain_strain_id HAVING COUNT(DISTINCT flavor.name) = ?"
+			args = append(args, len(q.Flavors))
+		}
+		query = query.Where("strain.strain_id IN ("+sub+")", args...)
+	}
+	if len(q.Effects) > 0 {
+		sub := "SELECT strain_effects.strain_strain_id FROM strain_effects " +
+			"JOIN effect ON strain_effects.effect_effect_id = effect.effect_id " +
+			"WHERE effect.name IN (?)"
+		args := []interface{}{q.Effects}
+		if len(q.EffectCategories) > 0 {
+			sub += " AND effect.category IN (?)"
+			args = append(args, q.EffectCategories)
+		}
+		if q.EffectMatch == MatchAll {
+			sub += " GROUP BY strain_effects.strain_strain_id HAVING COUNT(DISTINCT effect.name) = ?"
+			args = append(args, len(q.Effects))
+		}
+		query = query.Where("strain.strain_id IN ("+sub+")", args...)
+	}
+	if len(q.ExcludeEffects) > 0 {
+		query = query.Where("strain.strain_id NOT IN ("+
+			"SELECT strain_effects.strain_strain_id FROM strain_effects "+
+			"JOIN effect ON strain_effects.effect_effect_id = effect.effect_id "+
+			"WHERE effect.name IN (?))", q.ExcludeEffects)
+	}
+	if q.Filter != nil {
+		cond, args := q.Filter.sql()
+		query = query.Where(cond, args...)
+	}
+
+	if err := s.fromDBPage(query); err != nil {
+		return errors.Wrap(err, "unable to search for strains in DB")
+	}
+	return nil
+}
+
+// FromDBByNameMatch populates the struct with strains from the database whose names match name as set by mode,
+// returning them best matches first.  The database only narrows down the strains for the modes which it can match
+// itself, so a fuzzy search reads the name of every strain.
+func (s *Strains) FromDBByNameMatch(name string, mode NameMode, limit int) ([]NameResult, error) {
+	if s.DB == nil {
+		return nil, ErrDatabaseConnectionNil
+	}
+
+	query := s.DB.Table("strain").
+		Select("strain.strain_id, strain.name, COALESCE(strain.race, ''), strain.reference_id, strain.revision, strain.updated_at").
+		Where("strain.deleted_at IS NULL")
+	lower := strings.ToLower(name)
+	switch mode {
+	case NameExact:
+		query = query.Where("strain.name = ?", name)
+	case NameIgnoreCase:
+		query = query.Where("LOWER(strain.name) = ?", lower)
+	case NamePrefix:
+		query = query.Where("LOWER(strain.name) LIKE ? ESCAPE '!'", escapeLike(lower)+"%")
+	case NameSubstring:
+		query = query.Where("LOWER(strain.name) LIKE ? ESCAPE '!'", "%"+escapeLike(lower)+"%")
+	case NameFuzzy:
+	default:
+		return nil, ErrInvalidNameMode
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get strains matching name %s from DB", name)
+	}
+	defer rows.Close()
+	var found []Strain
+	for rows.Next() {
+		strain := Strain{DB: s.DB}
+		if err := rows.Scan(&strain.StrainID, &strain.Name, &strain.Race, &strain.ReferenceID, &strain.Revision, &strain.UpdatedAt); err != nil {
+			return nil, errors.Wrap(err, "error scanning results for strain name search")
+		}
+		found = append(found, strain)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading results for strain name search")
+	}
+
+	results, err := rankNameMatches(name, mode, found, limit)
+	if err != nil {
+		return nil, err
+	}
+	ranked := make([]Strain, 0, len(results))
+	for _, r := range results {
+		ranked = append(ranked, r.Strain)
+	}
+	if err := s.appendWithTraits(ranked); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Strain = s.strains[len(s.strains)-len(results)+i]
+	}
+	return results, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, for use with ESCAPE '!'.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// fromDBPage populates the struct with the page of the strains found by query which is selected by s.List.  The
+// query may join the strain table to others, and so find a strain more than once.
+func (s *Strains) fromDBPage(query *gorm.DB) error {
+	key, err := parseSort(s.List.Sort)
+	if err != nil {
+		return err
+	}
+	c := s.List.Cursor
+	if c != nil && c.Sort != key.String() {
+		return ErrInvalidCursor
+	}
+
+	// a strain can be found more than once, for instance when it has an effect by the same name in two categories
+	if err := query.Select("COUNT(DISTINCT strain.strain_id)").Row().Scan(&s.Total); err != nil {
+		return errors.Wrap(err, "unable to count strains")
+	}
+
+	before := c != nil && c.Before
+	page := query.
+		Select("DISTINCT strain.strain_id, strain.name, COALESCE(strain.race, ''), strain.reference_id, strain.revision, strain.updated_at").
+		Order(key.orderBy(before))
+	if c != nil {
+		where, args := key.keyset(c)
+		page = page.Where(where, args...)
+	} else if s.List.Offset > 0 {
+		page = page.Offset(s.List.Offset)
+	}
+	// one more strain than the limit tells whether there is another page
+	if s.List.Limit > 0 {
+		page = page.Limit(s.List.Limit + 1)
+	} else if s.List.Offset > 0 {
+		// an offset needs a limit
+		page = page.Limit(math.MaxInt32)
+	}
+
+	rows, err := page.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var found []Strain
 	for rows.Next() {
 		strain := Strain{DB: s.DB}
-		if err := rows.Scan(&strain.Name, &strain.Race, &strain.ReferenceID); err != nil {
+		if err := rows.Scan(&strain.StrainID, &strain.Name, &strain.Race, &strain.ReferenceID, &strain.Revision, &strain.UpdatedAt); err != nil {
 			return errors.Wrap(err, "error scanning results for strain search")
 		}
-		strain.Flavors, err = strain.FlavorsFromDBByRefID(strain.ReferenceID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to get flavors for strain with reference ID %d", strain.ReferenceID)
+		found = append(found, strain)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error reading results for strain search")
+	}
+
+	more := s.List.Limit > 0 && len(found) > s.List.Limit
+	if more {
+		found = found[:s.List.Limit]
+	}
+	if before {
+		for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+			found[i], found[j] = found[j], found[i]
 		}
-		strain.Effects, err = strain.EffectsFromDBByRefID(strain.ReferenceID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to get effects for strain with reference ID %d", strain.ReferenceID)
+	}
+	s.Next, s.Prev = nil, nil
+	if len(found) > 0 {
+		if (before && more) || (!before && (c != nil || s.List.Offset > 0)) {
+			s.Prev = key.cursor(found[0], true)
+		}
+		if (!before && more) || before {
+			s.Next = key.cursor(found[len(found)-1], false)
 		}
-		s.strains = append(s.strains, strain)
 	}
-	return nil
+	return s.appendWithTraits(found)
 }
 
-// FromDBByEffect populates the struct with all strains from the database by searching on strain effect name and category.
-func (s *Strains) FromDBByEffect(effect string) error {
+// FromDBDeleted populates the struct with all soft deleted strains from the database.
+func (s *Strains) FromDBDeleted() error {
 	if s.DB == nil {
 		return ErrDatabaseConnectionNil
 	}
 
-	rows, err := s.DB.Table("strain_effects").
-		Select("strain.name, strain.race, strain.reference_id").
-		Joins("JOIN strain ON strain_effects.strain_strain_id = strain.strain_id").
-		Joins("JOIN effect ON strain_effects.effect_effect_id = effect.effect_id").
-		Where("effect.name = ?", effect).
+	rows, err := s.DB.Table("strain").
+		Select("strain.strain_id, strain.name, COALESCE(strain.race, ''), strain.reference_id, strain.revision, strain.updated_at, strain.deleted_at").
+		Where("strain.deleted_at IS NOT NULL").
+		Order("strain.reference_id").
 		Rows()
 	if err != nil {
-		return errors.Wrapf(err, "unable to get strains by effect %s from DB", effect)
+		return errors.Wrap(err, "unable to get deleted strains from DB")
 	}
+	defer rows.Close()
+	var found []Strain
 	for rows.Next() {
 		strain := Strain{DB: s.DB}
-		if err := rows.Scan(&strain.Name, &strain.Race, &strain.ReferenceID); err != nil {
-			return errors.Wrap(err, "error scanning results for strain search")
+		if err := rows.Scan(&strain.StrainID, &strain.Name, &strain.Race, &strain.ReferenceID, &strain.Revision, &strain.UpdatedAt, &strain.DeletedAt); err != nil {
+			return errors.Wrap(err, "error scanning results for deleted strains")
 		}
-		strain.Flavors, err = strain.FlavorsFromDBByRefID(strain.ReferenceID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to get flavors for strain with reference ID %d", strain.ReferenceID)
+		found = append(found, strain)
+	}
+	return s.appendWithTraits(found)
+}
+
+// appendWithTraits gets flavors and effects for the found strains and adds them to the collection.  Traits are
+// loaded for many strains at once, so the number of queries does not grow with the number of strains.
+func (s *Strains) appendWithTraits(found []Strain) error {
+	// a strain can be found more than once, for instance when it has an effect by the same name in two categories
+	unique := make([]Strain, 0, len(found))
+	seen := make(map[uint]bool, len(found))
+	for _, strain := range found {
+		if !seen[strain.StrainID] {
+			seen[strain.StrainID] = true
+			unique = append(unique, strain)
 		}
-		strain.Effects, err = strain.EffectsFromDBByRefID(strain.ReferenceID)
-		if err != nil {
-			return errors.Wrapf(err, "unable to get effects for strain with reference ID %d", strain.ReferenceID)
+	}
+
+	byID := make(map[uint]*Strain, len(unique))
+	ids := make([]uint, 0, len(unique))
+	for i := range unique {
+		byID[unique[i].StrainID] = &unique[i]
+		ids = append(ids, unique[i].StrainID)
+	}
+	for start := 0; start < len(ids); start += traitBatchSize {
+		end := start + traitBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := s.loadFlavors(ids[start:end], byID); err != nil {
+			return errors.Wrap(err, "unable to get flavors for strains")
+		}
+		if err := s.loadEffects(ids[start:end], byID); err != nil {
+			return errors.Wrap(err, "unable to get effects for strains")
 		}
-		s.strains = append(s.strains, strain)
 	}
+	s.strains = append(s.strains, unique...)
 	return nil
 }
 
+// loadFlavors gets the flavors of the strains with the given strain IDs in a single query.
+func (s *Strains) loadFlavors(ids []uint, byID map[uint]*Strain) error {
+	rows, err := s.DB.Table("strain_flavors").
+		Select("strain_flavors.strain_strain_id, flavor.name").
+		Joins("JOIN flavor ON strain_flavors.flavor_flavor_id = flavor.flavor_id").
+		Where("strain_flavors.strain_strain_id IN (?)", ids).
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint
+		var f Flavor
+		if err := rows.Scan(&id, &f.Name); err != nil {
+			return err
+		}
+		byID[id].Flavors = append(byID[id].Flavors, f)
+	}
+	return rows.Err()
+}
+
+// loadEffects gets the effects of the strains with the given strain IDs in a single query.
+func (s *Strains) loadEffects(ids []uint, byID map[uint]*Strain) error {
+	rows, err := s.DB.Table("strain_effects").
+		Select("strain_effects.strain_strain_id, effect.name, effect.category").
+		Joins("JOIN effect ON strain_effects.effect_effect_id = effect.effect_id").
+		Where("strain_effects.strain_strain_id IN (?)", ids).
+		Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint
+		var e Effect
+		if err := rows.Scan(&id, &e.Name, &e.Category); err != nil {
+			return err
+		}
+		byID[id].Effects = append(byID[id].Effects, e)
+	}
+	return rows.Err()
+}
+
+// page is the page of strains found by the last search.
+func (s *Strains) page() StrainPage {
+	return StrainPage{Strains: s.strains, Total: s.Total, Next: s.Next, Prev: s.Prev}
+}
+
 func (s *Strains) ToStrainRepr() StrainReprs {
 	var reprs []StrainRepr
 	for _, strain := range s.strains {
@@ -325,8 +605,10 @@ type DatabaseVer struct {
 	UpdatedAt time.Time  `json:"-"`
 	DeletedAt *time.Time `json:"-"`
 	VersionID uint       `gorm:"primary_key;auto_increment" json:"-"`
-	// Iteration holds the current iteration of the database schema.
+	// Iteration holds the iteration of the database schema reached by applying a migration.
 	Iteration uint `gorm:"unique;not null"`
+	// Description is the description of the applied migration.
+	Description string
 }
 
 // Flavor is how the Strain will taste, and is used to directly model the database schema.
@@ -399,119 +681,386 @@ type StrainRepr struct {
 		Negative []string `json:"negative"`
 		Medical  []string `json:"medical"`
 	} `json:"effects"`
+	// DeletedAt is when the strain was deleted, only set for deleted strains.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 
 	DB *gorm.DB `json:"-"`
 }
 
+// ToStrain converts the representation to a Strain, categorizing effects along the way.
+func (rs *StrainRepr) ToStrain() Strain {
+	s := Strain{
+		ReferenceID: rs.ID,
+		Name:        rs.Name,
+		Race:        rs.Race,
+		DB:          rs.DB,
+	}
+	for _, f := range rs.Flavors {
+		s.Flavors = append(s.Flavors, Flavor{Name: f})
+	}
+	for _, e := range rs.Effects.Positive {
+		s.Effects = append(s.Effects, Effect{Name: e, Category: "positive"})
+	}
+	for _, e := range rs.Effects.Negative {
+		s.Effects = append(s.Effects, Effect{Name: e, Category: "negative"})
+	}
+	for _, e := range rs.Effects.Medical {
+		s.Effects = append(s.Effects, Effect{Name: e, Category: "medical"})
+	}
+	return s
+}
+
 // CreateInDB will create the strain record in the database.  An error is returned if the strain ID already exists.
-func (rs *StrainRepr) CreateInDB() error {
+func (rs *StrainRepr) CreateInDB(opts WriteOptions) error {
+	_, err := rs.writeInDB(true, opts)
+	return err
+}
+
+// ReplaceInDB will create or replace the strain record in the database, reporting whether it was created.
+func (rs *StrainRepr) ReplaceInDB(opts WriteOptions) (bool, error) {
+	return rs.writeInDB(false, opts)
+}
+
+// writeInDB writes the strain and its traits in a single transaction, along with a new revision of the strain.
+// The race and traits are written in canonical form.  A transaction which conflicts with a concurrent write is
+// retried, so that the last write wins as a whole.  When create is set the write fails if the strain already exists.
+// It reports whether the strain was created rather than replaced.
+func (rs *StrainRepr) writeInDB(create bool, opts WriteOptions) (bool, error) {
 	if rs.DB == nil {
-		return ErrDatabaseConnectionNil
+		return false, ErrDatabaseConnectionNil
 	}
-	var count int
-	rs.DB.Select("strain").Where("strain.reference_id = ?", rs.ID).Count(&count)
-	if count > 0 {
-		return ErrRecordAlreadyExists
+
+	normalized := rs.normalized()
+	for attempt := 1; ; attempt++ {
+		created, err := normalized.writeInTx(create, opts)
+		if err == nil || !isWriteConflict(err) || attempt >= maxWriteAttempts {
+			return created, err
+		}
+		log.WithError(err).Debugf("write of strain with ID %d conflicted, retrying", rs.ID)
+		time.Sleep(time.Duration(attempt) * writeRetryBackoff)
 	}
-	return rs.ReplaceInDB()
 }
 
-// ReplaceInDB will create or replace the strain record in the database.
-func (rs *StrainRepr) ReplaceInDB() error {
-	if rs.DB == nil {
-		return ErrDatabaseConnectionNil
+// writeInTx makes a single attempt at writing the strain in a transaction.
+func (rs *StrainRepr) writeInTx(create bool, opts WriteOptions) (bool, error) {
+	tx := rs.DB.Begin()
+	if tx.Error != nil {
+		return false, errors.Wrap(tx.Error, "unable to begin transaction")
 	}
+	defer tx.RollbackUnlessCommitted()
 
-	var flavors []Flavor
-	for _, flavor := range rs.Flavors {
-		f := Flavor{Name: flavor}
-		rs.DB.Model(&f).Where(&f).FirstOrCreate(&f)
-		flavors = append(flavors, f)
+	created, err := rs.saveInTx(tx, create, opts)
+	if err != nil {
+		return false, err
 	}
+	if err := tx.Commit().Error; err != nil {
+		return false, errors.Wrapf(err, "unable to commit record for strain with ID %d", rs.ID)
+	}
+	return created, nil
+}
 
-	var effects []Effect
-	for _, effect := range rs.Effects.Positive {
-		e := Effect{Name: effect, Category: "positive"}
-		rs.DB.Model(&e).Where(&e).FirstOrCreate(&e)
-		effects = append(effects, e)
+// saveInTx writes the strain, which must be in canonical form, in the transaction tx and leaves it to the caller to
+// commit.  It reports whether the strain was created, which includes bringing back a deleted strain.
+func (rs *StrainRepr) saveInTx(tx *gorm.DB, create bool, opts WriteOptions) (bool, error) {
+	s := Strain{DB: tx}
+	query := tx
+	if tx.Dialect().GetName() == DriverMySQL {
+		// lock the strain row so that concurrent writes of the same strain wait their turn
+		query = tx.Set("gorm:query_option", "FOR UPDATE")
 	}
-	for _, effect := range rs.Effects.Negative {
-		e := Effect{Name: effect, Category: "negative"}
-		rs.DB.Model(&e).Where(&e).FirstOrCreate(&e)
-		effects = append(effects, e)
+	// deleted strains are included, as writing over a deleted strain brings it back
+	err := query.Unscoped().Where("reference_id = ?", rs.ID).First(&s).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+	case err != nil:
+		return false, errors.Wrapf(err, "unable to get strain with ID %d", rs.ID)
+	case create && s.DeletedAt == nil:
+		return false, ErrRecordAlreadyExists
 	}
-	for _, effect := range rs.Effects.Medical {
-		e := Effect{Name: effect, Category: "medical"}
-		rs.DB.Model(&e).Where(&e).FirstOrCreate(&e)
-		effects = append(effects, e)
+	exists := err == nil && s.DeletedAt == nil
+	if err := opts.check(exists, s); err != nil {
+		return false, err
 	}
 
-	var s Strain
-	s.DB = rs.DB
-	s.ReferenceID = rs.ID
-	rs.DB.Model(&s).Where(&s).FirstOrCreate(&s)
+	traits := rs.ToStrain()
+	for i := range traits.Flavors {
+		f := &traits.Flavors[i]
+		if err := tx.Where(Flavor{Name: f.Name}).FirstOrCreate(f).Error; err != nil {
+			return false, errors.Wrapf(err, "unable to get or create flavor %s", f.Name)
+		}
+	}
+	for i := range traits.Effects {
+		e := &traits.Effects[i]
+		if err := tx.Where(Effect{Name: e.Name, Category: e.Category}).FirstOrCreate(e).Error; err != nil {
+			return false, errors.Wrapf(err, "unable to get or create %s effect %s", e.Category, e.Name)
+		}
+	}
 
 	// remove flavors that are present in the DB but not in our object
 	flavorsFromDB, err := s.FlavorsFromDBByRefID(rs.ID)
 	if err != nil {
-		return errors.Wrap(err, "unable to get flavors from database")
+		return false, errors.Wrap(err, "unable to get flavors from database")
 	}
-	for _, superfluousFlavor := range flavorsFromDB.Difference(flavors) {
-		_, err := rs.DB.Table("strain_flavors").
-			Delete("strain_flavors").
-			Joins("JOIN strain ON strain_flavors.strain_strain_id = strain.strain_id").
-			Joins("JOIN flavor ON strain_flavors.flavor_flavor_id = flavor.flavor_id").
-			Where("flavor.name = ? AND strain.reference_id = ?", superfluousFlavor.Name, s.ReferenceID).
-			Rows()
+	for _, superfluousFlavor := range flavorsFromDB.Difference(traits.Flavors) {
+		err := tx.Exec(
+			"DELETE FROM strain_flavors WHERE strain_strain_id = ? AND flavor_flavor_id IN (SELECT flavor_id FROM flavor WHERE name = ?)",
+			s.StrainID, superfluousFlavor.Name,
+		).Error
 		if err != nil {
-			return errors.Wrapf(err, "unable to delete superfluous strain_flavors for ID %d", rs.ID)
+			return false, errors.Wrapf(err, "unable to delete superfluous strain_flavors for ID %d", rs.ID)
 		}
 	}
 
 	// remove effects that are present in the DB but not in our object
 	effectsFromDB, err := s.EffectsFromDBByRefID(rs.ID)
 	if err != nil {
-		return errors.Wrap(err, "unable to get effects from database")
+		return false, errors.Wrap(err, "unable to get effects from database")
 	}
-	for _, superfluousEffect := range effectsFromDB.Difference(effects) {
-		_, err := rs.DB.Table("strain_effects").
-			Delete("strain_effects").
-			Joins("JOIN strain ON strain_effects.strain_strain_id = strain.strain_id").
-			Joins("JOIN effect ON strain_effects.effect_effect_id = effect.effect_id").
-			Where("effect.name = ? AND strain.reference_id = ?", superfluousEffect.Name, s.ReferenceID).
-			Rows()
+	for _, superfluousEffect := range effectsFromDB.Difference(traits.Effects) {
+		err := tx.Exec(
+			"DELETE FROM strain_effects WHERE strain_strain_id = ? AND effect_effect_id IN (SELECT effect_id FROM effect WHERE name = ? AND category = ?)",
+			s.StrainID, superfluousEffect.Name, superfluousEffect.Category,
+		).Error
 		if err != nil {
-			return errors.Wrapf(err, "unable to delete superfluous strain_effects for ID %d", rs.ID)
+			return false, errors.Wrapf(err, "unable to delete superfluous strain_effects for ID %d", rs.ID)
 		}
 	}
 
+	rev, err := newStrainRevision(*rs, opts)
+	if err != nil {
+		return false, err
+	}
+	if err := rev.CreateInDB(tx); err != nil {
+		return false, err
+	}
+
+	s.ReferenceID = rs.ID
 	s.Name = rs.Name
 	s.Race = rs.Race
-	s.Flavors = flavors
-	s.Effects = effects
+	s.Revision = rev.Revision
+	s.DeletedAt = nil
+	s.Flavors = traits.Flavors
+	s.Effects = traits.Effects
 
 	log.Debugf("updating record for strain %s with ID %d", s.Name, rs.ID)
-	if err := rs.DB.Model(&s).Save(&s).Error; err != nil {
-		return errors.Wrapf(err, "unable to save record for strain with ID %d", rs.ID)
+	// traits were written above, so only the strain and its join rows are saved here
+	if err := tx.Unscoped().Set("gorm:association_autoupdate", false).Save(&s).Error; err != nil {
+		return false, errors.Wrapf(err, "unable to save record for strain with ID %d", rs.ID)
+	}
+	return !exists, nil
+}
+
+// writeBulkInDB makes the writes in a single transaction, returning the outcome of each write.  If any write fails
+// the transaction is rolled back, and the writes which did not fail themselves fail with ErrBulkAborted.  A transaction which
+// conflicts with a concurrent write is retried as a whole.  The error returned separately is a failure of the
+// transaction, after which none of the writes were made.
+func writeBulkInDB(db *gorm.DB, writes []BulkWrite, opts WriteOptions) ([]BulkOutcome, error) {
+	if db == nil {
+		return nil, ErrDatabaseConnectionNil
+	}
+
+	for attempt := 1; ; attempt++ {
+		outcomes, err := writeBulkInTx(db, writes, opts)
+		if err == nil || !isWriteConflict(err) || attempt >= maxWriteAttempts {
+			return outcomes, err
+		}
+		log.WithError(err).Debugf("bulk write of %d strains conflicted, retrying", len(writes))
+		time.Sleep(time.Duration(attempt) * writeRetryBackoff)
+	}
+}
+
+// writeBulkInTx makes a single attempt at making the writes in a transaction.
+func writeBulkInTx(db *gorm.DB, writes []BulkWrite, opts WriteOptions) ([]BulkOutcome, error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return nil, errors.Wrap(tx.Error, "unable to begin transaction")
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	outcomes := make([]BulkOutcome, len(writes))
+	for i, w := range writes {
+		o := &outcomes[i]
+		switch w.Action {
+		case BulkCreate, BulkReplace:
+			repr := w.Strain.normalized()
+			o.Created, o.Err = repr.saveInTx(tx, w.Action == BulkCreate, opts)
+		case BulkDelete:
+			o.Err = deleteStrainInDB(tx, w.Strain.ID, opts)
+		default:
+			o.Err = errors.Errorf("unknown bulk action %s", w.Action)
+		}
+		if isWriteConflict(o.Err) {
+			return nil, o.Err
+		}
+	}
+	if abortBulk(outcomes) {
+		return outcomes, nil
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.Wrapf(err, "unable to commit bulk write of %d strains", len(writes))
+	}
+	return outcomes, nil
+}
+
+// PatchInDB applies patch to the strain with the given reference ID in a single transaction, along with a new
+// revision of the strain.  Only the columns and join rows of the traits which the patch changes are written.  A
+// transaction which conflicts with a concurrent write is retried, applying the patch to the strain as it is then.
+func (s *Strain) PatchInDB(id uint, patch Patch, opts WriteOptions) error {
+	if s.DB == nil {
+		return ErrDatabaseConnectionNil
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.patchInTx(id, patch, opts)
+		if err == nil || !isWriteConflict(err) || attempt >= maxWriteAttempts {
+			return err
+		}
+		log.WithError(err).Debugf("patch of strain with ID %d conflicted, retrying", id)
+		time.Sleep(time.Duration(attempt) * writeRetryBackoff)
+	}
+}
+
+// patchInTx makes a single attempt at patching the strain in a transaction.
+func (s *Strain) patchInTx(id uint, patch Patch, opts WriteOptions) error {
+	tx := s.DB.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "unable to begin transaction")
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	current := Strain{DB: tx}
+	query := tx
+	if tx.Dialect().GetName() == DriverMySQL {
+		// lock the strain row so that concurrent writes of the same strain wait their turn
+		query = tx.Set("gorm:query_option", "FOR UPDATE")
+	}
+	err := query.Where("reference_id = ?", id).First(&current).Error
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return ErrNotExists
+	case err != nil:
+		return errors.Wrapf(err, "unable to get strain with ID %d", id)
+	}
+	if err := opts.check(true, current); err != nil {
+		return err
+	}
+	if current.Flavors, err = current.FlavorsFromDBByRefID(id); err != nil {
+		return errors.Wrap(err, "unable to get flavors from database")
+	}
+	if current.Effects, err = current.EffectsFromDBByRefID(id); err != nil {
+		return errors.Wrap(err, "unable to get effects from database")
+	}
+
+	from := current.ToStrainRepr()
+	to, err := applyPatch(from, patch)
+	if err != nil {
+		return err
+	}
+	if changed, err := patchChanged(from, to); err != nil || !changed {
+		// compared with the strain as loaded, as its traits may not be in the order of its latest revision
+		return err
+	}
+	rev, err := newStrainRevision(to, opts)
+	if err != nil {
+		return err
+	}
+	if err := rev.CreateInDB(tx); err != nil {
+		return err
+	}
+	if rev.Revision == current.Revision {
+		// the patch changed nothing
+		return tx.Commit().Error
+	}
+
+	flavors := diffSet(from.Flavors, to.Flavors)
+	for _, name := range flavors.Removed {
+		err := tx.Exec(
+			"DELETE FROM strain_flavors WHERE strain_strain_id = ? AND flavor_flavor_id IN (SELECT flavor_id FROM flavor WHERE name = ?)",
+			current.StrainID, name,
+		).Error
+		if err != nil {
+			return errors.Wrapf(err, "unable to remove flavor %s from strain with ID %d", name, id)
+		}
+	}
+	for _, name := range flavors.Added {
+		f := Flavor{Name: name}
+		if err := tx.Where(f).FirstOrCreate(&f).Error; err != nil {
+			return errors.Wrapf(err, "unable to get or create flavor %s", name)
+		}
+		err := tx.Exec("INSERT INTO strain_flavors (strain_strain_id, flavor_flavor_id) VALUES (?, ?)", current.StrainID, f.FlavorID).Error
+		if err != nil {
+			return errors.Wrapf(err, "unable to add flavor %s to strain with ID %d", name, id)
+		}
+	}
+
+	for _, c := range []struct {
+		category string
+		change   SetChange
+	}{
+		{"positive", diffSet(from.Effects.Positive, to.Effects.Positive)},
+		{"negative", diffSet(from.Effects.Negative, to.Effects.Negative)},
+		{"medical", diffSet(from.Effects.Medical, to.Effects.Medical)},
+	} {
+		for _, name := range c.change.Removed {
+			err := tx.Exec(
+				"DELETE FROM strain_effects WHERE strain_strain_id = ? AND effect_effect_id IN (SELECT effect_id FROM effect WHERE name = ? AND category = ?)",
+				current.StrainID, name, c.category,
+			).Error
+			if err != nil {
+				return errors.Wrapf(err, "unable to remove %s effect %s from strain with ID %d", c.category, name, id)
+			}
+		}
+		for _, name := range c.change.Added {
+			e := Effect{Name: name, Category: c.category}
+			if err := tx.Where(e).FirstOrCreate(&e).Error; err != nil {
+				return errors.Wrapf(err, "unable to get or create %s effect %s", c.category, name)
+			}
+			err := tx.Exec("INSERT INTO strain_effects (strain_strain_id, effect_effect_id) VALUES (?, ?)", current.StrainID, e.EffectID).Error
+			if err != nil {
+				return errors.Wrapf(err, "unable to add %s effect %s to strain with ID %d", c.category, name, id)
+			}
+		}
+	}
+
+	err = tx.Exec("UPDATE strain SET name = ?, race = ?, revision = ?, updated_at = ? WHERE strain_id = ?",
+		to.Name, to.Race, rev.Revision, dbNow(), current.StrainID).Error
+	if err != nil {
+		return errors.Wrapf(err, "unable to update record for strain with ID %d", id)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrapf(err, "unable to commit patch of strain with ID %d", id)
 	}
 	return nil
 }
 
-// ParseStrain populates a StrainRepr from src.
+// isWriteConflict reports whether err was caused by a concurrent write, in which case the write can be retried.
+func isWriteConflict(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case *mysql.MySQLError:
+		return err.Number == mysqlErrDuplicateEntry || err.Number == mysqlErrLockWaitTimeout || err.Number == mysqlErrDeadlock
+	case sqlite3.Error:
+		return err.Code == sqlite3.ErrBusy || err.Code == sqlite3.ErrLocked ||
+			err.ExtendedCode == sqlite3.ErrConstraintUnique || err.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+// ParseStrain populates a StrainRepr from src.  Unknown fields and fields of the wrong type are returned as a
+// *ValidationError.  Use Validate to check the values of the fields.
 func ParseStrain(src io.Reader) (StrainRepr, error) {
-	var r StrainRepr
 	b, err := ioutil.ReadAll(src)
 	if err != nil {
-		return r, errors.Wrap(err, "unable to read strains")
+		return StrainRepr{}, errors.Wrap(err, "unable to read strain")
 	}
-
-	if err := json.Unmarshal(b, &r); err != nil {
-		return r, errors.Wrap(err, "unable to unmarshal strains")
+	r, err := unmarshalStrain(b)
+	if _, ok := err.(*ValidationError); err != nil && !ok {
+		return r, errors.Wrap(err, "unable to unmarshal strain")
 	}
-	return r, nil
+	return r, err
 }
 
-// ParseStrains populates a StrainReprs from src.
+// ParseStrains populates a StrainReprs from src.  Unknown fields and fields of the wrong type in any of the
+// strains are returned together as a *ValidationError, with each field prefixed by the index of its strain.
 func ParseStrains(src io.Reader) (StrainReprs, error) {
 	var r StrainReprs
 	b, err := ioutil.ReadAll(src)
@@ -519,10 +1068,23 @@ func ParseStrains(src io.Reader) (StrainReprs, error) {
 		return r, errors.Wrap(err, "unable to read strains")
 	}
 
-	if err := json.Unmarshal(b, &r); err != nil {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
 		return r, errors.Wrap(err, "unable to unmarshal strains")
 	}
-	return r, nil
+	verr := &ValidationError{}
+	for i, rb := range raw {
+		repr, err := unmarshalStrain(rb)
+		if parseErr, ok := err.(*ValidationError); ok {
+			for _, f := range parseErr.Fields {
+				verr.Add(fmt.Sprintf("[%d].%s", i, f.Field), "%s", f.Message)
+			}
+		} else if err != nil {
+			return r, errors.Wrapf(err, "unable to unmarshal strain at index %d", i)
+		}
+		r = append(r, repr)
+	}
+	return r, verr.Err()
 }
 
 func (rs *StrainRepr) Write(w io.Writer) {
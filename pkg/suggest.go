@@ -0,0 +1,272 @@
+package tms
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidSuggestKind = errors.New("kind must be one of name, flavor or effect")
+
+// SuggestKind is the kind of vocabulary a suggestion is taken from.
+type SuggestKind string
+
+const (
+	SuggestName   SuggestKind = "name"
+	SuggestFlavor SuggestKind = "flavor"
+	SuggestEffect SuggestKind = "effect"
+)
+
+// Suggestion is a strain name, flavor or effect which starts with what was typed so far.
+type Suggestion struct {
+	Kind SuggestKind `json:"kind"`
+	Text string      `json:"text"`
+}
+
+// suggestEntry is a suggestion in the index, keyed on its lower case text so that suggestions are found whatever
+// case is typed.
+type suggestEntry struct {
+	key string
+	Suggestion
+}
+
+// less orders entries by key, then text, then kind.
+func (e suggestEntry) less(o suggestEntry) bool {
+	if e.key != o.key {
+		return e.key < o.key
+	}
+	if e.Text != o.Text {
+		return e.Text < o.Text
+	}
+	return e.Kind < o.Kind
+}
+
+// SuggestIndex is an in-process prefix index of strain names, flavors and effects, for suggestions as a user types.
+// Entries are kept sorted so that the suggestions for a prefix are found with a binary search.  Each entry is
+// counted once for every strain which uses it, and is removed once no strain uses it any more.  SuggestIndex is safe
+// for concurrent use.
+type SuggestIndex struct {
+	mu      sync.RWMutex
+	entries []suggestEntry
+	// refs counts the strains which use each entry, plus the times it was added on its own.
+	refs map[suggestEntry]int
+	// strains holds the entries used by each strain, keyed on its reference ID.
+	strains map[uint][]suggestEntry
+}
+
+// NewSuggestIndex creates an empty SuggestIndex.
+func NewSuggestIndex() *SuggestIndex {
+	return &SuggestIndex{
+		refs:    make(map[suggestEntry]int),
+		strains: make(map[uint][]suggestEntry),
+	}
+}
+
+// LoadFromDB puts the name, flavors and effects of every strain in the database in the index.
+func (idx *SuggestIndex) LoadFromDB(db *gorm.DB) error {
+	if db == nil {
+		return ErrDatabaseConnectionNil
+	}
+
+	loaded := make(map[uint][]suggestEntry)
+	for _, src := range []struct {
+		kind  SuggestKind
+		query string
+	}{
+		{SuggestName, "SELECT s.reference_id, s.name FROM strain s WHERE s.deleted_at IS NULL"},
+		{SuggestFlavor, "SELECT s.reference_id, f.name FROM strain s JOIN strain_flavors sf ON sf.strain_strain_id = s.strain_id JOIN flavor f ON f.flavor_id = sf.flavor_flavor_id WHERE s.deleted_at IS NULL"},
+		{SuggestEffect, "SELECT s.reference_id, e.name FROM strain s JOIN strain_effects se ON se.strain_strain_id = s.strain_id JOIN effect e ON e.effect_id = se.effect_effect_id WHERE s.deleted_at IS NULL"},
+	} {
+		rows, err := db.Raw(src.query).Rows()
+		if err != nil {
+			return errors.Wrapf(err, "unable to get %s vocabulary from DB", src.kind)
+		}
+		for rows.Next() {
+			var id uint
+			var text string
+			if err := rows.Scan(&id, &text); err != nil {
+				rows.Close()
+				return errors.Wrapf(err, "error scanning %s vocabulary", src.kind)
+			}
+			loaded[id] = append(loaded[id], newSuggestEntry(src.kind, text))
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s vocabulary", src.kind)
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for id, entries := range loaded {
+		idx.release(id)
+		idx.hold(id, entries)
+	}
+	// sorting everything at once is much faster than adding entries one at a time
+	idx.entries = idx.entries[:0]
+	for e := range idx.refs {
+		idx.entries = append(idx.entries, e)
+	}
+	sort.Slice(idx.entries, func(i, j int) bool {
+		return idx.entries[i].less(idx.entries[j])
+	})
+	return nil
+}
+
+// Add adds the text to the index, unless it is blank.  Text added this way is never removed.
+func (idx *SuggestIndex) Add(kind SuggestKind, text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e := newSuggestEntry(kind, text)
+	idx.refs[e]++
+	idx.insert(e)
+}
+
+// Put adds the name, flavors and effects of the strain to the index, replacing those of the strain if it is already
+// indexed.
+func (idx *SuggestIndex) Put(repr StrainRepr) {
+	entries := []suggestEntry{newSuggestEntry(SuggestName, repr.Name)}
+	for _, f := range repr.Flavors {
+		entries = append(entries, newSuggestEntry(SuggestFlavor, f))
+	}
+	for _, effects := range [][]string{repr.Effects.Positive, repr.Effects.Negative, repr.Effects.Medical} {
+		for _, e := range effects {
+			entries = append(entries, newSuggestEntry(SuggestEffect, e))
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	removed := idx.release(repr.ID)
+	for _, e := range idx.hold(repr.ID, entries) {
+		idx.insert(e)
+	}
+	for _, e := range removed {
+		if idx.refs[e] == 0 {
+			idx.delete(e)
+		}
+	}
+}
+
+// Remove removes the name, flavors and effects of the strain with the given reference ID from the index, unless
+// another strain uses them too.
+func (idx *SuggestIndex) Remove(id uint) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, e := range idx.release(id) {
+		idx.delete(e)
+	}
+}
+
+// hold counts the entries, skipping blank and repeated ones, as used by the strain with the given reference ID, which
+// must not use any yet.  It returns the entries which nothing used before.  The caller must hold the write lock.
+func (idx *SuggestIndex) hold(id uint, entries []suggestEntry) []suggestEntry {
+	var held, added []suggestEntry
+	for _, e := range entries {
+		if strings.TrimSpace(e.Text) == "" || containsEntry(held, e) {
+			continue
+		}
+		held = append(held, e)
+		idx.refs[e]++
+		if idx.refs[e] == 1 {
+			added = append(added, e)
+		}
+	}
+	if len(held) > 0 {
+		idx.strains[id] = held
+	}
+	return added
+}
+
+// release stops counting the entries used by the strain with the given reference ID.  It returns the entries which
+// nothing uses any more.  The caller must hold the write lock.
+func (idx *SuggestIndex) release(id uint) []suggestEntry {
+	var unused []suggestEntry
+	for _, e := range idx.strains[id] {
+		idx.refs[e]--
+		if idx.refs[e] == 0 {
+			delete(idx.refs, e)
+			unused = append(unused, e)
+		}
+	}
+	delete(idx.strains, id)
+	return unused
+}
+
+// insert inserts an entry in order, unless it is already there.  The caller must hold the write lock.
+func (idx *SuggestIndex) insert(e suggestEntry) {
+	i := idx.search(e)
+	if i < len(idx.entries) && idx.entries[i] == e {
+		return
+	}
+	idx.entries = append(idx.entries, suggestEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = e
+}
+
+// delete deletes an entry, if it is there.  The caller must hold the write lock.
+func (idx *SuggestIndex) delete(e suggestEntry) {
+	i := idx.search(e)
+	if i < len(idx.entries) && idx.entries[i] == e {
+		idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+	}
+}
+
+// search finds the index at which the entry is, or would be inserted.  The caller must hold the lock.
+func (idx *SuggestIndex) search(e suggestEntry) int {
+	return sort.Search(len(idx.entries), func(i int) bool {
+		return !idx.entries[i].less(e)
+	})
+}
+
+// Suggest gets up to limit suggestions of the given kinds which start with prefix in any case, in alphabetical
+// order.  Suggestions of every kind are made if no kinds are given.
+func (idx *SuggestIndex) Suggest(prefix string, kinds []SuggestKind, limit int) []Suggestion {
+	key := strings.ToLower(prefix)
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	suggestions := []Suggestion{}
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return idx.entries[i].key >= key
+	})
+	for ; i < len(idx.entries) && len(suggestions) < limit; i++ {
+		e := idx.entries[i]
+		if !strings.HasPrefix(e.key, key) {
+			break
+		}
+		if len(kinds) > 0 && !containsKind(kinds, e.Kind) {
+			continue
+		}
+		suggestions = append(suggestions, e.Suggestion)
+	}
+	return suggestions
+}
+
+func newSuggestEntry(kind SuggestKind, text string) suggestEntry {
+	return suggestEntry{key: strings.ToLower(text), Suggestion: Suggestion{Kind: kind, Text: text}}
+}
+
+func containsEntry(entries []suggestEntry, e suggestEntry) bool {
+	for _, o := range entries {
+		if o == e {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKind(kinds []SuggestKind, kind SuggestKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
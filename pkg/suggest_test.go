@@ -0,0 +1,95 @@
+package tms
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSuggesting(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	idx := NewSuggestIndex()
+	for _, repr := range searchableStrains() {
+		idx.Put(repr)
+	}
+	idx.Put(StrainRepr{Name: "Earthquake", Flavors: []string{"earthy", ""}})
+
+	tests := []struct {
+		name   string
+		prefix string
+		kinds  []SuggestKind
+		limit  int
+		exp    []Suggestion
+	}{
+		{"any_case", "EAR", nil, 10, []Suggestion{
+			{SuggestName, "Earthquake"}, {SuggestFlavor, "Earthy"}, {SuggestFlavor, "earthy"},
+		}},
+		{"kind", "ear", []SuggestKind{SuggestName}, 10, []Suggestion{{SuggestName, "Earthquake"}}},
+		{"limit", "ear", nil, 1, []Suggestion{{SuggestName, "Earthquake"}}},
+		{"repeated_vocabulary", "ins", nil, 10, []Suggestion{{SuggestEffect, "Insomnia"}}},
+		{"whole_word", "pine", nil, 10, []Suggestion{{SuggestFlavor, "Pine"}}},
+		{"no_match", "xyz", nil, 10, []Suggestion{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(tt.exp, idx.Suggest(tt.prefix, tt.kinds, tt.limit))
+		})
+	}
+}
+
+func TestIndexedStoreKeepsVocabularyCurrent(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	idx := NewSuggestIndex()
+	store := NewIndexedStore(NewMemoryStore(), idx)
+	assert.Nil(store.CreateStrain(StrainRepr{ID: 1, Name: "Afpak", Flavors: []string{"Earthy"}}, WriteOptions{}))
+	_, err := store.ReplaceStrain(StrainRepr{ID: 1, Name: "Afpak", Flavors: []string{"Earl Grey"}}, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]Suggestion{{SuggestFlavor, "Earl Grey"}}, idx.Suggest("ear", nil, 10))
+	patch := mustParsePatch(t, JSONPatchContentType, `[{"op":"add","path":"/flavors/-","value":"early bloom"}]`)
+	assert.Nil(store.PatchStrain(1, patch, WriteOptions{}))
+	assert.Equal([]Suggestion{{SuggestFlavor, "Earl Grey"}, {SuggestFlavor, "Early Bloom"}}, idx.Suggest("ear", nil, 10))
+
+	// failed writes change nothing
+	assert.Equal(ErrRecordAlreadyExists, store.CreateStrain(StrainRepr{ID: 1, Name: "Afghani"}, WriteOptions{}))
+	assert.Equal([]Suggestion{{SuggestName, "Afpak"}}, idx.Suggest("af", nil, 10))
+
+	// vocabulary is kept while any strain uses it
+	afghani := StrainRepr{ID: 2, Name: "Afghani", Flavors: []string{"Earl Grey"}}
+	afghani.Effects.Positive = []string{"Sleepy"}
+	afghani.Effects.Medical = []string{"Sleepy"}
+	assert.Nil(store.CreateStrain(afghani, WriteOptions{}))
+	assert.Nil(store.DeleteStrain(1, WriteOptions{}))
+	assert.Equal([]Suggestion{{SuggestName, "Afghani"}}, idx.Suggest("af", nil, 10))
+	assert.Equal([]Suggestion{{SuggestFlavor, "Earl Grey"}}, idx.Suggest("ear", nil, 10))
+	assert.Nil(store.RestoreStrain(1))
+	assert.Equal([]Suggestion{{SuggestName, "Afghani"}, {SuggestName, "Afpak"}}, idx.Suggest("af", nil, 10))
+	outcomes, err := store.WriteStrains([]BulkWrite{
+		{Action: BulkDelete, Strain: StrainRepr{ID: 1}},
+		{Action: BulkDelete, Strain: StrainRepr{ID: 2}},
+	}, BulkAtomic, WriteOptions{})
+	assert.Nil(err)
+	assert.Equal([]BulkOutcome{{}, {}}, outcomes)
+	assert.Empty(idx.Suggest("", nil, 10))
+
+	// vocabulary added on its own stays
+	idx.Add(SuggestFlavor, "Earthy")
+	idx.Put(StrainRepr{ID: 3, Name: "Earthquake", Flavors: []string{"Earthy"}})
+	idx.Remove(3)
+	assert.Equal([]Suggestion{{SuggestFlavor, "Earthy"}}, idx.Suggest("ear", nil, 10))
+}
+
+func BenchmarkSuggesting(b *testing.B) {
+	idx := NewSuggestIndex()
+	for i := 0; i < 50000; i++ {
+		idx.Add(SuggestName, fmt.Sprintf("strain %d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Suggest("strain 12", nil, DefaultSuggestions)
+	}
+}
@@ -0,0 +1,216 @@
+package tms
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on the length of the text of a strain, which match the size of the database columns.
+const (
+	MaxNameLength  = 255
+	MaxTraitLength = 255
+)
+
+// Races are the races a strain can be.
+var Races = []string{"indica", "sativa", "hybrid"}
+
+var (
+	// strainFields are the fields of the JSON representation of a strain which clients write.  deleted_at is only
+	// ever written by the server.
+	strainFields = map[string]bool{"name": true, "id": true, "race": true, "flavors": true, "effects": true}
+	// effectFields are the fields of the effects of a strain, one for each category.
+	effectFields = map[string]bool{"positive": true, "negative": true, "medical": true}
+)
+
+// FieldError is a problem with one field of a strain.
+type FieldError struct {
+	// Field is the path to the field in the JSON representation of the strain, such as name or effects.medical[1].
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found with a strain.
+type ValidationError struct {
+	Fields []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		problems = append(problems, f.Field+" "+f.Message)
+	}
+	return "invalid strain: " + strings.Join(problems, "; ")
+}
+
+// Add records a problem with the field.
+func (e *ValidationError) Add(field, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Merge records the problems of err, which is a *ValidationError or nil, leaving out problems with fields which
+// already have one.  Any other error is returned as it is.
+func (e *ValidationError) Merge(err error) error {
+	if err == nil {
+		return nil
+	}
+	other, ok := err.(*ValidationError)
+	if !ok {
+		return err
+	}
+	for _, f := range other.Fields {
+		if !e.has(f.Field) {
+			e.Fields = append(e.Fields, f)
+		}
+	}
+	return nil
+}
+
+// Err returns the error if it has any problems, and nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) has(field string) bool {
+	for _, f := range e.Fields {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the strain can be stored, returning a *ValidationError listing every problem with it.  The ID
+// and name are required, the race must be one of Races if it is given, and flavors and effects must not be blank
+// or repeat each other within their list once in canonical form.
+func (rs StrainRepr) Validate() error {
+	verr := &ValidationError{}
+	if rs.ID == 0 {
+		verr.Add("id", "is required")
+	}
+	switch {
+	case strings.TrimSpace(rs.Name) == "":
+		verr.Add("name", "is required")
+	case utf8.RuneCountInString(rs.Name) > MaxNameLength:
+		verr.Add("name", "must be at most %d characters", MaxNameLength)
+	}
+	if rs.Race != "" && !contains(Races, CanonicalRace(rs.Race)) {
+		verr.Add("race", "must be one of %s, %s or %s", Races[0], Races[1], Races[2])
+	}
+	validateTraits(verr, "flavors", rs.Flavors)
+	validateTraits(verr, "effects.positive", rs.Effects.Positive)
+	validateTraits(verr, "effects.negative", rs.Effects.Negative)
+	validateTraits(verr, "effects.medical", rs.Effects.Medical)
+	return verr.Err()
+}
+
+// validateTraits records the problems with a list of flavors or effects.
+func validateTraits(verr *ValidationError, field string, traits []string) {
+	seen := make(map[string]int)
+	for i, t := range traits {
+		path := fmt.Sprintf("%s[%d]", field, i)
+		canonical := CanonicalTrait(t)
+		switch first, repeated := seen[canonical]; {
+		case canonical == "":
+			verr.Add(path, "must not be blank")
+		case utf8.RuneCountInString(canonical) > MaxTraitLength:
+			verr.Add(path, "must be at most %d characters", MaxTraitLength)
+		case repeated:
+			verr.Add(path, "repeats %s[%d]", field, first)
+		default:
+			seen[canonical] = i
+		}
+	}
+}
+
+// unmarshalStrain unmarshals the JSON representation of a strain.  Unknown fields and fields of the wrong type are
+// returned as a *ValidationError, and any other error if b is not valid JSON.
+func unmarshalStrain(b []byte) (StrainRepr, error) {
+	var repr StrainRepr
+	verr := &ValidationError{}
+	if err := json.Unmarshal(b, &repr); err != nil {
+		typeErr, ok := err.(*json.UnmarshalTypeError)
+		if !ok {
+			return repr, err
+		}
+		if typeErr.Field == "" {
+			verr.Add("strain", "must be %s", jsonTypeName(typeErr.Type))
+		}
+	}
+
+	// fields are unmarshaled again one at a time, as json.Unmarshal only reports the first of the wrong type
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(b, &fields) == nil {
+		for name, value := range fields {
+			if !strainFields[name] {
+				verr.Add(name, "is not a field of a strain")
+				continue
+			}
+			var effects map[string]json.RawMessage
+			if name != "effects" || json.Unmarshal(value, &effects) != nil {
+				addTypeError(verr, map[string]json.RawMessage{name: value})
+				continue
+			}
+			for category, v := range effects {
+				if !effectFields[category] {
+					verr.Add("effects."+category, "is not a category of effect")
+					continue
+				}
+				addTypeError(verr, map[string]map[string]json.RawMessage{"effects": {category: v}})
+			}
+		}
+	}
+	// map order is random, so problems are sorted to report them the same way every time
+	sort.SliceStable(verr.Fields, func(i, j int) bool {
+		return verr.Fields[i].Field < verr.Fields[j].Field
+	})
+	return repr, verr.Err()
+}
+
+// addTypeError records a problem with the field of doc, a strain with the one field, if it is of the wrong type.
+func addTypeError(verr *ValidationError, doc interface{}) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	if typeErr, ok := json.Unmarshal(b, &StrainRepr{}).(*json.UnmarshalTypeError); ok {
+		verr.Add(fieldPath(typeErr.Field), "must be %s", jsonTypeName(typeErr.Type))
+	}
+}
+
+// fieldPath rewrites a field as encoding/json names it, such as effects.medical.1, with the indexes of lists in
+// brackets as in effects.medical[1].
+func fieldPath(field string) string {
+	parts := strings.Split(field, ".")
+	path := parts[0]
+	for _, p := range parts[1:] {
+		if _, err := strconv.Atoi(p); err == nil {
+			path += "[" + p + "]"
+		} else {
+			path += "." + p
+		}
+	}
+	return path
+}
+
+// jsonTypeName describes a type as it appears in JSON.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number of at least zero"
+	case reflect.Slice:
+		return "a list of " + strings.TrimPrefix(strings.TrimPrefix(jsonTypeName(t.Elem()), "a "), "an ") + "s"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return "a " + t.String()
+}
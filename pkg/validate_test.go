@@ -0,0 +1,122 @@
+package tms
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidatingStrain(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	valid := func() StrainRepr {
+		repr := StrainRepr{ID: 1, Name: "Afpak", Race: "Indica", Flavors: []string{"Earthy", "Pine"}}
+		repr.Effects.Positive = []string{"Relaxed"}
+		repr.Effects.Medical = []string{"Relaxed"}
+		return repr
+	}
+	tests := []struct {
+		name   string
+		change func(*StrainRepr)
+		exp    []FieldError
+	}{
+		{"valid", func(*StrainRepr) {}, nil},
+		{"no_race", func(rs *StrainRepr) { rs.Race = "" }, nil},
+		{"required", func(rs *StrainRepr) { rs.ID = 0; rs.Name = "  " }, []FieldError{
+			{"id", "is required"},
+			{"name", "is required"},
+		}},
+		{"unknown_race", func(rs *StrainRepr) { rs.Race = "sativia" }, []FieldError{
+			{"race", "must be one of indica, sativa or hybrid"},
+		}},
+		{"long_name", func(rs *StrainRepr) { rs.Name = strings.Repeat("é", MaxNameLength+1) }, []FieldError{
+			{"name", "must be at most 255 characters"},
+		}},
+		{"traits", func(rs *StrainRepr) {
+			rs.Flavors = []string{"Earthy", "", " earthy", strings.Repeat("x", MaxTraitLength+1)}
+			rs.Effects.Negative = []string{"Dry Mouth", "dry mouth"}
+		}, []FieldError{
+			{"flavors[1]", "must not be blank"},
+			{"flavors[2]", "repeats flavors[0]"},
+			{"flavors[3]", "must be at most 255 characters"},
+			{"effects.negative[1]", "repeats effects.negative[0]"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repr := valid()
+			tt.change(&repr)
+			err := repr.Validate()
+			if tt.exp == nil {
+				assert.Nil(err)
+				return
+			}
+			if assert.IsType(&ValidationError{}, err) {
+				assert.Equal(tt.exp, err.(*ValidationError).Fields)
+			}
+		})
+	}
+	assert.EqualError(&ValidationError{Fields: []FieldError{{"id", "is required"}, {"race", "must be hybrid"}}},
+		"invalid strain: id is required; race must be hybrid")
+}
+
+func TestParsingStrainReportsFieldProblems(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		name   string
+		json   string
+		exp    []FieldError
+		expErr bool
+	}{
+		{"valid", `{"name":"Afpak","id":1,"effects":{"medical":["Pain"]}}`, nil, false},
+		{"unknown_fields", `{"name":"Afpak","id":1,"colour":"green","effects":{"psychedelic":["Giggly"]},"aroma":[]}`,
+			[]FieldError{
+				{"aroma", "is not a field of a strain"},
+				{"colour", "is not a field of a strain"},
+				{"effects.psychedelic", "is not a category of effect"},
+			}, false},
+		{"wrong_type", `{"name":"Afpak","id":-1}`, []FieldError{{"id", "must be a whole number of at least zero"}}, false},
+		{"wrong_list_type", `{"name":"Afpak","flavors":"Pine"}`, []FieldError{{"flavors", "must be a list of strings"}}, false},
+		{"many_wrong_types", `{"name":7,"id":-1,"flavors":"Pine","effects":{"positive":"Happy","medical":["Pain",1]}}`,
+			[]FieldError{
+				{"effects.medical[1]", "must be a string"},
+				{"effects.positive", "must be a list of strings"},
+				{"flavors", "must be a list of strings"},
+				{"id", "must be a whole number of at least zero"},
+				{"name", "must be a string"},
+			}, false},
+		{"not_an_object", `["Afpak"]`, []FieldError{{"strain", "must be an object"}}, false},
+		{"deleted_at", `{"name":"Afpak","deleted_at":"2020-01-01T00:00:00Z"}`, []FieldError{{"deleted_at", "is not a field of a strain"}}, false},
+		{"malformed", `{"name":"Afpak",`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseStrain(bytes.NewBufferString(tt.json))
+			switch {
+			case tt.expErr:
+				_, isValidation := err.(*ValidationError)
+				assert.NotNil(err)
+				assert.False(isValidation, "malformed JSON is not a validation error")
+			case tt.exp == nil:
+				assert.Nil(err)
+			default:
+				if assert.IsType(&ValidationError{}, err) {
+					assert.Equal(tt.exp, err.(*ValidationError).Fields)
+				}
+			}
+		})
+	}
+
+	// problems with many strains are reported together, each prefixed by the index of its strain
+	reprs, err := ParseStrains(bytes.NewBufferString(`[{"name":"a","id":1},{"name":"b","id":2,"colour":"green"}]`))
+	if assert.IsType(&ValidationError{}, err) {
+		assert.Equal([]FieldError{{"[1].colour", "is not a field of a strain"}}, err.(*ValidationError).Fields)
+	}
+	assert.Len(reprs, 2)
+}
@@ -0,0 +1,225 @@
+package tms
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// minorWords are kept lower case in the middle of canonical flavors and effects, as in "Lack of Appetite".
+var minorWords = map[string]bool{
+	"a": true, "an": true, "and": true, "at": true, "by": true, "for": true, "in": true,
+	"of": true, "on": true, "or": true, "the": true, "to": true, "with": true,
+}
+
+// CanonicalRace gets the canonical form of a race, trimmed and in lower case, as races are stored and matched.
+func CanonicalRace(race string) string {
+	return strings.ToLower(canonicalText(race))
+}
+
+// CanonicalTrait gets the canonical form of a flavor or effect, as they are stored and matched.  Each word is
+// capitalized except for minor words after the first, and the letters after a slash, hyphen or parenthesis are
+// capitalized too, so "spicy/herbal" becomes "Spicy/Herbal".  Parts of words written all in capitals, such as
+// "PTSD" or "ADD/ADHD", are acronyms and are kept as written.
+func CanonicalTrait(trait string) string {
+	words := strings.Fields(canonicalText(trait))
+	for i, w := range words {
+		if i > 0 && minorWords[strings.ToLower(w)] && !isAcronym([]rune(w)) {
+			words[i] = strings.ToLower(w)
+			continue
+		}
+		runes := []rune(w)
+		start := 0
+		for j := 0; j <= len(runes); j++ {
+			if j < len(runes) && runes[j] != '/' && runes[j] != '-' && runes[j] != '(' {
+				continue
+			}
+			if part := runes[start:j]; len(part) > 0 && !isAcronym(part) {
+				for k := range part {
+					part[k] = unicode.ToLower(part[k])
+				}
+				part[0] = unicode.ToUpper(part[0])
+			}
+			start = j + 1
+		}
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// isAcronym reports whether the part of a word has at least two letters and every letter is upper case.
+func isAcronym(part []rune) bool {
+	letters := 0
+	for _, r := range part {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 2
+}
+
+// canonicalText trims the text, collapses runs of whitespace to a single space and composes accented letters, in
+// Unicode normalization form C.
+func canonicalText(text string) string {
+	return norm.NFC.String(strings.Join(strings.Fields(text), " "))
+}
+
+// normalized returns the strain with its race, flavors and effects in canonical form.  Blank traits are dropped,
+// as are traits which repeat another once in canonical form.
+func (rs StrainRepr) normalized() StrainRepr {
+	rs.Race = CanonicalRace(rs.Race)
+	rs.Flavors = canonicalTraits(rs.Flavors)
+	rs.Effects.Positive = canonicalTraits(rs.Effects.Positive)
+	rs.Effects.Negative = canonicalTraits(rs.Effects.Negative)
+	rs.Effects.Medical = canonicalTraits(rs.Effects.Medical)
+	return rs
+}
+
+// canonicalTraits gets the distinct canonical forms of the traits, keeping their order.  A nil slice stays nil.
+func canonicalTraits(traits []string) []string {
+	if traits == nil {
+		return nil
+	}
+	canonical := []string{}
+	for _, t := range traits {
+		if c := CanonicalTrait(t); c != "" && !contains(canonical, c) {
+			canonical = append(canonical, c)
+		}
+	}
+	return canonical
+}
+
+// canonicalizeVocabulary rewrites every race, flavor and effect in the database in the canonical form of migration 5.  Flavors, and
+// effects in the same category, which are the same once in canonical form are merged into the one with the lowest
+// ID, and strains which had the others are given it instead.
+func canonicalizeVocabulary(tx *gorm.DB) error {
+	rows, err := tx.Raw("SELECT DISTINCT race FROM strain WHERE race IS NOT NULL").Rows()
+	if err != nil {
+		return errors.Wrap(err, "unable to get races")
+	}
+	var races []string
+	for rows.Next() {
+		var race string
+		if err := rows.Scan(&race); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error scanning race")
+		}
+		races = append(races, race)
+	}
+	rows.Close()
+	for _, race := range races {
+		if c := migration5Race(race); c != race {
+			if err := tx.Exec("UPDATE strain SET race = ? WHERE race = ?", c, race).Error; err != nil {
+				return errors.Wrapf(err, "unable to rewrite race %s", race)
+			}
+		}
+	}
+
+	if err := mergeTraits(tx, "flavor", "SELECT flavor_id, name, '' FROM flavor ORDER BY flavor_id"); err != nil {
+		return err
+	}
+	return mergeTraits(tx, "effect", "SELECT effect_id, name, category FROM effect ORDER BY effect_id")
+}
+
+// mergeTraits rewrites the names of the flavors or effects found by query in the canonical form of migration 5,
+// merging those which are then the same.  query selects the ID, name and category of every trait in order of ID.
+func mergeTraits(tx *gorm.DB, trait, query string) error {
+	join := "strain_" + trait + "s"
+	idColumn := trait + "_id"
+	joinColumn := trait + "_" + idColumn
+
+	type traitRow struct {
+		id             uint
+		name, category string
+	}
+	rows, err := tx.Raw(query).Rows()
+	if err != nil {
+		return errors.Wrapf(err, "unable to get %ss", trait)
+	}
+	var traits []traitRow
+	for rows.Next() {
+		var t traitRow
+		if err := rows.Scan(&t.id, &t.name, &t.category); err != nil {
+			rows.Close()
+			return errors.Wrapf(err, "error scanning %s", trait)
+		}
+		traits = append(traits, t)
+	}
+	rows.Close()
+
+	// kept holds the trait each canonical name and category is merged into
+	kept := make(map[[2]string]traitRow)
+	var renamed []traitRow
+	for _, t := range traits {
+		key := [2]string{migration5Trait(t.name), t.category}
+		keep, ok := kept[key]
+		if !ok {
+			kept[key] = t
+			if key[0] != t.name {
+				renamed = append(renamed, traitRow{t.id, key[0], t.category})
+			}
+			continue
+		}
+		// the derived table stops MySQL rejecting a subquery on the table being updated
+		err := tx.Exec(fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s = ? WHERE %[2]s = ? AND strain_strain_id NOT IN "+
+				"(SELECT strain_strain_id FROM (SELECT strain_strain_id FROM %[1]s WHERE %[2]s = ?) AS kept)",
+			join, joinColumn), keep.id, t.id, keep.id).Error
+		if err != nil {
+			return errors.Wrapf(err, "unable to merge %s %s into %s", trait, t.name, keep.name)
+		}
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", join, joinColumn), t.id).Error; err != nil {
+			return errors.Wrapf(err, "unable to delete merged %s %s from strains", trait, t.name)
+		}
+		if err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", trait, idColumn), t.id).Error; err != nil {
+			return errors.Wrapf(err, "unable to delete merged %s %s", trait, t.name)
+		}
+	}
+
+	// names are only rewritten once every duplicate is gone, so that they stay unique
+	for _, t := range renamed {
+		if err := tx.Exec(fmt.Sprintf("UPDATE %s SET name = ? WHERE %s = ?", trait, idColumn), t.name, t.id).Error; err != nil {
+			return errors.Wrapf(err, "unable to rewrite %s %s", trait, t.name)
+		}
+	}
+	return nil
+}
+
+// migration5Race, migration5Trait and migration5Text are the canonical forms as migration 5 shipped them.  They are
+// frozen here so that the migration rewrites every database the same way, whatever CanonicalRace and
+// CanonicalTrait later become.
+func migration5Race(race string) string {
+	return strings.ToLower(migration5Text(race))
+}
+
+func migration5Trait(trait string) string {
+	words := strings.Fields(strings.ToLower(migration5Text(trait)))
+	for i, w := range words {
+		if i > 0 && migration5MinorWords[w] {
+			continue
+		}
+		runes := []rune(w)
+		for j := range runes {
+			if j == 0 || runes[j-1] == '/' || runes[j-1] == '-' || runes[j-1] == '(' {
+				runes[j] = unicode.ToUpper(runes[j])
+			}
+		}
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+func migration5Text(text string) string {
+	return norm.NFC.String(strings.Join(strings.Fields(text), " "))
+}
+
+var migration5MinorWords = map[string]bool{
+	"a": true, "an": true, "and": true, "at": true, "by": true, "for": true, "in": true,
+	"of": true, "on": true, "or": true, "the": true, "to": true, "with": true,
+}
@@ -0,0 +1,87 @@
+package tms
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCanonicalVocabulary(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	traits := []struct {
+		trait string
+		exp   string
+	}{
+		{"Earthy", "Earthy"},
+		{"earthy", "Earthy"},
+		{" eaRTHy\t", "Earthy"},
+		{"tree  fruit", "Tree Fruit"},
+		{"lack of appetite", "Lack of Appetite"},
+		{"of mice", "Of Mice"},
+		{"spicy/herbal", "Spicy/Herbal"},
+		{"sour-diesel", "Sour-Diesel"},
+		{"cre\u0300me bru\u0302le\u0301e", "Cr\u00e8me Br\u00fbl\u00e9e"},
+		{"pho\u031b\u0300", "Ph\u1edd"},
+		{"PTSD", "PTSD"},
+		{"ptsd", "Ptsd"},
+		{"ADD/ADHD", "ADD/ADHD"},
+		{"high CBD", "High CBD"},
+		{"THC-free", "THC-Free"},
+		{"relief FROM pain", "Relief FROM Pain"},
+		{"lack OF appetite", "Lack OF Appetite"},
+		{"vitamin c", "Vitamin C"},
+		{"pain (CHRONIC)", "Pain (CHRONIC)"},
+		{"  ", ""},
+	}
+	for _, tt := range traits {
+		assert.Equal(tt.exp, CanonicalTrait(tt.trait), tt.trait)
+	}
+
+	assert.Equal("sativa", CanonicalRace(" Sativa "))
+	assert.Equal("caf\u00e9", canonicalText("cafe\u0301"))
+	assert.Equal("x\u0301", canonicalText("x\u0301"), "letters without a composed form are left alone")
+}
+
+func TestMigration5VocabularyIsFrozen(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// migration 5 capitalized acronyms like any other word, and must keep doing so
+	assert.Equal("Ptsd", migration5Trait("PTSD"))
+	assert.Equal("Add/Adhd", migration5Trait(" ADD/ADHD"))
+	assert.Equal("Lack of Appetite", migration5Trait("LACK OF APPETITE"))
+	assert.Equal("Cr\u00e8me", migration5Trait("CRE\u0300ME"))
+	assert.Equal("sativa", migration5Race(" SATIVA"))
+}
+
+func TestMemoryStoreMatchesVocabularyInAnyCase(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := NewMemoryStore()
+	repr := StrainRepr{ID: 1, Name: "Afpak", Race: " Indica", Flavors: []string{"earthy", " Earthy", "pine", "CBD", ""}}
+	repr.Effects.Negative = []string{"dry  mouth"}
+	assert.Nil(store.CreateStrain(repr, WriteOptions{}))
+
+	s, err := store.StrainByRefID(1)
+	assert.Nil(err)
+	stored := s.ToStrainRepr()
+	assert.Equal("indica", stored.Race)
+	assert.Equal([]string{"Earthy", "Pine", "CBD"}, stored.Flavors)
+	assert.Equal([]string{"Dry Mouth"}, stored.Effects.Negative)
+
+	for _, search := range []func() (StrainPage, error){
+		func() (StrainPage, error) { return store.StrainsByRace("INDICA", ListOptions{}) },
+		func() (StrainPage, error) { return store.StrainsByFlavor("eARTHY", ListOptions{}) },
+		func() (StrainPage, error) { return store.StrainsByEffect("Dry mouth", ListOptions{}) },
+		func() (StrainPage, error) {
+			return store.SearchStrains(StrainQuery{Races: []string{"Indica"}, Flavors: []string{"pine"}}, ListOptions{})
+		},
+		func() (StrainPage, error) { return store.StrainsByFlavor(" CBD", ListOptions{}) },
+	} {
+		page, err := search()
+		assert.Nil(err)
+		assert.Equal(1, page.Total)
+	}
+}